@@ -0,0 +1,88 @@
+package cloudwatch
+
+// streamBacklog holds the batches of one log stream that its uploader
+// hasn't taken yet, if CLOUDWATCH_STREAM_BUFFER_LIMIT is set.
+type streamBacklog struct {
+	uploader *CloudwatchUploader
+	batches  []CloudwatchBatch // oldest first
+	events   int               // the messages in all the batches
+}
+
+// Queues the batch behind any others waiting for its stream, then sends
+// the stream's batches to its uploader until it's full. If the stream then
+// has more than bufferLimit messages waiting, the oldest are dropped.
+func (b *CloudwatchBatcher) queueBatch(uploader *CloudwatchUploader,
+	batch CloudwatchBatch) {
+	key := keyFor(batch.Msgs[0])
+	backlog, exists := b.backlogs[key]
+	if !exists {
+		backlog = &streamBacklog{uploader: uploader}
+		b.backlogs[key] = backlog
+	}
+	backlog.batches = append(backlog.batches, batch)
+	backlog.events = backlog.events + len(batch.Msgs)
+	b.sendBacklog(key, false)
+	if (backlog.events > b.bufferLimit) && !b.stopping {
+		b.evictOldest(backlog)
+	}
+}
+
+// Sends the stream's waiting batches to its uploader, oldest first, until
+// it's full - or until they're all sent, if wait is set.
+func (b *CloudwatchBatcher) sendBacklog(key batchKey, wait bool) {
+	backlog := b.backlogs[key]
+	for len(backlog.batches) > 0 {
+		batch := backlog.batches[0]
+		if wait {
+			backlog.uploader.Input <- batch
+		} else {
+			select {
+			case backlog.uploader.Input <- batch:
+			default:
+				return
+			}
+		}
+		backlog.batches = backlog.batches[1:]
+		backlog.events = backlog.events - len(batch.Msgs)
+	}
+	delete(b.backlogs, key)
+}
+
+// Sends the waiting batches of every stream, as in sendBacklog.
+func (b *CloudwatchBatcher) sendBacklogs(wait bool) {
+	for key := range b.backlogs {
+		b.sendBacklog(key, wait)
+	}
+}
+
+// Drops the stream's oldest waiting messages until no more than bufferLimit
+// are left, counting them as evicted.
+func (b *CloudwatchBatcher) evictOldest(backlog *streamBacklog) {
+	msg := backlog.batches[0].Msgs[0]
+	id := streamID{group: msg.Group, stream: msg.Stream}
+	b.adapter.log("evicting %d messages from %s-%s",
+		backlog.events-b.bufferLimit, msg.Group, msg.Stream)
+	for backlog.events > b.bufferLimit {
+		oldest := backlog.batches[0]
+		count := backlog.events - b.bufferLimit
+		if count >= len(oldest.Msgs) { // drop the whole batch
+			count = len(oldest.Msgs)
+			backlog.batches = backlog.batches[1:]
+			lags.Finished(id, count, false)
+			releaseBatch(oldest)
+		} else { // keep the batch's newest messages
+			remaining := NewCloudwatchBatch()
+			for i, evicted := range oldest.Msgs {
+				if i < count {
+					evicted.wal.Release()
+				} else {
+					remaining.Append(evicted)
+				}
+			}
+			backlog.batches[0] = *remaining
+			lags.Evicted(id, count)
+		}
+		backlog.events = backlog.events - count
+		drops.Add(DROP_EVICTED, count)
+	}
+}
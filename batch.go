@@ -1,6 +1,9 @@
 package cloudwatch
 
-import "time"
+import (
+	"time"
+	"unicode/utf8"
+)
 
 // CloudwatchMessage is a simple JSON input to Cloudwatch.
 type CloudwatchMessage struct {
@@ -9,20 +12,54 @@ type CloudwatchMessage struct {
 	Stream    string    `json:"stream"`
 	Time      time.Time `json:"time"`
 	Container string    `json:"container"`
+	Region    string    `json:"region,omitempty"` // "" for the default region
+	// tags and retention for the log group, if it must be created
+	Tags          map[string]string `json:"tags,omitempty"`
+	RetentionDays int               `json:"retention_days,omitempty"`
+	// if set, holds the message until it's uploaded
+	wal *walRecord
 }
 
 type CloudwatchBatch struct {
-	Msgs []CloudwatchMessage
-	Size int64
+	Msgs   []CloudwatchMessage
+	Size   int64
+	Oldest time.Time // the earliest message time
+	Newest time.Time // the latest message time
 }
 
 // Rules for creating Cloudwatch Log batches, from https://goo.gl/TrIN8c
-const MAX_BATCH_COUNT = 10000  // messages
-const MAX_BATCH_SIZE = 1048576 // bytes
-const MSG_OVERHEAD = 26        // bytes
+const MAX_BATCH_COUNT = 10000         // messages
+const MAX_BATCH_SIZE = 1048576        // bytes
+const MSG_OVERHEAD = 26               // bytes
+const MAX_EVENT_SIZE = 262144         // bytes, including MSG_OVERHEAD
+const MAX_BATCH_SPAN = 24 * time.Hour // from the oldest to newest message
 
+// ends each part of a message that was split by splitMessage, except the last
+const CONTINUATION_MARKER = "..."
+
+// returns the size of the message in a batch - its UTF-8 length plus overhead
 func msgSize(msg CloudwatchMessage) int64 {
-	return int64((len(msg.Message) * 8) + MSG_OVERHEAD)
+	return int64(len(msg.Message) + MSG_OVERHEAD)
+}
+
+// splits a message that is too large for a single Cloudwatch event into
+// several messages, without splitting any multibyte UTF-8 characters.
+func splitMessage(msg CloudwatchMessage) []CloudwatchMessage {
+	maxLen := MAX_EVENT_SIZE - MSG_OVERHEAD
+	parts := []CloudwatchMessage{}
+	text := msg.Message
+	for len(text) > maxLen {
+		cut := maxLen - len(CONTINUATION_MARKER)
+		for (cut > 0) && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		part := msg
+		part.Message = text[:cut] + CONTINUATION_MARKER
+		parts = append(parts, part)
+		text = text[cut:]
+	}
+	msg.Message = text
+	return append(parts, msg)
 }
 
 func NewCloudwatchBatch() *CloudwatchBatch {
@@ -33,6 +70,21 @@ func NewCloudwatchBatch() *CloudwatchBatch {
 }
 
 func (b *CloudwatchBatch) Append(msg CloudwatchMessage) {
+	if (len(b.Msgs) == 0) || msg.Time.Before(b.Oldest) {
+		b.Oldest = msg.Time
+	}
+	if (len(b.Msgs) == 0) || msg.Time.After(b.Newest) {
+		b.Newest = msg.Time
+	}
 	b.Msgs = append(b.Msgs, msg)
 	b.Size = b.Size + msgSize(msg)
 }
+
+// returns true if adding the message would make the batch span too long
+func (b *CloudwatchBatch) exceedsSpan(msg CloudwatchMessage) bool {
+	if len(b.Msgs) == 0 {
+		return false
+	}
+	return (msg.Time.Sub(b.Oldest) > MAX_BATCH_SPAN) ||
+		(b.Newest.Sub(msg.Time) > MAX_BATCH_SPAN)
+}
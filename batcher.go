@@ -1,9 +1,15 @@
 package cloudwatch
 
 import (
+	"fmt"
+	"hash/fnv"
 	"log"
+	"math/rand"
 	"os"
+	"path"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gliderlabs/logspout/router"
@@ -11,63 +17,534 @@ import (
 
 const DEFAULT_DELAY = 4 //seconds
 
+// the number of uploaders for each AWS region
+const DEFAULT_UPLOAD_WORKERS = 1
+
+// multiline entries are submitted after receiving no new lines for this long
+const DEFAULT_MULTILINE_TIMEOUT = time.Second
+
+// repeated lines are collapsed into one message for at most this long
+const DEFAULT_DEDUP_WINDOW = 10 * time.Second
+
 // CloudwatchBatcher receieves Cloudwatch messages on its input channel,
 // stores them in CloudwatchBatches until enough data is ready to send, then
-// sends each CloudwatchMessageBatch on its output channel.
+// sends each CloudwatchMessageBatch to the CloudwatchUploader for its region.
 type CloudwatchBatcher struct {
-	Input  chan CloudwatchMessage
-	output chan CloudwatchBatch
-	route  *router.Route
-	timer  chan bool
-	// maintain a batch for each container, indexed by its name
-	batches map[string]*CloudwatchBatch
+	Input chan CloudwatchMessage
+	Done  chan bool   // closed once Input is closed and all batches uploaded
+	Flush chan string // submits the batches for the given container ID
+	route *router.Route
+	timer chan bool
+	// maintain uploaders for each AWS region - "" is the default region
+	adapter   *CloudwatchAdapter
+	uploaders map[string][]*CloudwatchUploader
+	workers   int // uploaders per region, each handling its own streams
+	// maintain a batch for each log stream
+	batches map[batchKey]*CloudwatchBatch
+	// submit all batches this often, or whenever one holds maxCount messages
+	interval time.Duration
+	jitter   int        // percent of the interval to randomly add or subtract
+	random   *rand.Rand // seeded per process, so instances differ
+	maxCount int
+	// if set, the longest any message waits before its batch is submitted
+	maxLatency time.Duration
+	// if set, combine the lines of each entry into one message, using the
+	// pattern as set by multilineMatch (see multiline.go)
+	multiline        *regexp.Regexp
+	multilineMatch   string
+	multilineTimeout time.Duration
+	// true if the MULTILINE_* options of logspout's adapter are used
+	multilineShared bool
+	pending         map[pendingKey]*pendingEntry
+	limiter         *RateLimiter // if set, limits events per stream
+	denylist        []string     // glob patterns of groups not to upload
+	// if set, drop batches when an uploader is full, instead of waiting
+	dropWhenFull bool
+	// if set, keep up to this many messages per stream while its uploader is
+	// full, dropping the oldest, instead of waiting
+	bufferLimit int
+	backlogs    map[batchKey]*streamBacklog
+	stopping    bool // set once Input is closed, so nothing is evicted
+	// if set, collapse identical consecutive lines into one message
+	dedup       bool
+	dedupWindow time.Duration
+	repeated    map[pendingKey]*repeatedEntry
+}
+
+// batchKey identifies the log stream that a message is batched for.
+type batchKey struct {
+	region string
+	group  string
+	stream string
+}
+
+// returns the key of the batch that the given message belongs in
+func keyFor(msg CloudwatchMessage) batchKey {
+	return batchKey{region: msg.Region, group: msg.Group, stream: msg.Stream}
+}
+
+// pendingKey identifies a container's multiline entry for one log stream.
+type pendingKey struct {
+	container string
+	batch     batchKey
+}
+
+// pendingEntry is a multiline message that may still receive more lines.
+type pendingEntry struct {
+	msg     CloudwatchMessage
+	started time.Time // when the first line was received
+	updated time.Time // when the last line was received
+}
+
+// repeatedEntry is a line that may still be repeated.
+type repeatedEntry struct {
+	msg   CloudwatchMessage
+	count int
+	first time.Time // when the line was first received
 }
 
 // constructor for CloudwatchBatcher - requires the adapter
 func NewCloudwatchBatcher(adapter *CloudwatchAdapter) *CloudwatchBatcher {
+	maxCount := getIntOption(adapter.Route, `CLOUDWATCH_BATCH_SIZE`,
+		MAX_BATCH_COUNT)
+	if (maxCount > MAX_BATCH_COUNT) || (maxCount < 1) {
+		log.Printf("cloudwatch: WARNING: CLOUDWATCH_BATCH_SIZE must be from "+
+			"1 to %d, using %d\n", MAX_BATCH_COUNT, MAX_BATCH_COUNT)
+		maxCount = MAX_BATCH_COUNT
+	}
+	workers := getIntOption(adapter.Route, `CLOUDWATCH_UPLOAD_WORKERS`,
+		DEFAULT_UPLOAD_WORKERS)
+	if workers < 1 {
+		log.Printf("cloudwatch: WARNING: CLOUDWATCH_UPLOAD_WORKERS must be "+
+			"at least 1, using %d\n", DEFAULT_UPLOAD_WORKERS)
+		workers = DEFAULT_UPLOAD_WORKERS
+	}
+	inputBuffer := getIntOption(adapter.Route, `CLOUDWATCH_INPUT_BUFFER`, 0)
+	if inputBuffer < 0 {
+		log.Printf("cloudwatch: WARNING: CLOUDWATCH_INPUT_BUFFER must be at "+
+			"least 0, ignoring %d\n", inputBuffer)
+		inputBuffer = 0
+	}
 	batcher := CloudwatchBatcher{
-		Input:   make(chan CloudwatchMessage),
-		output:  NewCloudwatchUploader(adapter).Input,
-		batches: map[string]*CloudwatchBatch{},
-		timer:   make(chan bool),
-		route:   adapter.Route,
+		Input:     make(chan CloudwatchMessage, inputBuffer),
+		Done:      make(chan bool),
+		Flush:     make(chan string),
+		adapter:   adapter,
+		uploaders: map[string][]*CloudwatchUploader{},
+		workers:   workers,
+		batches:   map[batchKey]*CloudwatchBatch{},
+		timer:     make(chan bool),
+		route:     adapter.Route,
+		maxCount:  maxCount,
+		pending:   map[pendingKey]*pendingEntry{},
+		repeated:  map[pendingKey]*repeatedEntry{},
+		backlogs:  map[batchKey]*streamBacklog{},
+	}
+	batcher.uploaders[""] = batcher.newUploaders("")
+	batcher.interval = getDurationOption(adapter.Route,
+		`CLOUDWATCH_BATCH_INTERVAL`, batcher.delay())
+	if batcher.interval <= 0 {
+		batcher.interval = batcher.delay()
+		log.Printf("cloudwatch: WARNING: CLOUDWATCH_BATCH_INTERVAL must be "+
+			"more than 0, using %s\n", batcher.interval)
 	}
+	batcher.jitter = getIntOption(adapter.Route, `CLOUDWATCH_FLUSH_JITTER`, 0)
+	if (batcher.jitter < 0) || (batcher.jitter > 100) {
+		log.Printf("cloudwatch: WARNING: CLOUDWATCH_FLUSH_JITTER must be "+
+			"from 0 to 100, ignoring %d\n", batcher.jitter)
+		batcher.jitter = 0
+	}
+	batcher.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	batcher.maxLatency = getDurationOption(adapter.Route,
+		`CLOUDWATCH_MAX_LATENCY`, 0)
+	batcher.setMultiline(adapter.Route)
+	if policy, isSet := getOption(adapter.Route,
+		`CLOUDWATCH_INFLIGHT_POLICY`); isSet {
+		switch policy {
+		case `drop`:
+			batcher.dropWhenFull = true
+		case `block`:
+		default:
+			log.Printf("cloudwatch: WARNING: ERROR parsing "+
+				"CLOUDWATCH_INFLIGHT_POLICY %s, using block\n", policy)
+		}
+	}
+	batcher.bufferLimit = getIntOption(adapter.Route,
+		`CLOUDWATCH_STREAM_BUFFER_LIMIT`, 0)
+	batcher.dedup = getBoolOption(adapter.Route, `CLOUDWATCH_DEDUP`, false)
+	batcher.dedupWindow = getDurationOption(adapter.Route,
+		`CLOUDWATCH_DEDUP_WINDOW`, DEFAULT_DEDUP_WINDOW)
+	if rate := getIntOption(adapter.Route, `CLOUDWATCH_MAX_EVENTS_PER_SEC`,
+		0); rate > 0 {
+		batcher.limiter = NewRateLimiter(rate)
+	}
+	batcher.denylist = getGroupDenylist(adapter.Route)
+	batcher.logSummary()
 	go batcher.Start()
 	return &batcher
 }
 
+// returns the glob patterns listed in CLOUDWATCH_GROUP_DENYLIST, leaving out
+// any that can't be parsed, with a warning
+func getGroupDenylist(route *router.Route) []string {
+	list, isSet := getOption(route, `CLOUDWATCH_GROUP_DENYLIST`)
+	if !isSet {
+		return nil
+	}
+	patterns := []string{}
+	for _, pattern := range strings.Split(list, `,`) {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Printf("cloudwatch: WARNING: ERROR parsing "+
+				"CLOUDWATCH_GROUP_DENYLIST pattern %s, ignoring it: %s\n",
+				pattern, err)
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// returns true if the group matches a CLOUDWATCH_GROUP_DENYLIST pattern
+func (b *CloudwatchBatcher) denied(group string) bool {
+	for _, pattern := range b.denylist {
+		if matched, _ := path.Match(pattern, group); matched {
+			return true
+		}
+	}
+	return false
+}
+
 // Main loop for the Batcher - just sorts each messages into a batch, but
 // submits the batch first and replaces it if the message is too big.
 func (b *CloudwatchBatcher) Start() {
 	go b.RunTimer()
 	for { // run forever, and...
-		select { // either batch up a message, or respond to the timer
-		case msg := <-b.Input: // a message - put it into its slice
+		select { // either batch up a message, or respond to a flush or timer
+		case msg, open := <-b.Input: // a message - put it into its slice
+			if !open { // no more messages - submit everything and stop
+				b.shutdown()
+				return
+			}
 			if len(msg.Message) == 0 { // empty messages are not allowed
+				drops.Add(DROP_EMPTY, 1)
+				msg.wal.Release()
 				break
 			}
-			// get or create the correct slice of messages for this message
-			if _, exists := b.batches[msg.Container]; !exists {
-				b.batches[msg.Container] = NewCloudwatchBatch()
-			}
-			// if Msg is too long for the current batch, submit the batch
-			if (b.batches[msg.Container].Size+msgSize(msg)) > MAX_BATCH_SIZE ||
-				len(b.batches[msg.Container].Msgs) >= MAX_BATCH_COUNT {
-				b.output <- *b.batches[msg.Container]
-				b.batches[msg.Container] = NewCloudwatchBatch()
+			if b.dedup {
+				b.addRepeat(msg)
+			} else {
+				b.queueLine(msg)
 			}
-			thisBatch := b.batches[msg.Container]
-			thisBatch.Append(msg)
+		case container := <-b.Flush: // submit one container's messages
+			b.flushContainer(container)
 		case <-b.timer: // submit and delete all existing batches
-			for container, batch := range b.batches {
-				b.output <- *batch
-				delete(b.batches, container)
+			b.submitRepeated(b.dedupWindow)
+			b.submitPending(b.multilineTimeout)
+			b.submitBatches()
+			b.sendBacklogs(false)
+			if b.limiter != nil {
+				b.limiter.LogDropped()
 			}
+			b.logLag()
+		}
+	}
+}
+
+// Counts a line if it repeats the previous line from its container and
+// stream, within the dedup window. Otherwise, the previous line is queued,
+// and this line is kept to count any repeats.
+func (b *CloudwatchBatcher) addRepeat(msg CloudwatchMessage) {
+	key := pendingKey{container: msg.Container, batch: keyFor(msg)}
+	entry, exists := b.repeated[key]
+	if exists && (entry.msg.Message == msg.Message) &&
+		(time.Since(entry.first) < b.dedupWindow) {
+		entry.count++
+		entry.msg.wal.Join(msg.wal) // replayed along with the first copy
+		return
+	}
+	if exists {
+		b.queueRepeated(entry)
+	}
+	b.repeated[key] = &repeatedEntry{msg: msg, count: 1, first: time.Now()}
+}
+
+// Queues the line, noting how many times it was repeated.
+func (b *CloudwatchBatcher) queueRepeated(entry *repeatedEntry) {
+	msg := entry.msg
+	if entry.count > 1 {
+		msg.Message = fmt.Sprintf("%s (repeated %d times)", msg.Message,
+			entry.count)
+	}
+	b.queueLine(msg)
+}
+
+// Queues all the repeated lines first received at least maxAge ago, or
+// that are overdue.
+func (b *CloudwatchBatcher) submitRepeated(maxAge time.Duration) {
+	for key, entry := range b.repeated {
+		if (time.Since(entry.first) >= maxAge) || b.overdue(entry.first) {
+			b.queueRepeated(entry)
+			delete(b.repeated, key)
+		}
+	}
+}
+
+// Adds a line to its multiline entry, if a multiline pattern is set, or
+// else batches it.
+func (b *CloudwatchBatcher) queueLine(msg CloudwatchMessage) {
+	if b.multiline != nil {
+		b.addLine(msg)
+	} else {
+		b.batchEntry(msg)
+	}
+}
+
+// Adds a line to the pending multiline entry for its container and stream.
+// If the line starts a new entry, the previous entry is batched first, and
+// if it ends its entry, the entry is batched right away.
+func (b *CloudwatchBatcher) addLine(msg CloudwatchMessage) {
+	key := pendingKey{container: msg.Container, batch: keyFor(msg)}
+	entry, exists := b.pending[key]
+	if exists && !b.startsEntry(msg.Message) {
+		entry.msg.Message = entry.msg.Message + "\n" + msg.Message
+		entry.updated = time.Now()
+		entry.msg.wal.Join(msg.wal) // replayed along with the first line
+	} else {
+		if exists {
+			b.batchEntry(entry.msg)
+		}
+		entry = &pendingEntry{msg: msg, started: time.Now(),
+			updated: time.Now()}
+		b.pending[key] = entry
+	}
+	if b.endsEntry(msg.Message) {
+		b.batchEntry(entry.msg)
+		delete(b.pending, key)
+	}
+}
+
+// Batches all the pending multiline entries not updated within maxAge, or
+// that are overdue.
+func (b *CloudwatchBatcher) submitPending(maxAge time.Duration) {
+	for key, entry := range b.pending {
+		if (time.Since(entry.updated) >= maxAge) || b.overdue(entry.started) {
+			b.batchEntry(entry.msg)
+			delete(b.pending, key)
+		}
+	}
+}
+
+// Submits every batch and waiting entry, waits for them all to be uploaded,
+// then closes Done. Nothing is evicted from the backlogs, which are all
+// sent, however long that takes.
+func (b *CloudwatchBatcher) shutdown() {
+	b.stopping = true
+	b.submitRepeated(0)
+	b.submitPending(0)
+	b.submitBatches()
+	b.sendBacklogs(true)
+	b.stopUploaders()
+	close(b.Done)
+}
+
+// Submits and deletes all existing batches.
+func (b *CloudwatchBatcher) submitBatches() {
+	for key, batch := range b.batches {
+		b.submit(*batch)
+		delete(b.batches, key)
+	}
+}
+
+// Queues the given container's repeated lines and batches its pending
+// multiline entries, then submits and deletes every batch holding any of
+// its messages.
+func (b *CloudwatchBatcher) flushContainer(container string) {
+	for key, entry := range b.repeated {
+		if key.container == container {
+			b.queueRepeated(entry)
+			delete(b.repeated, key)
+		}
+	}
+	for key, entry := range b.pending {
+		if key.container == container {
+			b.batchEntry(entry.msg)
+			delete(b.pending, key)
+		}
+	}
+	for key, batch := range b.batches {
+		for _, msg := range batch.Msgs {
+			if msg.Container == container {
+				b.submit(*batch)
+				delete(b.batches, key)
+				break
+			}
+		}
+	}
+}
+
+// Batches a complete log entry, first splitting any message too large
+// to be a single event. Entries for denylisted groups, or over the rate
+// limit, are dropped.
+func (b *CloudwatchBatcher) batchEntry(msg CloudwatchMessage) {
+	if b.denied(msg.Group) {
+		drops.Add(DROP_DENYLISTED, 1)
+		msg.wal.Release()
+		return
+	}
+	if (b.limiter != nil) && !b.limiter.Allow(msg) {
+		drops.Add(DROP_RATE_LIMITED, 1)
+		msg.wal.Release()
+		return
+	}
+	parts := splitMessage(msg)
+	msg.wal.Add(len(parts) - 1) // each part is released separately
+	for _, part := range parts {
+		b.batchMessage(part)
+	}
+}
+
+// Adds a message to the batch for its stream, first submitting the batch
+// if the message would make it too large, and submitting it afterwards
+// if it has reached the maximum message count or size.
+func (b *CloudwatchBatcher) batchMessage(msg CloudwatchMessage) {
+	// get or create the correct slice of messages for this message
+	key := keyFor(msg)
+	if _, exists := b.batches[key]; !exists {
+		b.batches[key] = NewCloudwatchBatch()
+		lags.Started(streamID{group: msg.Group, stream: msg.Stream})
+	}
+	// if Msg is too long for the current batch, or too far apart in time
+	// from its other messages, submit the batch
+	thisBatch := b.batches[key]
+	if (len(thisBatch.Msgs) > 0) &&
+		((thisBatch.Size+msgSize(msg)) > MAX_BATCH_SIZE ||
+			len(thisBatch.Msgs) >= b.maxCount ||
+			thisBatch.exceedsSpan(msg)) {
+		b.submit(*thisBatch)
+		thisBatch = NewCloudwatchBatch()
+		b.batches[key] = thisBatch
+		lags.Started(streamID{group: msg.Group, stream: msg.Stream})
+	}
+	thisBatch.Append(msg)
+	lags.Added(streamID{group: msg.Group, stream: msg.Stream})
+	// submit the batch right away once it's full
+	if (len(thisBatch.Msgs) >= b.maxCount) ||
+		(thisBatch.Size >= MAX_BATCH_SIZE) {
+		b.submit(*thisBatch)
+		delete(b.batches, key)
+	}
+}
+
+// Sends a batch to the uploader for its stream, in its region, creating
+// the region's uploaders as needed. Each stream always uses the same
+// uploader, so its batches are uploaded in order, one at a time.
+// If the uploader already holds CLOUDWATCH_MAX_INFLIGHT batches, this
+// waits for it - or drops the batch, if dropWhenFull is set, or queues it
+// in the stream's backlog, if bufferLimit is set.
+func (b *CloudwatchBatcher) submit(batch CloudwatchBatch) {
+	region := batch.Msgs[0].Region
+	uploaders, exists := b.uploaders[region]
+	if !exists {
+		uploaders = b.newUploaders(region)
+		b.uploaders[region] = uploaders
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(batch.Msgs[0].Group + "\n" + batch.Msgs[0].Stream))
+	uploader := uploaders[hash.Sum32()%uint32(len(uploaders))]
+	if b.bufferLimit > 0 {
+		b.queueBatch(uploader, batch)
+		return
+	}
+	if !b.dropWhenFull {
+		uploader.Input <- batch
+		return
+	}
+	select {
+	case uploader.Input <- batch:
+	default:
+		msg := batch.Msgs[0]
+		log.Printf("cloudwatch: WARNING: uploader is full, dropping batch "+
+			"for %s-%s (length %d, size %v)\n", msg.Group, msg.Stream,
+			len(batch.Msgs), batch.Size)
+		reportError(batch, errUploaderFull)
+		lags.Finished(streamID{group: msg.Group, stream: msg.Stream},
+			len(batch.Msgs), false)
+		releaseBatch(batch)
+	}
+}
+
+// creates the uploaders for the given region
+func (b *CloudwatchBatcher) newUploaders(region string) []*CloudwatchUploader {
+	uploaders := []*CloudwatchUploader{}
+	for i := 0; i < b.workers; i++ {
+		uploaders = append(uploaders, NewCloudwatchUploader(b.adapter, region))
+	}
+	return uploaders
+}
+
+// Closes the input of every uploader, then waits for them to finish.
+func (b *CloudwatchBatcher) stopUploaders() {
+	for _, uploaders := range b.uploaders {
+		for _, uploader := range uploaders {
+			close(uploader.Input)
+		}
+	}
+	for _, uploaders := range b.uploaders {
+		for _, uploader := range uploaders {
+			<-uploader.Done
+		}
+	}
+}
+
+// logs the lag of each stream with messages still to upload, in debug mode
+func (b *CloudwatchBatcher) logLag() {
+	if !b.adapter.debugSet {
+		return
+	}
+	for _, lag := range lags.Values() {
+		if lag.bufferedCount > 0 {
+			b.adapter.log("Stream %s-%s has %d batches to upload, oldest "+
+				"started %v ago, last uploaded %v ago", lag.id.group,
+				lag.id.stream, lag.bufferedCount, lag.oldestAge, lag.sinceFlush)
 		}
 	}
 }
 
 func (b *CloudwatchBatcher) RunTimer() {
+	for {
+		time.Sleep(b.nextInterval())
+		b.timer <- true
+	}
+}
+
+// returns the time until the next flush - the interval, plus or minus
+// a random amount up to the jitter percentage, but no more than half of
+// CLOUDWATCH_MAX_LATENCY, if it's set
+func (b *CloudwatchBatcher) nextInterval() time.Duration {
+	interval := b.interval
+	if maxJitter := int64(b.interval) * int64(b.jitter) / 100; maxJitter > 0 {
+		interval = interval +
+			time.Duration(b.random.Int63n(2*maxJitter+1)-maxJitter)
+	}
+	if (b.maxLatency > 0) && (interval > b.maxLatency/2) {
+		interval = b.maxLatency / 2
+	}
+	return interval
+}
+
+// Returns true if a repeated line or multiline entry that started at the
+// given time must be batched now, to be submitted within the maximum
+// latency. Since each flush comes within half the maximum latency, it's
+// batched at the first flush after half the maximum latency has passed.
+func (b *CloudwatchBatcher) overdue(started time.Time) bool {
+	return (b.maxLatency > 0) && (time.Since(started) >= b.maxLatency/2)
+}
+
+// returns the flush interval set by the DELAY option, in seconds
+func (b *CloudwatchBatcher) delay() time.Duration {
 	delayText := strconv.Itoa(DEFAULT_DELAY)
 	if routeDelay, isSet := b.route.Options[`DELAY`]; isSet {
 		delayText = routeDelay
@@ -81,8 +558,5 @@ func (b *CloudwatchBatcher) RunTimer() {
 			delayText, DEFAULT_DELAY)
 		delay = DEFAULT_DELAY
 	}
-	for {
-		time.Sleep(time.Duration(delay) * time.Second)
-		b.timer <- true
-	}
+	return time.Duration(delay) * time.Second
 }
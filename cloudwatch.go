@@ -1,15 +1,65 @@
 package cloudwatch
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/gliderlabs/logspout/router"
 )
 
+// containers with this label set to "false" are not shipped to Cloudwatch
+const DEFAULT_FILTER_LABEL = `LOGSPOUT_CLOUDWATCH`
+
+// containers with this label set the retention of the log groups they create
+const DEFAULT_RETENTION_LABEL = `CLOUDWATCH_RETENTION_DAYS`
+
+// how long to wait for the remaining logs to upload, when stopped by a signal
+const DEFAULT_SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// ANSI escape sequences: CSI sequences such as colors and cursor movement,
+// OSC sequences such as window titles, and other two-character escapes
+var ansiEscapes = regexp.MustCompile("\x1b\\[[0-?]*[ -/]*[@-~]" +
+	"|\x1b\\][^\x07\x1b]*(\x07|\x1b\\\\)|\x1b[@-Z\\\\-_]")
+
+// CLOUDWATCH_LOGGER_HOST value that names the logger host after its instance
+const LOGGER_HOST_INSTANCE_ID = `instance-id`
+
+// the delay before recreating the Docker client after a connection error,
+// which doubles after each attempt, up to the maximum
+const DEFAULT_RECONNECT_DELAY = time.Second
+const MAX_RECONNECT_DELAY = time.Minute
+
+// the number of containers that may be inspected at once
+const DEFAULT_INSPECT_WORKERS = 4
+
+// how long to use default names for a container that couldn't be inspected,
+// before trying to inspect it again
+const INSPECT_RETRY_DELAY = 5 * time.Second
+
+// how often each container's cached log names are rendered again, so names
+// that use the date template function rotate without a restart
+const NAMES_PERIOD = time.Hour
+
+// with CLOUDWATCH_NO_DOCKER, there are no destroy events, so the cached info
+// of containers that have sent nothing for this long is removed instead
+const IDLE_SWEEP_PERIOD = 10 * time.Minute
+
+// the adapters whose Stream loop is running, so that on a signal, the
+// process exits only once all of them have uploaded their remaining logs
+var streaming sync.WaitGroup
+
 func init() {
 	router.AdapterFactories.Register(NewCloudwatchAdapter, "cloudwatch")
 }
@@ -24,10 +74,126 @@ type CloudwatchAdapter struct {
 	Ec2Region   string
 	Ec2Instance string
 
-	client      *docker.Client
-	batcher     *CloudwatchBatcher // batches up messages by log group and stream
-	groupnames  map[string]string  // maps container names to log groups
-	streamnames map[string]string  // maps container names to log streams
+	// if noDocker is set, there is no client, and nothing is inspected
+	client     *docker.Client
+	dockerHost string
+	noDocker   bool
+	events     chan *docker.APIEvents    // Docker container events
+	batcher    *CloudwatchBatcher        // batches messages by group and stream
+	containers map[string]*containerInfo // cached info, by container ID
+	cacheTTL   time.Duration             // 0 caches forever
+	// when the Docker client may next be recreated, and the delay after that
+	nextReconnect  time.Time
+	reconnectDelay time.Duration
+	// messages from containers being inspected, in order, by container ID
+	waiting      map[string][]*router.Message
+	inspected    chan inspection   // the results of each container inspection
+	inspectSlots chan bool         // limits how many inspections run at once
+	tags         map[string]string // templates for new log group tags
+	filterLabel  string            // label that opts containers in or out
+	optIn        bool              // if set, only ship opted-in containers
+	requireGroup bool              // if set, drop logs with no group set
+	// label that sets the retention of new groups, in days
+	retentionLabel string
+	// containers warned about logging to the default group
+	defaultGroups map[string]bool
+	signals       chan os.Signal // SIGTERM or SIGINT, to stop the adapter
+	stopTimeout   time.Duration  // max time to upload logs after a signal
+	// replaces invalid characters in group and stream names
+	nameReplacement string
+	invalidNames    map[string]bool // names that have been warned about
+	skipEmpty       bool            // if set, drop whitespace-only messages
+	parseJSON       bool            // if set, render names per JSON message
+	stripANSI       bool            // if set, remove ANSI escape sequences
+	keepNameSlash   bool            // if set, keep the "/" that starts names
+	// if set, read each message's time from the pattern's first capture group
+	timestampPattern *regexp.Regexp
+	timestampFormat  string // the time.Parse layout for timestampPattern
+	// the time zone of rendered timestamps, such as in the JSON envelope
+	timezone *time.Location
+	// if set, stores messages until they're uploaded, to survive restarts
+	wal      *WriteAheadLog
+	replayed []CloudwatchMessage // unsent messages from the last run
+	// templates for text added before and after each message
+	msgPrefix string
+	msgSuffix string
+	// if set, an awslogs-style tag template for the default stream name
+	streamTag string
+	// templates for the group and stream names, if theirs can't be rendered
+	fallbackGroup  string
+	fallbackStream string
+	// templates for the group and stream names, if theirs aren't set
+	defaultGroup  string
+	defaultStream string
+	// group and stream templates for containers, by name, in order
+	configRules []configRule
+	precedence  []string // the sources of renderEnvValue, lowest first
+	// templates defined in CLOUDWATCH_TEMPLATE_FILE, for renderEnvValue
+	templates *template.Template
+	// if set, send messages matching their patterns to other streams
+	streamRoutes []streamRoute
+	// if set, add the suffix for each message's level to its stream name
+	levelPattern *regexp.Regexp
+	levelStreams map[string]string // stream suffixes, by upper-case level
+	// the patterns of CLOUDWATCH_DROP_PATTERN, whose matching lines are dropped
+	dropPatterns []*regexp.Regexp
+	// if set, the stream template for the recent lines of crashed containers
+	crashStream string
+	crashLines  int                     // how many recent lines to send
+	recent      map[string]*recentLines // recent lines, by container ID
+	// if set, ticks every CLOUDWATCH_HEARTBEAT_INTERVAL
+	heartbeats      <-chan time.Time
+	heartbeatStream string // the stream that heartbeats are sent to
+	// if CLOUDWATCH_MERGE_PARTIAL is set, the lines split by Docker, by
+	// container ID and source, and a ticker to send them on if they stall
+	partials     map[string]*partialLine
+	partialTicks <-chan time.Time
+	// with CLOUDWATCH_NO_DOCKER, ticks every IDLE_SWEEP_PERIOD
+	idleSweeps <-chan time.Time
+	// if set, the fields of a JSON envelope to wrap each message in
+	envelopeFields []string
+	nestedJSON     bool     // if set, nest JSON messages in the envelope
+	insightsJSON   bool     // if set, use the INSIGHTS_KEYS in the envelope
+	labelKeys      []string // the container labels to add to each message
+	envPrefix      string   // prefix of the container env vars to add
+	debugSet       bool
+}
+
+// containerInfo holds everything computed from inspecting a container.
+type containerInfo struct {
+	names  map[string]*logNames // log names, by message source
+	region string               // AWS region, if not the default
+	ship   bool                 // false if the container was filtered out
+	tags   map[string]string    // tags for the log group, if it's created
+	prefix string               // rendered CLOUDWATCH_MSG_PREFIX
+	suffix string               // rendered CLOUDWATCH_MSG_SUFFIX
+	// the retention for the log group, if it's created, or 0 for the default
+	retentionDays int
+	// the labels named by CLOUDWATCH_LABEL_FIELDS, and their message prefix
+	labelFields []labelField
+	labelPrefix string
+	// the env vars named by CLOUDWATCH_ENV_PREFIX, without the prefix
+	envFields []labelField
+	// the context the names were rendered in, to render them per message
+	context *RenderContext
+	expires time.Time // if set, when to inspect the container again
+	idle    bool      // set by each idle sweep, cleared by each message
+}
+
+// inspection is the result of inspecting the container that sent msg.
+type inspection struct {
+	msg       *router.Message
+	container *docker.Container
+	err       error
+}
+
+// logNames are the log group and stream names rendered for a message.
+type logNames struct {
+	groups []string
+	stream string
+	routes []string // the streams of the CLOUDWATCH_STREAM_ROUTES, in order
+	// the NAMES_PERIOD in which the names were rendered
+	period time.Time
 }
 
 // NewCloudwatchAdapter creates a CloudwatchAdapter for the current region.
@@ -36,9 +202,13 @@ func NewCloudwatchAdapter(route *router.Route) (router.LogAdapter, error) {
 	if envVal := os.Getenv(`DOCKER_HOST`); envVal != "" {
 		dockerHost = envVal
 	}
-	client, err := docker.NewClient(dockerHost)
-	if err != nil {
-		return nil, err
+	var client *docker.Client
+	noDocker := getBoolOption(route, `CLOUDWATCH_NO_DOCKER`, false)
+	if !noDocker {
+		var err error
+		if client, err = newDockerClient(dockerHost); err != nil {
+			return nil, err
+		}
 	}
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -49,58 +219,779 @@ func NewCloudwatchAdapter(route *router.Route) (router.LogAdapter, error) {
 		return nil, err
 	}
 	adapter := CloudwatchAdapter{
-		Route:       route,
-		OsHost:      hostname,
-		Ec2Instance: ec2info.InstanceID,
-		Ec2Region:   ec2info.Region,
-		client:      client,
-		groupnames:  map[string]string{},
-		streamnames: map[string]string{},
+		Route:           route,
+		OsHost:          loggerHost(route, hostname, ec2info),
+		Ec2Instance:     ec2info.InstanceID,
+		Ec2Region:       ec2info.Region,
+		client:          client,
+		dockerHost:      dockerHost,
+		noDocker:        noDocker,
+		reconnectDelay:  DEFAULT_RECONNECT_DELAY,
+		events:          make(chan *docker.APIEvents),
+		containers:      map[string]*containerInfo{},
+		waiting:         map[string][]*router.Message{},
+		inspected:       make(chan inspection),
+		filterLabel:     DEFAULT_FILTER_LABEL,
+		retentionLabel:  DEFAULT_RETENTION_LABEL,
+		signals:         make(chan os.Signal, 1),
+		nameReplacement: DEFAULT_NAME_REPLACEMENT,
+		invalidNames:    map[string]bool{},
+		defaultGroups:   map[string]bool{},
+		recent:          map[string]*recentLines{},
+		stopTimeout: getDurationOption(route, `CLOUDWATCH_SHUTDOWN_TIMEOUT`,
+			DEFAULT_SHUTDOWN_TIMEOUT),
+	}
+	if label, isSet := getOption(route, `CLOUDWATCH_FILTER_LABEL`); isSet {
+		adapter.filterLabel = label
+	}
+	if label, isSet := getOption(route,
+		`CLOUDWATCH_RETENTION_LABEL`); isSet {
+		adapter.retentionLabel = label
+	}
+	workers := getIntOption(route, `CLOUDWATCH_INSPECT_WORKERS`,
+		DEFAULT_INSPECT_WORKERS)
+	if workers < 1 {
+		log.Printf("cloudwatch: WARNING: CLOUDWATCH_INSPECT_WORKERS must be "+
+			"at least 1, using %d\n", DEFAULT_INSPECT_WORKERS)
+		workers = DEFAULT_INSPECT_WORKERS
 	}
+	adapter.inspectSlots = make(chan bool, workers)
+	adapter.cacheTTL = getDurationOption(route, `CLOUDWATCH_CACHE_TTL`, 0)
+	if adapter.cacheTTL < 0 { // would inspect the container for each message
+		log.Printf("cloudwatch: WARNING: CLOUDWATCH_CACHE_TTL must not be "+
+			"negative, ignoring %v\n", adapter.cacheTTL)
+		adapter.cacheTTL = 0
+	}
+	_, adapter.optIn = getOption(route, `CLOUDWATCH_OPT_IN`)
+	adapter.requireGroup = getBoolOption(route, `CLOUDWATCH_REQUIRE_GROUP`,
+		false)
+	adapter.skipEmpty = getBoolOption(route, `CLOUDWATCH_SKIP_EMPTY`, true)
+	adapter.dropPatterns = getDropPatterns(route)
+	adapter.setCrashContext(route)
+	adapter.setHeartbeat(route)
+	adapter.setMergePartial(route)
+	adapter.parseJSON = getBoolOption(route, `CLOUDWATCH_PARSE_JSON`, false)
+	adapter.stripANSI = getBoolOption(route, `CLOUDWATCH_STRIP_ANSI`, false)
+	adapter.keepNameSlash = getBoolOption(route, `CLOUDWATCH_KEEP_NAME_SLASH`,
+		false)
+	adapter.debugSet = isDebugSet(route)
+	if pattern, isSet := getOption(route,
+		`CLOUDWATCH_TIMESTAMP_PATTERN`); isSet {
+		if adapter.timestampPattern, err = regexp.Compile(pattern); err != nil {
+			log.Printf("cloudwatch: WARNING: ERROR parsing "+
+				"CLOUDWATCH_TIMESTAMP_PATTERN %s, ignoring it: %s\n",
+				pattern, err)
+		}
+		adapter.timestampFormat = time.RFC3339
+		if format, isSet := getOption(route,
+			`CLOUDWATCH_TIMESTAMP_FORMAT`); isSet {
+			adapter.timestampFormat = format
+		}
+	}
+	if replacement, isSet := getOption(route,
+		`CLOUDWATCH_NAME_REPLACEMENT`); isSet {
+		adapter.nameReplacement = replacement
+	}
+	adapter.msgPrefix, _ = getOption(route, `CLOUDWATCH_MSG_PREFIX`)
+	adapter.msgSuffix, _ = getOption(route, `CLOUDWATCH_MSG_SUFFIX`)
+	adapter.envelopeFields = getEnvelopeFields(route)
+	adapter.nestedJSON = getBoolOption(route, `CLOUDWATCH_NESTED_JSON`, false)
+	adapter.insightsJSON = getBoolOption(route, `CLOUDWATCH_INSIGHTS_JSON`,
+		false)
+	adapter.timezone = time.UTC
+	if zone, isSet := getOption(route, `CLOUDWATCH_TIMEZONE`); isSet {
+		location, err := time.LoadLocation(zone)
+		if err != nil {
+			log.Printf("cloudwatch: WARNING: ERROR parsing CLOUDWATCH_TIMEZONE "+
+				"%s, using UTC: %s\n", zone, err)
+		} else {
+			adapter.timezone = location
+		}
+	}
+	adapter.labelKeys = getLabelFields(route)
+	adapter.envPrefix, _ = getOption(route, `CLOUDWATCH_ENV_PREFIX`)
+	adapter.streamTag, _ = getOption(route, `CLOUDWATCH_STREAM_TAG`)
+	adapter.fallbackGroup, _ = getOption(route, `CLOUDWATCH_FALLBACK_GROUP`)
+	adapter.fallbackStream, _ = getOption(route, `CLOUDWATCH_FALLBACK_STREAM`)
+	adapter.defaultGroup, _ = getOption(route, `CLOUDWATCH_DEFAULT_GROUP`)
+	adapter.defaultStream, _ = getOption(route, `CLOUDWATCH_DEFAULT_STREAM`)
+	adapter.configRules = loadConfigRules(route)
+	adapter.precedence = getOptionPrecedence(route)
+	adapter.templates = loadTemplates(route)
+	adapter.streamRoutes = getStreamRoutes(route)
+	adapter.setLevelStreams(route)
+	if tags, isSet := getOption(route, `CLOUDWATCH_TAGS`); isSet {
+		adapter.tags = parseTags(tags)
+	}
+	if addr, isSet := getOption(route, `CLOUDWATCH_METRICS_ADDR`); isSet {
+		serveMetrics(addr)
+	}
+	if addr, isSet := getOption(route, `CLOUDWATCH_HEALTH_ADDR`); isSet {
+		serveHealth(addr, getDurationOption(route, `CLOUDWATCH_HEALTH_WINDOW`,
+			DEFAULT_HEALTH_WINDOW))
+	}
+	if addr, isSet := getOption(route, `CLOUDWATCH_DEBUG_ADDR`); isSet {
+		serveDebug(addr)
+	}
+	if interval := getDurationOption(route, `CLOUDWATCH_DROP_LOG_INTERVAL`,
+		0); interval > 0 {
+		logDrops(interval)
+	}
+	if noDocker {
+		log.Println("cloudwatch: CLOUDWATCH_NO_DOCKER is set, using each " +
+			"message's own container info")
+		adapter.idleSweeps = time.NewTicker(IDLE_SWEEP_PERIOD).C
+	} else if err = client.AddEventListener(adapter.events); err != nil {
+		log.Println("cloudwatch: WARNING - cannot watch container events:", err)
+	}
+	adapter.wal, adapter.replayed = NewWriteAheadLog(route)
 	adapter.batcher = NewCloudwatchBatcher(&adapter)
 	return &adapter, nil
 }
 
+// Creates a client for the Docker daemon at the given host, and checks that
+// it can connect, to fail now rather than when the first container is
+// inspected.
+func newDockerClient(dockerHost string) (*docker.Client, error) {
+	client, err := docker.NewClient(dockerHost)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR creating Docker client for %s: %s",
+			dockerHost, err)
+	}
+	if err = client.Ping(); err != nil {
+		return nil, fmt.Errorf("ERROR connecting to Docker at %s "+
+			"(check DOCKER_HOST): %s", dockerHost, err)
+	}
+	return client, nil
+}
+
+// Returns the logger host set by CLOUDWATCH_LOGGER_HOST - either its value,
+// or the EC2 Instance ID if it's set to LOGGER_HOST_INSTANCE_ID - or else
+// the given hostname.
+func loggerHost(route *router.Route, hostname string, ec2info EC2Info) string {
+	host, isSet := getOption(route, `CLOUDWATCH_LOGGER_HOST`)
+	if !isSet || (host == "") {
+		return hostname
+	}
+	if host != LOGGER_HOST_INSTANCE_ID {
+		return host
+	}
+	if ec2info.InstanceID == "" {
+		log.Println("cloudwatch: WARNING: no EC2 Instance ID for " +
+			"CLOUDWATCH_LOGGER_HOST, using the hostname")
+		return hostname
+	}
+	return ec2info.InstanceID
+}
+
 // Stream implements the router.LogAdapter interface.
 func (a *CloudwatchAdapter) Stream(logstream chan *router.Message) {
-	for m := range logstream {
-		// determine the log group name and log stream name
-		var groupName, streamName string
-		// first, check the in-memory cache so this work is done per-container
-		if cachedGroup, isCached := a.groupnames[m.Container.ID]; isCached {
-			groupName = cachedGroup
-		}
-		if cachedStream, isCached := a.streamnames[m.Container.ID]; isCached {
-			streamName = cachedStream
-		}
-		if (streamName == "") || (groupName == "") {
-			// make a render context with the required info
-			containerData, err := a.client.InspectContainer(m.Container.ID)
-			if err != nil {
-				log.Println("cloudwatch: error inspecting container:", err)
-				continue
+	streaming.Add(1)
+	// only once streaming, so an adapter that's never started can't
+	// swallow the signals that would otherwise stop the process
+	signal.Notify(a.signals, syscall.SIGTERM, syscall.SIGINT)
+	// logspout's multiline adapter has already combined the lines, using the
+	// same options - this is safe, since the batcher has no messages yet
+	if a.batcher.multilineShared &&
+		strings.HasPrefix(a.Route.Adapter, `multiline+`) {
+		a.log("lines are combined by the multiline adapter, not the " +
+			"batcher\n")
+		a.batcher.multiline = nil
+	}
+	if len(a.replayed) > 0 { // first, resend the messages from the last run
+		log.Printf("cloudwatch: replaying %d messages from the write-ahead "+
+			"log\n", len(a.replayed))
+		for _, msg := range a.replayed {
+			a.batcher.Input <- msg
+		}
+		a.replayed = nil
+	}
+	for { // run until the logstream is closed, and...
+		select { // process a message, inspection, event, heartbeat or signal
+		case m, open := <-logstream:
+			if !open {
+				a.drain()
+				streaming.Done()
+				return
 			}
-			context := RenderContext{
-				Env:        parseEnv(m.Container.Config.Env),
-				Labels:     containerData.Config.Labels,
-				Name:       strings.TrimPrefix(m.Container.Name, `/`),
-				ID:         m.Container.ID,
-				Host:       m.Container.Config.Hostname,
-				LoggerHost: a.OsHost,
-				InstanceID: a.Ec2Instance,
-				Region:     a.Ec2Region,
+			a.streamMessage(m)
+		case result := <-a.inspected:
+			a.handleInspection(result)
+		case event, open := <-a.events:
+			if !open { // the Docker client has stopped sending events
+				a.events = nil
+				break
+			}
+			a.handleEvent(event)
+		case now := <-a.heartbeats:
+			a.sendHeartbeat(now)
+		case <-a.partialTicks:
+			a.flushPartials(PARTIAL_TIMEOUT)
+		case <-a.idleSweeps:
+			a.sweepIdle()
+		case sig := <-a.signals:
+			a.shutdown(sig)
+		}
+	}
+}
+
+// Uploads the remaining logs after a signal, then exits once every other
+// adapter in the process has done the same - each adapter gets the signal -
+// or once the shutdown timeout has passed.
+func (a *CloudwatchAdapter) shutdown(sig os.Signal) {
+	log.Printf("cloudwatch: got %s, uploading remaining logs...\n", sig)
+	started := time.Now()
+	a.drain()
+	streaming.Done()
+	if !waitGroup(&streaming, a.stopTimeout-time.Since(started)) {
+		log.Println("cloudwatch: WARNING: timed out waiting for the other " +
+			"routes to upload their logs")
+	}
+	os.Exit(0)
+}
+
+// Waits for the group, as for every adapter's Stream loop to finish, for up
+// to the given time. Returns false if it timed out.
+func waitGroup(group *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan bool)
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Stops handling signals, and sending messages to the batcher, then waits
+// for all the batched messages to be uploaded (or for the shutdown timeout).
+// Messages still waiting for their container's inspection are sent once it
+// finishes, or with the default info if it doesn't finish within half the
+// timeout, leaving the rest of it for their upload.
+func (a *CloudwatchAdapter) drain() {
+	signal.Stop(a.signals)
+	deadline := time.Now().Add(a.stopTimeout)
+	a.flushPartials(0)
+	a.finishInspections(time.Now().Add(a.stopTimeout / 2))
+	close(a.batcher.Input)
+	select {
+	case <-a.batcher.Done:
+		log.Println("cloudwatch: all remaining logs uploaded")
+	case <-time.After(time.Until(deadline)):
+		log.Println("cloudwatch: WARNING: timed out uploading remaining logs")
+	}
+}
+
+// Handles the inspections still running until no messages are waiting for
+// them, or until the deadline, when the waiting messages are sent with
+// their containers' default info instead.
+func (a *CloudwatchAdapter) finishInspections(deadline time.Time) {
+	for len(a.waiting) > 0 {
+		select {
+		case result := <-a.inspected:
+			a.handleInspection(result)
+		case <-time.After(time.Until(deadline)):
+			log.Printf("cloudwatch: WARNING: timed out inspecting %d "+
+				"containers, using their default info\n", len(a.waiting))
+			for id, waiting := range a.waiting {
+				info := a.defaultInfo(waiting[0])
+				for _, m := range waiting {
+					a.sendMessage(m, info)
+				}
+				delete(a.waiting, id)
 			}
-			groupName = a.renderEnvValue(`LOGSPOUT_GROUP`, &context, a.OsHost)
-			streamName = a.renderEnvValue(`LOGSPOUT_STREAM`, &context, context.Name)
-			a.groupnames[m.Container.ID] = groupName   // cache the group name
-			a.streamnames[m.Container.ID] = streamName // and the stream name
-		}
-		a.batcher.Input <- CloudwatchMessage{
-			Message:   m.Data,
-			Group:     groupName,
-			Stream:    streamName,
-			Time:      time.Now(),
-			Container: m.Container.ID,
 		}
 	}
 }
+
+// Sends the given message on to the batcher, once any line that Docker
+// split has been joined, if CLOUDWATCH_MERGE_PARTIAL is set.
+func (a *CloudwatchAdapter) streamMessage(m *router.Message) {
+	eventsReceived.Add(1)
+	if a.partials != nil {
+		if m = a.mergePartialLine(m); m == nil {
+			return // wait for the rest of the line
+		}
+	}
+	a.handleLine(m)
+}
+
+// Sends the given line on to the batcher, once its container's info
+// is known. Lines from a container that must be inspected first wait,
+// in order, until the inspection is done.
+func (a *CloudwatchAdapter) handleLine(m *router.Message) {
+	if a.stripANSI { // copy the message, which other routes may share
+		stripped := *m
+		stripped.Data = ansiEscapes.ReplaceAllLiteralString(m.Data, "")
+		m = &stripped
+	}
+	// Cloudwatch rejects empty messages, and blank ones are usually noise
+	if (m.Data == "") || (a.skipEmpty && (strings.TrimSpace(m.Data) == "")) {
+		drops.Add(DROP_EMPTY, 1)
+		return
+	}
+	if matchesAny(a.dropPatterns, m.Data) { // such as health checks
+		drops.Add(DROP_MATCHED, 1)
+		return
+	}
+	id := m.Container.ID
+	if waiting, isWaiting := a.waiting[id]; isWaiting {
+		a.waiting[id] = append(waiting, m)
+		return
+	}
+	// first, check the in-memory cache so this work is done per-container
+	info, isCached := a.containers[id]
+	if !isCached || (!info.expires.IsZero() && time.Now().After(info.expires)) {
+		a.waiting[id] = []*router.Message{m}
+		if a.noDocker { // the message's own container info is all there is
+			a.handleInspection(inspection{msg: m, container: m.Container})
+		} else {
+			go a.inspect(m, a.client)
+		}
+		return
+	}
+	info.idle = false
+	a.sendMessage(m, info)
+}
+
+// Removes the cached info of the containers that have sent nothing since
+// the last sweep, which have most likely been removed, and marks the rest
+// as idle until their next message.
+func (a *CloudwatchAdapter) sweepIdle() {
+	for id, info := range a.containers {
+		if info.idle {
+			a.forget(id)
+		} else {
+			info.idle = true
+		}
+	}
+}
+
+// Inspects the message's container in the background with the given
+// client, once one of the inspectSlots is free, then sends the result to
+// the Stream loop.
+func (a *CloudwatchAdapter) inspect(m *router.Message,
+	client *docker.Client) {
+	a.inspectSlots <- true
+	container, err := client.InspectContainer(m.Container.ID)
+	<-a.inspectSlots
+	a.inspected <- inspection{msg: m, container: container, err: err}
+}
+
+// Caches the info from a container inspection, then sends the messages
+// that were waiting for it.
+func (a *CloudwatchAdapter) handleInspection(result inspection) {
+	var info *containerInfo
+	if result.err != nil {
+		log.Println("cloudwatch: error inspecting container:", result.err)
+		if isConnectionError(result.err) {
+			a.reconnect()
+		}
+		info = a.defaultInfo(result.msg)
+	} else {
+		a.reconnectDelay = DEFAULT_RECONNECT_DELAY
+		info = a.newContainerInfo(result.msg, result.container)
+		if a.cacheTTL > 0 {
+			info.expires = time.Now().Add(a.cacheTTL)
+		}
+	}
+	id := result.msg.Container.ID
+	a.containers[id] = info
+	for _, m := range a.waiting[id] {
+		a.sendMessage(m, info)
+	}
+	delete(a.waiting, id)
+}
+
+// Recreates the Docker client, as when the Docker daemon has restarted,
+// unless it was recreated within the reconnect delay.
+func (a *CloudwatchAdapter) reconnect() {
+	if time.Now().Before(a.nextReconnect) {
+		return
+	}
+	a.nextReconnect = time.Now().Add(a.reconnectDelay)
+	a.reconnectDelay = a.reconnectDelay * 2
+	if a.reconnectDelay > MAX_RECONNECT_DELAY {
+		a.reconnectDelay = MAX_RECONNECT_DELAY
+	}
+	log.Println("cloudwatch: reconnecting to Docker at", a.dockerHost)
+	client, err := docker.NewClient(a.dockerHost)
+	if err != nil {
+		log.Println("cloudwatch: ERROR reconnecting to Docker:", err)
+		return
+	}
+	if a.events != nil {
+		a.client.RemoveEventListener(a.events)
+	}
+	a.client = client
+	a.events = make(chan *docker.APIEvents)
+	if err = client.AddEventListener(a.events); err != nil {
+		log.Println("cloudwatch: WARNING - cannot watch container events:", err)
+	}
+}
+
+// Determines the log group and stream names for the given message,
+// then sends it on to the batcher.
+func (a *CloudwatchAdapter) sendMessage(m *router.Message,
+	info *containerInfo) {
+	if !info.ship { // the container was filtered out
+		drops.Add(DROP_FILTERED, 1)
+		return
+	}
+	names := a.sourceNames(info, m.Source)
+	groups, stream, routes := names.groups, names.stream, names.routes
+	if a.parseJSON { // the names may depend on each message's JSON fields
+		if fields := parseJSONObject(m.Data); fields != nil {
+			context := *info.context
+			context.Source = m.Source
+			context.JSON = fields
+			groups, stream = a.renderNames(&context)
+			routes = a.renderRoutes(&context)
+		}
+	}
+	if len(a.streamRoutes) > 0 {
+		stream = a.routeStream(m.Data, routes, stream)
+	}
+	if a.levelPattern != nil {
+		stream = a.levelStream(m.Data, stream)
+	}
+	a.recordLine(m)
+	msgTime := a.messageTime(m)
+	text := info.prefix + m.Data + info.suffix
+	if a.envelopeFields != nil {
+		text = a.envelope(text, msgTime, m, info)
+	} else {
+		text = info.labelPrefix + text
+	}
+	a.sendToGroups(groups, stream, text, msgTime, m.Container.ID, info)
+}
+
+// Sends a copy of the message text to the given stream in each of the
+// given log groups, for the container with the given ID and info.
+func (a *CloudwatchAdapter) sendToGroups(groups []string, stream, text string,
+	msgTime time.Time, id string, info *containerInfo) {
+	for _, group := range groups {
+		msg := CloudwatchMessage{
+			Message:       text,
+			Group:         group,
+			Stream:        stream,
+			Time:          msgTime,
+			Container:     id,
+			Region:        info.region,
+			Tags:          info.tags,
+			RetentionDays: info.retentionDays,
+		}
+		if a.wal != nil {
+			if err := a.wal.Append(&msg); err != nil {
+				log.Println("cloudwatch: ERROR writing to write-ahead log:",
+					err)
+			}
+		}
+		a.batcher.Input <- msg
+	}
+}
+
+// Returns the time from the message text, if CLOUDWATCH_TIMESTAMP_PATTERN
+// is set and matches it, or else the time logspout received the message,
+// or the current time if neither is available.
+func (a *CloudwatchAdapter) messageTime(m *router.Message) time.Time {
+	if a.timestampPattern != nil {
+		match := a.timestampPattern.FindStringSubmatch(m.Data)
+		if len(match) > 1 {
+			msgTime, err := time.Parse(a.timestampFormat, match[1])
+			if err == nil {
+				return msgTime
+			}
+		}
+	}
+	if m.Time.IsZero() {
+		return time.Now()
+	}
+	return m.Time
+}
+
+// Uses the inspected info of the container that sent the given message to
+// determine its log group and stream names, and everything else that is
+// computed once per container.
+func (a *CloudwatchAdapter) newContainerInfo(m *router.Message,
+	containerData *docker.Container) *containerInfo {
+	// make a render context with the required info
+	image, imageTag := parseImage(containerData.Config.Image)
+	context := RenderContext{
+		Image:      image,
+		ImageTag:   imageTag,
+		Env:        parseEnv(m.Container.Config.Env),
+		Labels:     containerData.Config.Labels,
+		Name:       a.containerName(m),
+		ID:         m.Container.ID,
+		ShortID:    shortID(m.Container.ID),
+		Host:       containerHost(m.Container),
+		LoggerHost: a.OsHost,
+		InstanceID: a.Ec2Instance,
+		Region:     a.Ec2Region,
+		Source:     m.Source,
+	}
+	// Compose sets these labels on the containers it runs
+	context.ComposeProject = context.Labels[`com.docker.compose.project`]
+	context.ComposeService = context.Labels[`com.docker.compose.service`]
+	names := a.newLogNames(&context)
+	_, groupSource := a.lookupEnvValue(`LOGSPOUT_GROUP`, &context, "")
+	if a.debugSet {
+		_, streamSource := a.lookupEnvValue(`LOGSPOUT_STREAM`, &context, "")
+		a.log("Container %s logs to groups %s (from %s), stream %s (from %s)",
+			context.Name, strings.Join(names.groups, `, `), groupSource,
+			names.stream, streamSource)
+	}
+	info := &containerInfo{
+		names:   map[string]*logNames{m.Source: names},
+		region:  a.containerRegion(&context),
+		ship:    a.shouldShip(&context),
+		tags:    a.renderTags(&context),
+		prefix:  renderOptional(a.msgPrefix, &context),
+		suffix:  renderOptional(a.msgSuffix, &context),
+		context: &context,
+	}
+	if info.ship && (groupSource == `default`) {
+		a.warnDefaultGroup(&context)
+		if a.requireGroup {
+			info.ship = false
+		}
+	}
+	info.retentionDays = a.containerRetention(&context)
+	info.labelFields = selectLabels(context.Labels, a.labelKeys)
+	info.labelPrefix = labelPrefix(info.labelFields)
+	info.envFields = selectEnv(context.Env, a.envPrefix)
+	return info
+}
+
+// Warns once for each container whose log group is not set anywhere, so
+// its logs are sent to the default group, named after the logger host.
+func (a *CloudwatchAdapter) warnDefaultGroup(context *RenderContext) {
+	if a.defaultGroups[context.ID] {
+		return
+	}
+	a.defaultGroups[context.ID] = true
+	if a.requireGroup {
+		log.Printf("cloudwatch: WARNING: LOGSPOUT_GROUP is not set for "+
+			"container %s, dropping its logs\n", context.Name)
+		return
+	}
+	if a.defaultGroup != "" { // the default is a deliberate convention
+		return
+	}
+	log.Printf("cloudwatch: WARNING: LOGSPOUT_GROUP is not set for "+
+		"container %s, using the default group %s\n", context.Name, a.OsHost)
+}
+
+// Returns the info for a container that couldn't be inspected, built from
+// the message's own container info, labels included, so the same names and
+// filter apply. It expires shortly, so the container is inspected again
+// after INSPECT_RETRY_DELAY.
+func (a *CloudwatchAdapter) defaultInfo(m *router.Message) *containerInfo {
+	info := a.newContainerInfo(m, m.Container)
+	info.expires = time.Now().Add(INSPECT_RETRY_DELAY)
+	return info
+}
+
+// Returns the container's log names for messages from the given source,
+// rendering and caching them the first time the source is seen, and again
+// in each new NAMES_PERIOD.
+func (a *CloudwatchAdapter) sourceNames(info *containerInfo,
+	source string) *logNames {
+	names, exists := info.names[source]
+	if !exists || !names.period.Equal(namesPeriod()) {
+		context := *info.context
+		context.Source = source
+		names = a.newLogNames(&context)
+		info.names[source] = names
+	}
+	return names
+}
+
+// Renders the log names in the given context, for the current NAMES_PERIOD.
+func (a *CloudwatchAdapter) newLogNames(context *RenderContext) *logNames {
+	groups, stream := a.renderNames(context)
+	return &logNames{groups: groups, stream: stream,
+		routes: a.renderRoutes(context), period: namesPeriod()}
+}
+
+// returns the start of the current NAMES_PERIOD
+func namesPeriod() time.Time {
+	return time.Now().UTC().Truncate(NAMES_PERIOD)
+}
+
+// Returns the name of the message's container, without the "/" that Docker
+// starts it with, unless CLOUDWATCH_KEEP_NAME_SLASH is set.
+func (a *CloudwatchAdapter) containerName(m *router.Message) string {
+	if a.keepNameSlash {
+		return m.Container.Name
+	}
+	return strings.TrimPrefix(m.Container.Name, `/`)
+}
+
+// Renders the log group and stream names in the given context. The group
+// may render to a comma-separated list, to send messages to several groups.
+func (a *CloudwatchAdapter) renderNames(context *RenderContext) (
+	[]string, string) {
+	groups := []string{}
+	defaultGroup := a.renderDefault(a.defaultGroup, context, a.OsHost)
+	groupList := a.renderEnvFallback(`LOGSPOUT_GROUP`, context, defaultGroup,
+		a.fallbackGroup)
+	for _, group := range strings.Split(groupList, `,`) {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, a.sanitizeGroup(group))
+		}
+	}
+	if len(groups) == 0 {
+		groups = append(groups, a.sanitizeGroup(a.OsHost))
+	}
+	defaultStream := a.renderDefault(a.defaultStream, context, context.Name)
+	if a.streamTag != "" { // the awslogs tag replaces the container name
+		tag, err := renderTemplate(a.streamTag, newTagContext(context))
+		if err == nil {
+			defaultStream = tag
+		}
+	}
+	stream := a.renderEnvFallback(`LOGSPOUT_STREAM`, context, defaultStream,
+		a.fallbackStream)
+	return groups, a.sanitizeStream(stream)
+}
+
+// Renders the CLOUDWATCH_DEFAULT_GROUP or CLOUDWATCH_DEFAULT_STREAM template
+// in the given context, or returns the built-in default if the template is
+// unset, can't be rendered, or renders to "".
+func (a *CloudwatchAdapter) renderDefault(text string, context *RenderContext,
+	builtIn string) string {
+	if text == "" {
+		return builtIn
+	}
+	rendered, err := renderTemplateWith(a.templates, text, context)
+	if (err != nil) || (strings.TrimSpace(rendered) == "") {
+		return builtIn
+	}
+	return rendered
+}
+
+// Returns the region set by the container's CLOUDWATCH_REGION label or
+// Env var (the label takes precedence), or "" for the default region. As
+// for the route, "auto" names the default region, and so does the default
+// region's own name, so its containers share the default uploaders.
+func (a *CloudwatchAdapter) containerRegion(context *RenderContext) string {
+	region, exists := context.Labels[`CLOUDWATCH_REGION`]
+	if !exists {
+		region = context.Env[`CLOUDWATCH_REGION`]
+	}
+	if (region == "") || (region == "auto") || (region == defaultRegion(a)) {
+		return ""
+	}
+	return region
+}
+
+// Renders the CLOUDWATCH_TAGS values in the given context. Tags whose
+// values can't be rendered are left out.
+func (a *CloudwatchAdapter) renderTags(
+	context *RenderContext) map[string]string {
+	if len(a.tags) == 0 {
+		return nil
+	}
+	tags := map[string]string{}
+	for key, text := range a.tags {
+		if value, err := renderTemplate(text, context); err == nil {
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+// Renders the given template text in the given context, returning ""
+// if the text is empty or can't be rendered.
+func renderOptional(text string, context *RenderContext) string {
+	if text == "" {
+		return ""
+	}
+	rendered, err := renderTemplate(text, context)
+	if err != nil {
+		return ""
+	}
+	return rendered
+}
+
+// Returns the log retention in days set by the container's retention label,
+// or 0 if it has none, or its value is not allowed by Cloudwatch.
+func (a *CloudwatchAdapter) containerRetention(context *RenderContext) int {
+	labelVal, exists := context.Labels[a.retentionLabel]
+	if !exists {
+		return 0
+	}
+	days, err := strconv.Atoi(strings.TrimSpace(labelVal))
+	if (err != nil) || !isValidRetention(days) {
+		log.Printf("cloudwatch: WARNING: ERROR parsing %s label %s for "+
+			"container %s, using the default retention\n", a.retentionLabel,
+			labelVal, context.Name)
+		return 0
+	}
+	return days
+}
+
+// Returns true if the container's filter label allows its logs to be shipped.
+// Unlabeled containers are shipped, unless CLOUDWATCH_OPT_IN is set.
+func (a *CloudwatchAdapter) shouldShip(context *RenderContext) bool {
+	labelVal, exists := context.Labels[a.filterLabel]
+	if !exists {
+		return !a.optIn
+	}
+	ship, err := strconv.ParseBool(labelVal)
+	if err != nil {
+		log.Printf("cloudwatch: WARNING: ERROR parsing label %s=%s on %s\n",
+			a.filterLabel, labelVal, context.Name)
+		return !a.optIn
+	}
+	return ship
+}
+
+// Submits a container's batched messages once the container stops, along
+// with its crash context if it failed, and removes its cached info once the
+// container is destroyed, so a new container that reuses its name gets its
+// own group and stream names.
+func (a *CloudwatchAdapter) handleEvent(event *docker.APIEvents) {
+	if event.Type != "container" {
+		return
+	}
+	switch event.Action {
+	case "die", "stop":
+		if event.Action == "die" {
+			a.sendCrashContext(event.Actor.ID,
+				event.Actor.Attributes["exitCode"])
+		}
+		a.batcher.Flush <- event.Actor.ID
+	case "destroy":
+		a.forget(event.Actor.ID)
+	}
+}
+
+// removes everything kept about the given container
+func (a *CloudwatchAdapter) forget(id string) {
+	delete(a.containers, id)
+	delete(a.defaultGroups, id)
+	delete(a.recent, id)
+}
+
+// HELPER METHODS
+
+// returns true if the error means the Docker daemon couldn't be reached
+func isConnectionError(err error) bool {
+	if err == docker.ErrConnectionRefused {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func (a *CloudwatchAdapter) log(format string, args ...interface{}) {
+	if a.debugSet {
+		debugLog(format, args...)
+	}
+}
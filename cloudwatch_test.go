@@ -0,0 +1,2819 @@
+package cloudwatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+)
+
+// the error that fakeLogs returns for each failed request
+var errUnavailable = awserr.New(
+	cloudwatchlogs.ErrCodeServiceUnavailableException, "unavailable", nil)
+
+// fakeLogs is a Cloudwatch Logs client that keeps its log groups and
+// streams in memory, and records each upload. Each request fails with the
+// errors queued for it, if any, before it succeeds. It's also a
+// ClientFactory, which returns itself for every region.
+type fakeLogs struct {
+	cloudwatchlogsiface.CloudWatchLogsAPI // any other request panics
+	sync.Mutex
+	groups    map[string]bool
+	streams   map[streamID]bool
+	retention map[string]int64             // each group's retention, in days
+	tags      map[string]map[string]string // each group's tags, if any
+	keys      map[string]string            // each group's KMS key, if any
+	puts      []fakePut
+	calls     map[string]int     // the requests made, by name
+	failures  map[string][]error // the errors for the next requests, by name
+	regions   []string           // the region of each client created
+	// if set, returned by every upload
+	rejected *cloudwatchlogs.RejectedLogEventsInfo
+	putDelay time.Duration // how long each upload takes
+}
+
+// fakePut is an upload that fakeLogs accepted.
+type fakePut struct {
+	group    string
+	stream   string
+	messages []string
+	times    []int64 // each event's timestamp, in epoch milliseconds
+	token    string  // the sequence token sent, if any
+	started  time.Time
+	ended    time.Time
+}
+
+func newFakeLogs() *fakeLogs {
+	return &fakeLogs{
+		groups:    map[string]bool{},
+		streams:   map[streamID]bool{},
+		retention: map[string]int64{},
+		tags:      map[string]map[string]string{},
+		keys:      map[string]string{},
+		calls:     map[string]int{},
+		failures:  map[string][]error{},
+	}
+}
+
+func (f *fakeLogs) NewClient(route *router.Route,
+	region string) cloudwatchlogsiface.CloudWatchLogsAPI {
+	f.Lock()
+	defer f.Unlock()
+	f.regions = append(f.regions, region)
+	return f
+}
+
+// returns the region of each client created, in order
+func (f *fakeLogs) clientRegions() []string {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string{}, f.regions...)
+}
+
+// queues count failures for the named request
+func (f *fakeLogs) fail(request string, count int) {
+	f.failWith(request, errUnavailable, count)
+}
+
+// queues count failures for the named request, each returning err
+func (f *fakeLogs) failWith(request string, err error, count int) {
+	f.Lock()
+	defer f.Unlock()
+	for i := 0; i < count; i++ {
+		f.failures[request] = append(f.failures[request], err)
+	}
+}
+
+// counts the named request, and returns its next queued failure, if any
+func (f *fakeLogs) request(name string) error {
+	f.calls[name]++
+	errs := f.failures[name]
+	if len(errs) == 0 {
+		return nil
+	}
+	f.failures[name] = errs[1:]
+	return errs[0]
+}
+
+// returns the number of times the named request was made
+func (f *fakeLogs) callCount(name string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.calls[name]
+}
+
+// returns the messages of every upload, in order
+func (f *fakeLogs) messages() []string {
+	f.Lock()
+	defer f.Unlock()
+	messages := []string{}
+	for _, put := range f.puts {
+		messages = append(messages, put.messages...)
+	}
+	return messages
+}
+
+// returns the timestamps of all the messages uploaded, in order
+func (f *fakeLogs) times() []int64 {
+	f.Lock()
+	defer f.Unlock()
+	times := []int64{}
+	for _, put := range f.puts {
+		times = append(times, put.times...)
+	}
+	return times
+}
+
+// returns the number of messages in each upload, in order
+func (f *fakeLogs) batchSizes() []int {
+	f.Lock()
+	defer f.Unlock()
+	sizes := []int{}
+	for _, put := range f.puts {
+		sizes = append(sizes, len(put.messages))
+	}
+	return sizes
+}
+
+func (f *fakeLogs) DescribeLogGroups(
+	input *cloudwatchlogs.DescribeLogGroupsInput) (
+	*cloudwatchlogs.DescribeLogGroupsOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.request("DescribeLogGroups"); err != nil {
+		return nil, err
+	}
+	output := &cloudwatchlogs.DescribeLogGroupsOutput{}
+	for group := range f.groups {
+		if strings.HasPrefix(group, *input.LogGroupNamePrefix) {
+			logGroup := &cloudwatchlogs.LogGroup{LogGroupName: aws.String(group)}
+			if key, exists := f.keys[group]; exists {
+				logGroup.KmsKeyId = aws.String(key)
+			}
+			output.LogGroups = append(output.LogGroups, logGroup)
+		}
+	}
+	return output, nil
+}
+
+func (f *fakeLogs) CreateLogGroup(
+	input *cloudwatchlogs.CreateLogGroupInput) (
+	*cloudwatchlogs.CreateLogGroupOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.request("CreateLogGroup"); err != nil {
+		return nil, err
+	}
+	f.groups[*input.LogGroupName] = true
+	if len(input.Tags) > 0 {
+		f.tags[*input.LogGroupName] = aws.StringValueMap(input.Tags)
+	}
+	if input.KmsKeyId != nil {
+		f.keys[*input.LogGroupName] = *input.KmsKeyId
+	}
+	return &cloudwatchlogs.CreateLogGroupOutput{}, nil
+}
+
+func (f *fakeLogs) AssociateKmsKey(
+	input *cloudwatchlogs.AssociateKmsKeyInput) (
+	*cloudwatchlogs.AssociateKmsKeyOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.request("AssociateKmsKey"); err != nil {
+		return nil, err
+	}
+	f.keys[*input.LogGroupName] = *input.KmsKeyId
+	return &cloudwatchlogs.AssociateKmsKeyOutput{}, nil
+}
+
+func (f *fakeLogs) PutRetentionPolicy(
+	input *cloudwatchlogs.PutRetentionPolicyInput) (
+	*cloudwatchlogs.PutRetentionPolicyOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.request("PutRetentionPolicy"); err != nil {
+		return nil, err
+	}
+	f.retention[*input.LogGroupName] = *input.RetentionInDays
+	return &cloudwatchlogs.PutRetentionPolicyOutput{}, nil
+}
+
+func (f *fakeLogs) DescribeLogStreams(
+	input *cloudwatchlogs.DescribeLogStreamsInput) (
+	*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.request("DescribeLogStreams"); err != nil {
+		return nil, err
+	}
+	output := &cloudwatchlogs.DescribeLogStreamsOutput{}
+	id := streamID{group: *input.LogGroupName,
+		stream: *input.LogStreamNamePrefix}
+	if f.streams[id] {
+		output.LogStreams = []*cloudwatchlogs.LogStream{
+			{LogStreamName: aws.String(id.stream)}}
+	}
+	return output, nil
+}
+
+func (f *fakeLogs) CreateLogStream(
+	input *cloudwatchlogs.CreateLogStreamInput) (
+	*cloudwatchlogs.CreateLogStreamOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.request("CreateLogStream"); err != nil {
+		return nil, err
+	}
+	id := streamID{group: *input.LogGroupName, stream: *input.LogStreamName}
+	f.streams[id] = true
+	return &cloudwatchlogs.CreateLogStreamOutput{}, nil
+}
+
+func (f *fakeLogs) PutLogEvents(input *cloudwatchlogs.PutLogEventsInput) (
+	*cloudwatchlogs.PutLogEventsOutput, error) {
+	started := time.Now()
+	time.Sleep(f.putDelay)
+	f.Lock()
+	defer f.Unlock()
+	if err := f.request("PutLogEvents"); err != nil {
+		return nil, err
+	}
+	put := fakePut{group: *input.LogGroupName, stream: *input.LogStreamName,
+		token: aws.StringValue(input.SequenceToken), started: started,
+		ended: time.Now()}
+	for _, event := range input.LogEvents {
+		put.messages = append(put.messages, *event.Message)
+		put.times = append(put.times, *event.Timestamp)
+	}
+	f.puts = append(f.puts, put)
+	return &cloudwatchlogs.PutLogEventsOutput{
+		NextSequenceToken:     aws.String("token"),
+		RejectedLogEventsInfo: f.rejected,
+	}, nil
+}
+
+// Returns an adapter for the given route options, which uploads to the
+// given client, and needs neither Docker nor EC2. Its messages go to the
+// test-group log group, and its batches are only pushed when it stops.
+func newTestAdapter(t *testing.T, client *fakeLogs,
+	options map[string]string) *CloudwatchAdapter {
+	route := &router.Route{Adapter: `cloudwatch`, Address: `us-east-1`,
+		Options: map[string]string{
+			`NOEC2`:                     ``,
+			`CLOUDWATCH_NO_DOCKER`:      `true`,
+			`CLOUDWATCH_RETRY_BASE`:     `1ms`,
+			`CLOUDWATCH_BATCH_INTERVAL`: `1h`,
+			`LOGSPOUT_GROUP`:            `test-group`,
+		}}
+	for key, value := range options {
+		route.Options[key] = value
+	}
+	Clients = client // the uploaders are created with the adapter
+	defer func() { Clients = awsClientFactory{} }()
+	adapter, err := NewCloudwatchAdapter(route)
+	if err != nil {
+		t.Fatal("creating the adapter:", err)
+	}
+	return adapter.(*CloudwatchAdapter)
+}
+
+// Streams the given messages through the adapter, then closes its
+// logstream, so this returns once the messages have all been uploaded.
+func runAdapter(a *CloudwatchAdapter, msgs ...*router.Message) {
+	logstream := make(chan *router.Message, len(msgs))
+	for _, m := range msgs {
+		logstream <- m
+	}
+	close(logstream)
+	a.Stream(logstream)
+}
+
+// returns a message from the named container, which has no Environment
+// or labels
+func testMessage(name, data string) *router.Message {
+	return &router.Message{
+		Container: &docker.Container{
+			ID:     name + `-0123456789abcdef`,
+			Name:   `/` + name,
+			Config: &docker.Config{},
+		},
+		Source: `stdout`,
+		Data:   data,
+		Time:   time.Now(),
+	}
+}
+
+// returns true if the two lists hold the same strings, in the same order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRenderEnvValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		env     map[string]string
+		want    string
+	}{
+		{name: "default", want: "default-group"},
+		{
+			name:    "route option",
+			options: map[string]string{`LOGSPOUT_GROUP`: `route-group`},
+			want:    "route-group",
+		},
+		{
+			name:    "container env over route option",
+			options: map[string]string{`LOGSPOUT_GROUP`: `route-group`},
+			env:     map[string]string{`LOGSPOUT_GROUP`: `env-group`},
+			want:    "env-group",
+		},
+		{
+			name:    "template",
+			options: map[string]string{`LOGSPOUT_GROUP`: `{{.Name}}-logs`},
+			want:    "web-logs",
+		},
+		{
+			name:    "template with env",
+			options: map[string]string{`LOGSPOUT_GROUP`: `{{.Env.STAGE}}`},
+			env:     map[string]string{`STAGE`: `prod`},
+			want:    "prod",
+		},
+		{
+			name:    "bad template",
+			options: map[string]string{`LOGSPOUT_GROUP`: `{{.Name`},
+			want:    "default-group",
+		},
+	}
+	for _, test := range tests {
+		route := &router.Route{Options: map[string]string{}}
+		for key, value := range test.options {
+			route.Options[key] = value
+		}
+		adapter := &CloudwatchAdapter{Route: route,
+			precedence: getOptionPrecedence(route)}
+		context := &RenderContext{Name: `web`, Env: test.env}
+		got := adapter.renderEnvValue(`LOGSPOUT_GROUP`, context,
+			"default-group")
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRenderedGroupUploaded(t *testing.T) {
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client,
+		map[string]string{`LOGSPOUT_GROUP`: `{{.Name}}-logs`})
+	runAdapter(adapter, testMessage("web", "hello"))
+	if (len(client.puts) != 1) || (client.puts[0].group != "web-logs") ||
+		(client.puts[0].stream != "web") {
+		t.Errorf("got uploads %+v, want one to web-logs-web", client.puts)
+	}
+	if got := client.messages(); !sameStrings(got, []string{"hello"}) {
+		t.Errorf("got messages %q, want hello", got)
+	}
+}
+
+func TestMergePartialLine(t *testing.T) {
+	full := strings.Repeat("a", DOCKER_PARTIAL_SIZE)
+	rest := strings.Repeat("b", 20*1024-DOCKER_PARTIAL_SIZE)
+	tests := []struct {
+		name      string
+		lines     []string
+		sameTimes bool // if set, the lines all have the same time
+		want      []string
+	}{
+		{
+			name:      "20 KB line",
+			lines:     []string{full, rest},
+			sameTimes: true,
+			want:      []string{full + rest},
+		},
+		{
+			name:      "line split in three",
+			lines:     []string{full, full, "end"},
+			sameTimes: true,
+			want:      []string{full + full + "end"},
+		},
+		{
+			name:      "exact multiple of the split size",
+			lines:     []string{full},
+			sameTimes: true,
+			want:      []string{full},
+		},
+		{
+			name:  "16 KB line followed by another line",
+			lines: []string{full, "next"},
+			want:  []string{full, "next"},
+		},
+		{
+			name:      "short lines",
+			lines:     []string{"one", "two"},
+			sameTimes: true,
+			want:      []string{"one", "two"},
+		},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client,
+			map[string]string{`CLOUDWATCH_MERGE_PARTIAL`: `true`})
+		start := time.Now()
+		msgs := []*router.Message{}
+		for i, line := range test.lines {
+			m := testMessage("web", line)
+			m.Time = start
+			if !test.sameTimes {
+				m.Time = start.Add(time.Duration(i) * time.Millisecond)
+			}
+			msgs = append(msgs, m)
+		}
+		runAdapter(adapter, msgs...)
+		got := client.messages()
+		if !sameStrings(got, test.want) {
+			t.Errorf("%s: got %d messages, want %d", test.name, len(got),
+				len(test.want))
+		}
+	}
+}
+
+func TestContainerRegions(t *testing.T) {
+	regions := map[string]string{ // CLOUDWATCH_REGION labels, by container
+		"web":    "eu-west-1",
+		"db":     "ap-south-1",
+		"cache":  "auto",
+		"queue":  "us-east-1", // the default region
+		"worker": "",
+	}
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client, nil)
+	Clients = client // the other regions' uploaders are created as needed
+	defer func() { Clients = awsClientFactory{} }()
+	msgs := []*router.Message{}
+	for name, region := range regions {
+		msg := testMessage(name, "hello")
+		if region != "" {
+			msg.Container.Config.Labels = map[string]string{
+				`CLOUDWATCH_REGION`: region}
+		}
+		msgs = append(msgs, msg)
+	}
+	runAdapter(adapter, msgs...)
+	want := []string{"ap-south-1", "eu-west-1", "us-east-1"}
+	got := client.clientRegions()
+	sort.Strings(got)
+	if !sameStrings(got, want) {
+		t.Errorf("got clients for regions %q, want %q", got, want)
+	}
+	if got := len(client.messages()); got != len(regions) {
+		t.Errorf("got %d messages uploaded, want %d", got, len(regions))
+	}
+}
+
+// fakeMetadata serves the EC2 Metadata requests made by NewEC2Info, as for
+// an instance that requires IMDSv2 tokens, or that only supports IMDSv1.
+type fakeMetadata struct {
+	tokens bool // if set, requires tokens, and otherwise refuses them
+	sync.Mutex
+	tokenUsed bool // set once a request sends a token
+}
+
+func (f *fakeMetadata) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/latest/api/token" {
+		if !f.tokens {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+		fmt.Fprint(w, "test-token")
+		return
+	}
+	token := r.Header.Get("X-Aws-Ec2-Metadata-Token")
+	if f.tokens && (token != "test-token") {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.Lock()
+	f.tokenUsed = f.tokenUsed || (token != "")
+	f.Unlock()
+	switch r.URL.Path {
+	case "/latest/meta-data/instance-id":
+		fmt.Fprint(w, "i-0123456789abcdef0")
+	case "/latest/dynamic/instance-identity/document":
+		fmt.Fprint(w, `{"region": "eu-west-1"}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestEC2Metadata(t *testing.T) {
+	tests := []struct {
+		name          string
+		tokens        bool
+		fallback      string // CLOUDWATCH_IMDS_V1_FALLBACK, if set
+		wantRegion    string
+		wantTokenUsed bool
+	}{
+		{name: "IMDSv2", tokens: true, wantRegion: "eu-west-1",
+			wantTokenUsed: true},
+		{name: "IMDSv2 only", tokens: true, fallback: "false",
+			wantRegion: "eu-west-1", wantTokenUsed: true},
+		{name: "IMDSv1 fallback", tokens: false, wantRegion: "eu-west-1"},
+		{name: "IMDSv1 refused", tokens: false, fallback: "false",
+			wantRegion: ""},
+	}
+	defer os.Unsetenv(`AWS_EC2_METADATA_SERVICE_ENDPOINT`)
+	for _, test := range tests {
+		metadata := &fakeMetadata{tokens: test.tokens}
+		server := httptest.NewServer(metadata)
+		os.Setenv(`AWS_EC2_METADATA_SERVICE_ENDPOINT`, server.URL)
+		route := &router.Route{Options: map[string]string{}}
+		if test.fallback != "" {
+			route.Options[`CLOUDWATCH_IMDS_V1_FALLBACK`] = test.fallback
+		}
+		info, err := NewEC2Info(route)
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: got error %s", test.name, err)
+		}
+		if info.Region != test.wantRegion {
+			t.Errorf("%s: got region %q, want %q", test.name, info.Region,
+				test.wantRegion)
+		}
+		if metadata.tokenUsed != test.wantTokenUsed {
+			t.Errorf("%s: got token used %v, want %v", test.name,
+				metadata.tokenUsed, test.wantTokenUsed)
+		}
+	}
+}
+
+// returns the value of each metric served at /metrics, by name and labels
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	recorder := httptest.NewRecorder()
+	writeMetrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	metrics := map[string]float64{}
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if (line == "") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var value float64
+		space := strings.LastIndex(line, " ")
+		if _, err := fmt.Sscan(line[space+1:], &value); err != nil {
+			t.Fatalf("parsing metric %q: %s", line, err)
+		}
+		metrics[line[:space]] = value
+	}
+	return metrics
+}
+
+func TestMetrics(t *testing.T) {
+	client := newFakeLogs()
+	client.fail("PutLogEvents", 1)
+	adapter := newTestAdapter(t, client, nil)
+	before := scrapeMetrics(t)
+	runAdapter(adapter, testMessage("web", "one"), testMessage("web", ""),
+		testMessage("web", "three"))
+	after := scrapeMetrics(t)
+	want := map[string]float64{
+		"cloudwatch_events_received_total":                   3,
+		"cloudwatch_events_shipped_total":                    2,
+		"cloudwatch_batches_sent_total":                      1,
+		"cloudwatch_put_errors_total":                        1,
+		`cloudwatch_events_dropped_total{reason="empty"}`:    1,
+		`cloudwatch_events_dropped_total{reason="filtered"}`: 0,
+	}
+	for name, count := range want {
+		if got := after[name] - before[name]; got != count {
+			t.Errorf("got %s increased by %v, want %v", name, got, count)
+		}
+	}
+	shipped := after["cloudwatch_bytes_shipped_total"] -
+		before["cloudwatch_bytes_shipped_total"]
+	if shipped < float64(len("one")+len("three")) {
+		t.Errorf("got %v bytes shipped, want at least %d", shipped,
+			len("one")+len("three"))
+	}
+}
+
+func TestDropPattern(t *testing.T) {
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client, map[string]string{
+		`CLOUDWATCH_DROP_PATTERN`: `GET /healthz ;GET /metrics `})
+	before := scrapeMetrics(t)
+	runAdapter(adapter,
+		testMessage("web", "GET /healthz 200"),
+		testMessage("web", "GET /orders 200"),
+		testMessage("web", "GET /metrics 200"),
+		testMessage("web", "POST /healthz 405"),
+		testMessage("web", "GET /healthz 200"))
+	want := []string{"GET /orders 200", "POST /healthz 405"}
+	if got := client.messages(); !sameStrings(got, want) {
+		t.Errorf("got uploaded %q, want %q", got, want)
+	}
+	name := `cloudwatch_events_dropped_total{reason="matched"}`
+	if got := scrapeMetrics(t)[name] - before[name]; got != 3 {
+		t.Errorf("got %s increased by %v, want 3", name, got)
+	}
+}
+
+func TestDropMetrics(t *testing.T) {
+	rateLimited := `cloudwatch_events_dropped_total{reason="rate-limited"}`
+	evicted := `cloudwatch_events_dropped_total{reason="evicted"}`
+	before := scrapeMetrics(t)
+	// five messages at once, over a rate of two per second
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client,
+		map[string]string{`CLOUDWATCH_MAX_EVENTS_PER_SEC`: `2`})
+	msgs := []*router.Message{}
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, testMessage("web", fmt.Sprintf("m%d", i)))
+	}
+	runAdapter(adapter, msgs...)
+	// six messages waiting for a full uploader, over a limit of four
+	batcher := &CloudwatchBatcher{
+		adapter:     &CloudwatchAdapter{},
+		bufferLimit: 4,
+		backlogs:    map[batchKey]*streamBacklog{},
+	}
+	uploader := &CloudwatchUploader{Input: make(chan CloudwatchBatch)}
+	batcher.queueBatch(uploader, testBatch(0, 3))
+	batcher.queueBatch(uploader, testBatch(3, 3))
+	after := scrapeMetrics(t)
+	if got := after[rateLimited] - before[rateLimited]; got != 3 {
+		t.Errorf("got %s increased by %v, want 3", rateLimited, got)
+	}
+	if got := after[evicted] - before[evicted]; got != 2 {
+		t.Errorf("got %s increased by %v, want 2", evicted, got)
+	}
+}
+
+// returns the log stream of each upload, in order
+func (f *fakeLogs) putStreams() []string {
+	f.Lock()
+	defer f.Unlock()
+	streams := []string{}
+	for _, put := range f.puts {
+		streams = append(streams, put.stream)
+	}
+	return streams
+}
+
+func TestDrainWaiting(t *testing.T) {
+	tests := []struct {
+		name        string
+		inspected   bool // if set, the inspection finishes in time
+		wantStreams []string
+	}{
+		{name: "inspected", inspected: true,
+			wantStreams: []string{"inspected"}},
+		{name: "timed out", wantStreams: []string{"logged"}},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client, map[string]string{
+			`CLOUDWATCH_SHUTDOWN_TIMEOUT`: `200ms`,
+			`LOGSPOUT_STREAM`:             `{{.Image}}`})
+		msg := testMessage("web", "waiting")
+		msg.Container.Config.Image = "logged"
+		// as if the container's inspection was still running
+		adapter.waiting[msg.Container.ID] = []*router.Message{msg}
+		if test.inspected {
+			container := *msg.Container
+			container.Config = &docker.Config{Image: "inspected"}
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				adapter.inspected <- inspection{msg: msg,
+					container: &container}
+			}()
+		}
+		runAdapter(adapter)
+		if got := client.messages(); !sameStrings(got, []string{"waiting"}) {
+			t.Errorf("%s: got uploaded %q, want the waiting message",
+				test.name, got)
+		}
+		if got := client.putStreams(); !sameStrings(got, test.wantStreams) {
+			t.Errorf("%s: got streams %q, want %q", test.name, got,
+				test.wantStreams)
+		}
+	}
+}
+
+func TestWaitGroup(t *testing.T) {
+	var group sync.WaitGroup
+	group.Add(1)
+	if waitGroup(&group, 10*time.Millisecond) {
+		t.Error("got done with the group still running")
+	}
+	group.Done()
+	if !waitGroup(&group, time.Second) {
+		t.Error("got timed out with the group done")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		ttl         string
+		want        time.Duration
+		wantExpires bool // if set, the container's info expires
+	}{
+		{ttl: "5m", want: 5 * time.Minute, wantExpires: true},
+		{ttl: "0", want: 0},
+		{ttl: "-1s", want: 0},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client,
+			map[string]string{`CLOUDWATCH_CACHE_TTL`: test.ttl})
+		if adapter.cacheTTL != test.want {
+			t.Errorf("TTL %s: got %v, want %v", test.ttl, adapter.cacheTTL,
+				test.want)
+		}
+		msg := testMessage("web", "hello")
+		runAdapter(adapter, msg)
+		info := adapter.containers[msg.Container.ID]
+		if expires := !info.expires.IsZero(); expires != test.wantExpires {
+			t.Errorf("TTL %s: got info expiring %v, want %v", test.ttl,
+				expires, test.wantExpires)
+		}
+	}
+}
+
+func TestMessageTime(t *testing.T) {
+	sent := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client, nil)
+	msg := testMessage("web", "logged an hour ago")
+	msg.Time = sent
+	unset := testMessage("web", "no time")
+	unset.Time = time.Time{}
+	before := time.Now()
+	runAdapter(adapter, msg, unset)
+	times := client.times()
+	if len(times) != 2 {
+		t.Fatalf("got %d events, want 2", len(times))
+	}
+	if want := sent.UnixNano() / 1e6; times[0] != want {
+		t.Errorf("got timestamp %d, want the message's time %d", times[0],
+			want)
+	}
+	if got := time.Unix(0, times[1]*1e6); got.Before(before.Truncate(
+		time.Millisecond)) || got.After(time.Now()) {
+		t.Errorf("got timestamp %v for a message with no time, want now",
+			got)
+	}
+}
+
+func TestLabelNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string // LOGSPOUT_GROUP or LOGSPOUT_STREAM
+		env    map[string]string
+		labels map[string]string
+		want   string
+	}{
+		{
+			name:   "group label",
+			key:    `LOGSPOUT_GROUP`,
+			labels: map[string]string{`com.example.group`: `label-group`},
+			want:   "label-group",
+		},
+		{
+			name:   "group label over container env",
+			key:    `LOGSPOUT_GROUP`,
+			env:    map[string]string{`LOGSPOUT_GROUP`: `env-group`},
+			labels: map[string]string{`com.example.group`: `label-group`},
+			want:   "label-group",
+		},
+		{
+			name: "group label absent",
+			key:  `LOGSPOUT_GROUP`,
+			env:  map[string]string{`LOGSPOUT_GROUP`: `env-group`},
+			want: "env-group",
+		},
+		{
+			name: "group label and env absent",
+			key:  `LOGSPOUT_GROUP`,
+			want: "default",
+		},
+		{
+			name:   "stream label",
+			key:    `LOGSPOUT_STREAM`,
+			env:    map[string]string{`LOGSPOUT_STREAM`: `env-stream`},
+			labels: map[string]string{`com.example.stream`: `label-stream`},
+			want:   "label-stream",
+		},
+		{
+			name:   "stream label absent",
+			key:    `LOGSPOUT_STREAM`,
+			labels: map[string]string{`com.example.group`: `label-group`},
+			want:   "default",
+		},
+	}
+	for _, test := range tests {
+		route := &router.Route{Options: map[string]string{
+			`LOGSPOUT_GROUP_LABEL`:  `com.example.group`,
+			`LOGSPOUT_STREAM_LABEL`: `com.example.stream`,
+		}}
+		adapter := &CloudwatchAdapter{Route: route,
+			precedence: getOptionPrecedence(route)}
+		context := &RenderContext{Name: `web`, Env: test.env,
+			Labels: test.labels}
+		got := adapter.renderEnvValue(test.key, context, "default")
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	tests := []struct {
+		template string // LOGSPOUT_STREAM
+		want     string
+	}{
+		{template: `{{upper .Name}}`, want: "WEB_APP"},
+		{template: `{{.Env.TEAM | lower}}`, want: "payments"},
+		{template: `{{replace "_" "-" .Name}}`, want: "web-app"},
+		{template: `{{trim .Env.PADDED}}`, want: "padded"},
+		{template: `{{.Name | replace "_" "-" | upper}}`, want: "WEB-APP"},
+	}
+	for _, test := range tests {
+		route := &router.Route{Options: map[string]string{
+			`LOGSPOUT_STREAM`: test.template}}
+		adapter := &CloudwatchAdapter{Route: route,
+			precedence: getOptionPrecedence(route)}
+		context := &RenderContext{Name: `web_app`, Env: map[string]string{
+			`TEAM`: `Payments`, `PADDED`: `  padded `}}
+		got := adapter.renderEnvValue(`LOGSPOUT_STREAM`, context, "default")
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.template, got, test.want)
+		}
+	}
+}
+
+func TestContainerRecreated(t *testing.T) {
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client, nil)
+	old := testMessage("web", "from the old container")
+	old.Container.Config.Env = []string{"LOGSPOUT_STREAM=old-stream"}
+	adapter.streamMessage(old)
+	adapter.handleEvent(&docker.APIEvents{Type: "container",
+		Action: "destroy", Actor: docker.APIActor{ID: old.Container.ID}})
+	if _, cached := adapter.containers[old.Container.ID]; cached {
+		t.Error("got the destroyed container's info still cached")
+	}
+	// a new container with the same name, and a different Environment
+	recreated := testMessage("web", "from the new container")
+	recreated.Container.ID = "web-fedcba9876543210"
+	recreated.Container.Config.Env = []string{"LOGSPOUT_STREAM=new-stream"}
+	adapter.streamMessage(recreated)
+	runAdapter(adapter)
+	want := []string{"new-stream", "old-stream"}
+	got := client.putStreams()
+	sort.Strings(got)
+	if !sameStrings(got, want) {
+		t.Errorf("got streams %q, want %q", got, want)
+	}
+}
+
+func TestShipFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		labels  map[string]string // the filter label, by container name
+		want    []string          // the containers shipped
+	}{
+		{
+			name: "opt-out",
+			labels: map[string]string{
+				"web": "false", "db": "true", "cache": "not a bool"},
+			want: []string{"cache", "db", "worker"},
+		},
+		{
+			name:    "opt-in",
+			options: map[string]string{`CLOUDWATCH_OPT_IN`: `true`},
+			labels: map[string]string{
+				"web": "false", "db": "true", "cache": "not a bool"},
+			want: []string{"db"},
+		},
+		{
+			name: "custom label",
+			options: map[string]string{
+				`CLOUDWATCH_FILTER_LABEL`: `com.example.ship`},
+			labels: map[string]string{"web": "false"},
+			want:   []string{"cache", "db", "worker"},
+		},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		options := map[string]string{`LOGSPOUT_STREAM`: `{{.Name}}`}
+		for key, value := range test.options {
+			options[key] = value
+		}
+		adapter := newTestAdapter(t, client, options)
+		label := DEFAULT_FILTER_LABEL
+		if custom, isSet := test.options[`CLOUDWATCH_FILTER_LABEL`]; isSet {
+			label = custom
+		}
+		msgs := []*router.Message{}
+		for _, name := range []string{"web", "db", "cache", "worker"} {
+			msg := testMessage(name, "hello")
+			if value, isSet := test.labels[name]; isSet {
+				msg.Container.Config.Labels = map[string]string{label: value}
+			}
+			msgs = append(msgs, msg)
+		}
+		runAdapter(adapter, msgs...)
+		got := client.putStreams()
+		sort.Strings(got)
+		if !sameStrings(got, test.want) {
+			t.Errorf("%s: got %q shipped, want %q", test.name, got,
+				test.want)
+		}
+	}
+}
+
+func TestGroupTags(t *testing.T) {
+	tests := []struct {
+		name   string
+		tags   string // CLOUDWATCH_TAGS
+		exists bool   // if set, the group exists before the first upload
+		want   map[string]string
+	}{
+		{
+			name: "new group",
+			tags: `team=logs, app={{.Name}},bad={{.Nope`,
+			want: map[string]string{"team": "logs", "app": "web"},
+		},
+		{name: "existing group", tags: `team=logs`, exists: true},
+		{name: "unset"},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		if test.exists {
+			client.groups[`test-group`] = true
+		}
+		options := map[string]string{}
+		if test.tags != "" {
+			options[`CLOUDWATCH_TAGS`] = test.tags
+		}
+		adapter := newTestAdapter(t, client, options)
+		runAdapter(adapter, testMessage("web", "hello"))
+		got := client.tags[`test-group`]
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got tags %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for key, value := range test.want {
+			if got[key] != value {
+				t.Errorf("%s: got tags %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestImageGroup(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string // the group and stream
+	}{
+		{image: "nginx:1.19", want: "nginx-1.19"},
+		{image: "team/app:2.0", want: "team/app-2.0"},
+		{image: "team/app:2.0@sha256:0123abcd", want: "team/app-2.0"},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client, map[string]string{
+			`LOGSPOUT_GROUP`:  `{{.Image}}`,
+			`LOGSPOUT_STREAM`: `{{.ImageTag}}`})
+		msg := testMessage("web", "hello")
+		msg.Container.Config.Image = test.image
+		runAdapter(adapter, msg)
+		got := []string{}
+		for _, put := range client.puts {
+			got = append(got, put.group+"-"+put.stream)
+		}
+		if !sameStrings(got, []string{test.want}) {
+			t.Errorf("image %s: got uploads to %q, want %s", test.image, got,
+				test.want)
+		}
+	}
+}
+
+func TestSanitizeNames(t *testing.T) {
+	tests := []struct {
+		name        string
+		replacement string // CLOUDWATCH_NAME_REPLACEMENT, if set
+		group       string
+		stream      string
+	}{
+		{name: "app:v1", group: "app_v1", stream: "app_v1"},
+		{name: "logs*", group: "logs_", stream: "logs_"},
+		{name: "my app", group: "my_app", stream: "my app"},
+		{name: "team/app.log#1-a", group: "team/app.log#1-a",
+			stream: "team/app.log#1-a"},
+		{name: "a:b*c d", replacement: "-", group: "a-b-c-d",
+			stream: "a-b-c d"},
+	}
+	for _, test := range tests {
+		options := map[string]string{}
+		if test.replacement != "" {
+			options[`CLOUDWATCH_NAME_REPLACEMENT`] = test.replacement
+		}
+		adapter := newTestAdapter(t, newFakeLogs(), options)
+		if got := adapter.sanitizeGroup(test.name); got != test.group {
+			t.Errorf("%q: got group %q, want %q", test.name, got, test.group)
+		}
+		if got := adapter.sanitizeStream(test.name); got != test.stream {
+			t.Errorf("%q: got stream %q, want %q", test.name, got,
+				test.stream)
+		}
+	}
+}
+
+func TestSanitizedNamesUploaded(t *testing.T) {
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client, map[string]string{
+		`LOGSPOUT_GROUP`:  `{{.Name}}:logs`,
+		`LOGSPOUT_STREAM`: `{{.Name}}*`})
+	runAdapter(adapter, testMessage("web", "hello"))
+	if (len(client.puts) != 1) || (client.puts[0].group != "web_logs") ||
+		(client.puts[0].stream != "web_") {
+		t.Errorf("got uploads %+v, want one to web_logs-web_", client.puts)
+	}
+}
+
+func TestSkipEmpty(t *testing.T) {
+	lines := []string{"one", "", "two", "   ", "\t\n", "three"}
+	tests := []struct {
+		skip string // CLOUDWATCH_SKIP_EMPTY, if set
+		want []string
+	}{
+		{want: []string{"one", "two", "three"}},
+		{skip: `true`, want: []string{"one", "two", "three"}},
+		// empty events are always rejected by Cloudwatch
+		{skip: `false`, want: []string{"one", "two", "   ", "\t\n", "three"}},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		options := map[string]string{}
+		if test.skip != "" {
+			options[`CLOUDWATCH_SKIP_EMPTY`] = test.skip
+		}
+		adapter := newTestAdapter(t, client, options)
+		msgs := []*router.Message{}
+		for _, line := range lines {
+			msgs = append(msgs, testMessage("web", line))
+		}
+		runAdapter(adapter, msgs...)
+		if got := client.messages(); !sameStrings(got, test.want) {
+			t.Errorf("skip %q: got %q, want %q", test.skip, got, test.want)
+		}
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	lines := []string{
+		`{"level": "error", "app": {"name": "api"}}`, // valid, with nesting
+		`{"level": "error", "app": `,                 // invalid
+		`level=error app=api`,                        // not JSON
+	}
+	tests := []struct {
+		parse string // CLOUDWATCH_PARSE_JSON
+		want  []string
+	}{
+		{parse: `true`, want: []string{"error-api", "plain", "plain"}},
+		{parse: `false`, want: []string{"plain", "plain", "plain"}},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client, map[string]string{
+			`CLOUDWATCH_PARSE_JSON`: test.parse,
+			`CLOUDWATCH_BATCH_SIZE`: `1`,
+			`LOGSPOUT_STREAM`: `{{if .JSON}}{{.JSON.level}}-` +
+				`{{.JSON.app.name}}{{else}}plain{{end}}`})
+		msgs := []*router.Message{}
+		for _, line := range lines {
+			msgs = append(msgs, testMessage("web", line))
+		}
+		runAdapter(adapter, msgs...)
+		got := client.putStreams()
+		sort.Strings(got)
+		if !sameStrings(got, test.want) {
+			t.Errorf("parse %s: got uploads to %q, want %q", test.parse, got,
+				test.want)
+		}
+	}
+}
+
+func TestTimestampPattern(t *testing.T) {
+	logged := time.Now().Add(-2 * time.Hour).UTC().Truncate(time.Second)
+	sent := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	tests := []struct {
+		name    string
+		format  string // CLOUDWATCH_TIMESTAMP_FORMAT, if set
+		pattern string
+		line    string
+		want    time.Time
+	}{
+		{
+			name:    "RFC3339",
+			pattern: `^(\S+) `,
+			line:    logged.Format(time.RFC3339) + " hello",
+			want:    logged,
+		},
+		{
+			name:    "format",
+			format:  `2006/01/02 15:04:05`,
+			pattern: `^\[([^\]]+)\]`,
+			line:    "[" + logged.Format(`2006/01/02 15:04:05`) + "] hello",
+			want:    logged,
+		},
+		{
+			name:    "no match",
+			pattern: `^(\d{4}-\S+) `,
+			line:    "hello",
+			want:    sent,
+		},
+		{
+			name:    "bad time",
+			pattern: `^(\S+) `,
+			line:    "2019-13-45T99:00:00Z hello",
+			want:    sent,
+		},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		options := map[string]string{
+			`CLOUDWATCH_TIMESTAMP_PATTERN`: test.pattern}
+		if test.format != "" {
+			options[`CLOUDWATCH_TIMESTAMP_FORMAT`] = test.format
+		}
+		adapter := newTestAdapter(t, client, options)
+		msg := testMessage("web", test.line)
+		msg.Time = sent
+		runAdapter(adapter, msg)
+		times := client.times()
+		if len(times) != 1 {
+			t.Fatalf("%s: got %d events, want 1", test.name, len(times))
+		}
+		if want := test.want.UnixNano() / 1e6; times[0] != want {
+			t.Errorf("%s: got timestamp %d, want %d", test.name, times[0],
+				want)
+		}
+	}
+}
+
+// logBuffer collects the log output while it's captured.
+type logBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+// captures the log output until the returned function is called
+func captureLog() (*logBuffer, func()) {
+	output := &logBuffer{}
+	log.SetOutput(output)
+	return output, func() { log.SetOutput(os.Stderr) }
+}
+
+func TestDebugNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    string // in the log, or "" if nothing should be
+	}{
+		{
+			name:    "debug",
+			options: map[string]string{`DEBUG`: ``},
+			want: "Container web logs to groups env-group (from container env), " +
+				"stream web (from default)",
+		},
+		{
+			name: "cloudwatch debug",
+			options: map[string]string{`CLOUDWATCH_DEBUG`: `true`,
+				`LOGSPOUT_STREAM`: `{{.Name}}-stream`},
+			want: "Container web logs to groups env-group (from container env), " +
+				"stream web-stream (from route options)",
+		},
+		{name: "quiet", options: map[string]string{}},
+	}
+	for _, test := range tests {
+		output, restore := captureLog()
+		adapter := newTestAdapter(t, newFakeLogs(), test.options)
+		msg := testMessage("web", "hello")
+		msg.Container.Config.Env = []string{`LOGSPOUT_GROUP=env-group`}
+		runAdapter(adapter, msg)
+		restore()
+		logged := output.String()
+		if test.want == "" {
+			if strings.Contains(logged, "logs to groups") {
+				t.Errorf("%s: got names logged:\n%s", test.name, logged)
+			}
+		} else if !strings.Contains(logged, test.want) {
+			t.Errorf("%s: got log:\n%s\nwant %q", test.name, logged,
+				test.want)
+		}
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	tests := []struct {
+		group string // LOGSPOUT_GROUP
+		want  []string
+	}{
+		{group: `{{.Name}}-logs`, want: []string{"web-logs-web"}},
+		{group: `team-{{.Name}}, audit`,
+			want: []string{"audit-web", "team-web-web"}},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client,
+			map[string]string{`LOGSPOUT_GROUP`: test.group})
+		runAdapter(adapter, testMessage("web", "hello"))
+		got := []string{}
+		for _, put := range client.puts {
+			got = append(got, put.group+"-"+put.stream)
+			if !sameStrings(put.messages, []string{"hello"}) {
+				t.Errorf("group %s: got %q uploaded to %s", test.group,
+					put.messages, put.group)
+			}
+		}
+		sort.Strings(got)
+		if !sameStrings(got, test.want) {
+			t.Errorf("group %s: got uploads to %q, want %q", test.group, got,
+				test.want)
+		}
+	}
+}
+
+func TestMessagePrefix(t *testing.T) {
+	tests := []struct {
+		prefix string // CLOUDWATCH_MSG_PREFIX, if set
+		suffix string // CLOUDWATCH_MSG_SUFFIX, if set
+		want   string
+	}{
+		{want: "hello"},
+		{prefix: `[prod] `, want: "[prod] hello"},
+		{prefix: `[{{.Name}}] `, suffix: ` ({{.ShortID}})`,
+			want: "[web] hello (web-01234567)"},
+		{prefix: `{{.Nope`, want: "hello"}, // can't be rendered
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		options := map[string]string{}
+		if test.prefix != "" {
+			options[`CLOUDWATCH_MSG_PREFIX`] = test.prefix
+		}
+		if test.suffix != "" {
+			options[`CLOUDWATCH_MSG_SUFFIX`] = test.suffix
+		}
+		adapter := newTestAdapter(t, client, options)
+		runAdapter(adapter, testMessage("web", "hello"))
+		if got := client.messages(); !sameStrings(got, []string{test.want}) {
+			t.Errorf("prefix %q, suffix %q: got %q, want %q", test.prefix,
+				test.suffix, got, test.want)
+		}
+	}
+}
+
+func TestInspectionFailed(t *testing.T) {
+	inspections := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			inspections++
+			http.Error(w, "no such container", http.StatusNotFound)
+		}))
+	defer server.Close()
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client, nil)
+	dockerClient, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal("creating the Docker client:", err)
+	}
+	adapter.noDocker, adapter.client = false, dockerClient
+	logstream, done := startAdapter(adapter)
+	logstream <- testMessage("web", "one")
+	logstream <- testMessage("web", "two")
+	close(logstream)
+	<-done
+	// the default names are used, without inspecting the container again
+	if got := client.messages(); !sameStrings(got, []string{"one", "two"}) {
+		t.Errorf("got uploaded %q, want one and two", got)
+	}
+	if got := client.putStreams(); (len(got) == 0) || (got[0] != "web") {
+		t.Errorf("got uploads to streams %q, want web", got)
+	}
+	if inspections != 1 {
+		t.Errorf("got %d inspections, want 1", inspections)
+	}
+	info := adapter.containers[`web-0123456789abcdef`]
+	if wait := time.Until(info.expires); (wait <= 0) ||
+		(wait > INSPECT_RETRY_DELAY) {
+		t.Errorf("got the container inspected again in %v, want %v", wait,
+			INSPECT_RETRY_DELAY)
+	}
+}
+
+func TestSourceStreams(t *testing.T) {
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client,
+		map[string]string{`LOGSPOUT_STREAM`: `{{.Name}}/{{.Source}}`})
+	msgs := []*router.Message{}
+	for i, source := range []string{"stdout", "stderr", "stdout", "stderr"} {
+		msg := testMessage("web", fmt.Sprintf("%s %d", source, i))
+		msg.Source = source
+		msgs = append(msgs, msg)
+	}
+	runAdapter(adapter, msgs...)
+	got := map[string][]string{}
+	for _, put := range client.puts {
+		got[put.stream] = append(got[put.stream], put.messages...)
+	}
+	want := map[string][]string{
+		"web/stdout": {"stdout 0", "stdout 2"},
+		"web/stderr": {"stderr 1", "stderr 3"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got uploads to %d streams, want %d: %v", len(got),
+			len(want), got)
+	}
+	for stream, messages := range want {
+		if !sameStrings(got[stream], messages) {
+			t.Errorf("got %q uploaded to %s, want %q", got[stream], stream,
+				messages)
+		}
+	}
+}
+
+// fakeDocker serves container inspections, each taking the given delay,
+// and records the most that ran at once.
+type fakeDocker struct {
+	sync.Mutex
+	delay   time.Duration
+	running int
+	most    int
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	f.running++
+	if f.running > f.most {
+		f.most = f.running
+	}
+	f.Unlock()
+	time.Sleep(f.delay)
+	f.Lock()
+	f.running--
+	f.Unlock()
+	if strings.HasSuffix(r.URL.Path, "/events") { // sends none, until closed
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		return
+	}
+	// as in /containers/web-0123456789abcdef/json
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"),
+		"/json")
+	name := strings.Split(id, "-")[0]
+	fmt.Fprintf(w, `{"Id": "%s", "Name": "/%s", "Config": `+
+		`{"Image": "app:inspected"}}`, id, name)
+}
+
+func TestConcurrentInspections(t *testing.T) {
+	server := &fakeDocker{delay: 100 * time.Millisecond}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client,
+		map[string]string{`CLOUDWATCH_INSPECT_WORKERS`: `4`})
+	dockerClient, err := docker.NewClient(httpServer.URL)
+	if err != nil {
+		t.Fatal("creating the Docker client:", err)
+	}
+	adapter.noDocker, adapter.client = false, dockerClient
+	started := time.Now()
+	msgs := []*router.Message{}
+	for line := 0; line < 3; line++ {
+		for c := 0; c < 8; c++ {
+			msgs = append(msgs, testMessage(fmt.Sprintf("c%d", c),
+				fmt.Sprintf("c%d line %d", c, line)))
+		}
+	}
+	runAdapter(adapter, msgs...)
+	// 8 inspections, 4 at a time, take 2 delays rather than 8
+	if took := time.Since(started); took > 6*server.delay {
+		t.Errorf("took %v to inspect 8 containers, 4 at a time", took)
+	}
+	if server.most != 4 {
+		t.Errorf("got at most %d inspections at once, want 4", server.most)
+	}
+	got := map[string][]string{}
+	for _, put := range client.puts {
+		got[put.stream] = append(got[put.stream], put.messages...)
+	}
+	for c := 0; c < 8; c++ {
+		name := fmt.Sprintf("c%d", c)
+		want := []string{name + " line 0", name + " line 1", name + " line 2"}
+		if !sameStrings(got[name], want) {
+			t.Errorf("got %q uploaded for %s, want %q", got[name], name, want)
+		}
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	tests := []struct {
+		line string
+		want map[string]string
+	}{
+		{line: `KEY=value`, want: map[string]string{"KEY": "value"}},
+		{line: `KEY=a=b`, want: map[string]string{"KEY": "a=b"}},
+		{line: `KEY=`, want: map[string]string{"KEY": ""}},
+		{line: `=v`, want: map[string]string{}},
+		{line: `BAREWORD`, want: map[string]string{"BAREWORD": ""}},
+		{line: ``, want: map[string]string{}},
+	}
+	for _, test := range tests {
+		got := parseEnv([]string{test.line})
+		if len(got) != len(test.want) {
+			t.Errorf("%q: got %v, want %v", test.line, got, test.want)
+			continue
+		}
+		for key, value := range test.want {
+			if got[key] != value {
+				t.Errorf("%q: got %v, want %v", test.line, got, test.want)
+			}
+		}
+	}
+}
+
+func TestLoggerHost(t *testing.T) {
+	tests := []struct {
+		option   string // CLOUDWATCH_LOGGER_HOST, if set
+		instance string // the EC2 Instance ID, if any
+		want     string
+	}{
+		{want: "0123456789ab"},
+		{instance: "i-0abc", want: "0123456789ab"},
+		{option: "build-host", instance: "i-0abc", want: "build-host"},
+		{option: LOGGER_HOST_INSTANCE_ID, instance: "i-0abc", want: "i-0abc"},
+		{option: LOGGER_HOST_INSTANCE_ID, want: "0123456789ab"}, // not EC2
+	}
+	for _, test := range tests {
+		route := &router.Route{Options: map[string]string{}}
+		if test.option != "" {
+			route.Options[`CLOUDWATCH_LOGGER_HOST`] = test.option
+		}
+		got := loggerHost(route, "0123456789ab",
+			EC2Info{InstanceID: test.instance})
+		if got != test.want {
+			t.Errorf("option %q, instance %q: got %q, want %q", test.option,
+				test.instance, got, test.want)
+		}
+	}
+	// the override is used in templates
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client, map[string]string{
+		`CLOUDWATCH_LOGGER_HOST`: `build-host`,
+		`LOGSPOUT_STREAM`:        `{{.LoggerHost}}`})
+	runAdapter(adapter, testMessage("web", "hello"))
+	got := client.putStreams()
+	if !sameStrings(got, []string{"build-host"}) {
+		t.Errorf("got uploads to streams %q, want build-host", got)
+	}
+}
+
+func TestShortIDStream(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{id: "3f4e5a6b7c8d9e0f1a2b3c4d5e6f7a8b", want: "3f4e5a6b7c8d"},
+		{id: "3f4e5a", want: "3f4e5a"},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client,
+			map[string]string{`LOGSPOUT_STREAM`: `{{.ShortID}}`})
+		msg := testMessage("web", "hello")
+		msg.Container.ID = test.id
+		runAdapter(adapter, msg)
+		if got := client.putStreams(); !sameStrings(got,
+			[]string{test.want}) {
+			t.Errorf("ID %s: got uploads to streams %q, want %s", test.id,
+				got, test.want)
+		}
+	}
+}
+
+func TestJSONEnvelope(t *testing.T) {
+	sent := time.Now().Add(-time.Minute).Truncate(time.Second).UTC()
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    map[string]interface{} // or nil, if the text is raw
+	}{
+		{name: "raw"},
+		{
+			name:    "default fields",
+			options: map[string]string{`CLOUDWATCH_JSON_ENVELOPE`: `true`},
+			want: map[string]interface{}{
+				"message": "hello", "container": "web", "host": "logger-host",
+				"labels": map[string]interface{}{"team": "logs"},
+				"time":   sent.Format(time.RFC3339Nano)},
+		},
+		{
+			name: "listed fields",
+			options: map[string]string{`CLOUDWATCH_JSON_ENVELOPE`: `true`,
+				`CLOUDWATCH_ENVELOPE_FIELDS`: `message, source,id,bogus`},
+			want: map[string]interface{}{"message": "hello",
+				"source": "stderr", "id": "web-0123456789abcdef"},
+		},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		options := map[string]string{`CLOUDWATCH_LOGGER_HOST`: `logger-host`,
+			`CLOUDWATCH_TIMEZONE`: `UTC`}
+		for key, value := range test.options {
+			options[key] = value
+		}
+		adapter := newTestAdapter(t, client, options)
+		msg := testMessage("web", "hello")
+		msg.Container.Config.Labels = map[string]string{"team": "logs"}
+		msg.Source, msg.Time = "stderr", sent
+		runAdapter(adapter, msg)
+		messages := client.messages()
+		if len(messages) != 1 {
+			t.Fatalf("%s: got %d messages, want 1", test.name, len(messages))
+		}
+		if test.want == nil {
+			if messages[0] != "hello" {
+				t.Errorf("%s: got %q, want hello", test.name, messages[0])
+			}
+			continue
+		}
+		var got map[string]interface{}
+		if err := json.Unmarshal([]byte(messages[0]), &got); err != nil {
+			t.Fatalf("%s: got %q, which isn't JSON: %s", test.name,
+				messages[0], err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: got envelope %v, want %v", test.name, got,
+				test.want)
+		}
+	}
+}
+
+func TestStreamTag(t *testing.T) {
+	tests := []struct {
+		tag    string // CLOUDWATCH_STREAM_TAG
+		stream string // LOGSPOUT_STREAM, if set
+		want   string
+	}{
+		{tag: `{{.ID}}`, want: "web-01234567"},
+		{tag: `{{.FullID}}`, want: "web-0123456789abcdef"},
+		{tag: `{{.Name}}`, want: "web"},
+		{tag: `{{.ImageName}}`, want: "team/app_2.0"}, // no colons in streams
+		{tag: `{{.DaemonName}}`, want: "docker"},
+		{tag: `{{.Name}}/{{.ID}}`, want: "web/web-01234567"},
+		{tag: `{{.Nope`, want: "web"},                                // invalid
+		{tag: `{{.Name}}`, stream: `{{.Name}}-set`, want: "web-set"}, // wins
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		options := map[string]string{`CLOUDWATCH_STREAM_TAG`: test.tag}
+		if test.stream != "" {
+			options[`LOGSPOUT_STREAM`] = test.stream
+		}
+		adapter := newTestAdapter(t, client, options)
+		msg := testMessage("web", "hello")
+		msg.Container.Config.Image = "team/app:2.0"
+		runAdapter(adapter, msg)
+		if got := client.putStreams(); !sameStrings(got,
+			[]string{test.want}) {
+			t.Errorf("tag %s: got uploads to streams %q, want %s", test.tag,
+				got, test.want)
+		}
+	}
+}
+
+func TestTruncateNames(t *testing.T) {
+	long := strings.Repeat("a", 600)
+	other := strings.Repeat("a", 599) + "b" // the same first 512 characters
+	adapter := newTestAdapter(t, newFakeLogs(), nil)
+	for _, sanitize := range []func(string) string{adapter.sanitizeGroup,
+		adapter.sanitizeStream} {
+		truncated, truncatedOther := sanitize(long), sanitize(other)
+		if len(truncated) != MAX_NAME_LENGTH {
+			t.Errorf("got a name of %d characters, want %d", len(truncated),
+				MAX_NAME_LENGTH)
+		}
+		if !strings.HasPrefix(truncated, long[:400]) {
+			t.Errorf("got name %s, which doesn't start with the original",
+				truncated)
+		}
+		if truncated == truncatedOther {
+			t.Errorf("got the same name %s for two long names", truncated)
+		}
+		if got := sanitize(long[:MAX_NAME_LENGTH]); got != long[:MAX_NAME_LENGTH] {
+			t.Errorf("got name %s truncated, at the limit", got)
+		}
+	}
+	// each character is kept whole
+	if got := truncateName(strings.Repeat("é", 300)); !utf8.ValidString(got) {
+		t.Errorf("got name %q, with a split character", got)
+	}
+	// the long names are uploaded truncated
+	client := newFakeLogs()
+	adapter = newTestAdapter(t, client,
+		map[string]string{`LOGSPOUT_STREAM`: long})
+	runAdapter(adapter, testMessage("web", "hello"))
+	if got := client.putStreams(); (len(got) != 1) ||
+		(got[0] != adapter.sanitizeStream(long)) {
+		t.Errorf("got uploads to streams %q, want the truncated name", got)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "cloudwatch.yml")
+	err := ioutil.WriteFile(filename, []byte(`rules:
+  - name: "web-*"
+    group: "web-logs"
+    stream: "{{.Name}}-stream"
+  - name: "web-1" # the first matching rule wins
+    group: "never"
+  - regex: "^db\\d+$"
+    group: "db-logs"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		env  []string // the container's environment
+		want string   // the group and stream
+	}{
+		{name: "web-1", want: "web-logs-web-1-stream"},
+		{name: "db2", want: "db-logs-db2"},
+		{name: "cache", want: "test-group-cache"}, // no match
+		// the container's own settings win
+		{name: "web-2", env: []string{`LOGSPOUT_GROUP=env-group`},
+			want: "env-group-web-2-stream"},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client,
+			map[string]string{`CLOUDWATCH_CONFIG_FILE`: filename})
+		msg := testMessage(test.name, "hello")
+		msg.Container.Config.Env = test.env
+		runAdapter(adapter, msg)
+		if (len(client.puts) != 1) ||
+			(client.puts[0].group+"-"+client.puts[0].stream != test.want) {
+			t.Errorf("%s: got uploads %+v, want one to %s", test.name,
+				client.puts, test.want)
+		}
+	}
+	// a file that can't be parsed is ignored
+	ioutil.WriteFile(filename, []byte("rules:\n  - group: no-pattern\n"), 0644)
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client,
+		map[string]string{`CLOUDWATCH_CONFIG_FILE`: filename})
+	runAdapter(adapter, testMessage("web-1", "hello"))
+	if (len(client.puts) != 1) || (client.puts[0].group != "test-group") {
+		t.Errorf("got uploads %+v, want one to test-group", client.puts)
+	}
+}
+
+func TestStripANSI(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{line: "\x1b[31mERROR\x1b[0m failed", want: "ERROR failed"},
+		{line: "\x1b[1;32m✓\x1b[m done", want: "✓ done"},
+		{line: "\x1b]0;title\x07prompt", want: "prompt"}, // window title
+		{line: "\x1b[2K\x1b[1Gprogress 50%", want: "progress 50%"},
+		// text that only looks like an escape is kept
+		{line: "array[31m] = [0m]", want: "array[31m] = [0m]"},
+		{line: "\x1b[0m", want: ""}, // then empty, so skipped
+	}
+	for _, strip := range []bool{true, false} {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client, map[string]string{
+			`CLOUDWATCH_STRIP_ANSI`: fmt.Sprint(strip)})
+		msgs, want := []*router.Message{}, []string{}
+		for _, test := range tests {
+			msgs = append(msgs, testMessage("web", test.line))
+			switch {
+			case !strip:
+				want = append(want, test.line)
+			case test.want != "":
+				want = append(want, test.want)
+			}
+		}
+		runAdapter(adapter, msgs...)
+		if got := client.messages(); !sameStrings(got, want) {
+			t.Errorf("strip %v: got %q, want %q", strip, got, want)
+		}
+	}
+}
+
+func TestDockerReconnect(t *testing.T) {
+	stopped := httptest.NewServer(http.NotFoundHandler())
+	stopped.Close() // so connections to it are refused
+	restarted := httptest.NewServer(&fakeDocker{})
+	defer restarted.Close()
+	defer restarted.CloseClientConnections() // ending the events stream
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client, map[string]string{
+		`CLOUDWATCH_BATCH_SIZE`: `1`,
+		`LOGSPOUT_STREAM`:       `{{.Name}}-{{.ImageTag}}`})
+	dockerClient, err := docker.NewClient(stopped.URL)
+	if err != nil {
+		t.Fatal("creating the Docker client:", err)
+	}
+	adapter.noDocker, adapter.client = false, dockerClient
+	adapter.dockerHost = restarted.URL // where the daemon is back
+	logstream, done := startAdapter(adapter)
+	logstream <- testMessage("c1", "while stopped")
+	if !waitForMessages(client, 1, 2*time.Second) {
+		t.Fatal("got no upload within 2s")
+	}
+	logstream <- testMessage("c2", "after restarting")
+	close(logstream)
+	<-done
+	// the first container got the default names, and the second was
+	// inspected with the new client
+	got := client.putStreams()
+	if !sameStrings(got, []string{"c1-", "c2-inspected"}) {
+		t.Errorf("got uploads to streams %q, want c1- then c2-inspected", got)
+	}
+	if adapter.client == dockerClient {
+		t.Error("got the same Docker client, want a new one")
+	}
+}
+
+func TestLabelFields(t *testing.T) {
+	labels := map[string]string{"git.sha": "0a1b2c", "deploy.version": "1.2",
+		"team": "logs", "message": "replaced"}
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    string
+	}{
+		{name: "unset", want: "hello"},
+		{
+			name: "prefix",
+			options: map[string]string{
+				`CLOUDWATCH_LABEL_FIELDS`: `git.sha, deploy.version,missing`},
+			want: "[git.sha=0a1b2c deploy.version=1.2] hello",
+		},
+		{
+			name: "none found",
+			options: map[string]string{
+				`CLOUDWATCH_LABEL_FIELDS`: `missing`},
+			want: "hello",
+		},
+		{
+			name: "envelope",
+			options: map[string]string{
+				`CLOUDWATCH_LABEL_FIELDS`:    `git.sha,missing,message`,
+				`CLOUDWATCH_JSON_ENVELOPE`:   `true`,
+				`CLOUDWATCH_ENVELOPE_FIELDS`: `message`},
+			// a label can't replace an envelope field
+			want: `{"git.sha":"0a1b2c","message":"hello"}`,
+		},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client, test.options)
+		msg := testMessage("web", "hello")
+		msg.Container.Config.Labels = labels
+		runAdapter(adapter, msg)
+		if got := client.messages(); !sameStrings(got, []string{test.want}) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDefaultGroupWarning(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  map[string]string
+		warnings int
+		uploaded int
+	}{
+		{name: "default", warnings: 1, uploaded: 2},
+		{name: "required",
+			options:  map[string]string{`CLOUDWATCH_REQUIRE_GROUP`: `true`},
+			warnings: 1},
+		{name: "deliberate default",
+			options:  map[string]string{`CLOUDWATCH_DEFAULT_GROUP`: `all`},
+			uploaded: 2},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client, test.options)
+		delete(adapter.Route.Options, `LOGSPOUT_GROUP`)
+		filtered := drops.Total(DROP_FILTERED)
+		output, restore := captureLog()
+		runAdapter(adapter, testMessage("web", "one"),
+			testMessage("web", "two"))
+		restore()
+		warnings := strings.Count(output.String(),
+			"LOGSPOUT_GROUP is not set for container web")
+		if warnings != test.warnings {
+			t.Errorf("%s: got %d warnings, want %d", test.name, warnings,
+				test.warnings)
+		}
+		if got := len(client.messages()); got != test.uploaded {
+			t.Errorf("%s: got %d messages uploaded, want %d", test.name, got,
+				test.uploaded)
+		}
+		dropped := drops.Total(DROP_FILTERED) - filtered
+		if dropped != int64(2-test.uploaded) {
+			t.Errorf("%s: got %d messages dropped, want %d", test.name,
+				dropped, 2-test.uploaded)
+		}
+	}
+}
+
+func TestComposeNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string // the stream
+	}{
+		{
+			name: "compose",
+			labels: map[string]string{
+				`com.docker.compose.project`: `shop`,
+				`com.docker.compose.service`: `api`},
+			want: "[shop/api]",
+		},
+		{name: "not compose", want: "[/]"},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client, map[string]string{
+			`LOGSPOUT_STREAM`: `[{{.ComposeProject}}/{{.ComposeService}}]`})
+		msg := testMessage("web", "hello")
+		msg.Container.Config.Labels = test.labels
+		runAdapter(adapter, msg)
+		if got := client.putStreams(); !sameStrings(got,
+			[]string{test.want}) {
+			t.Errorf("%s: got uploads to streams %q, want %s", test.name,
+				got, test.want)
+		}
+	}
+}
+
+func TestTimestampZones(t *testing.T) {
+	sent := time.Date(2030, 1, 2, 3, 4, 5, 678900000, time.UTC)
+	zones := []*time.Location{time.UTC, time.FixedZone("IST", 19800),
+		time.FixedZone("PST", -28800)}
+	tests := []struct {
+		timezone string // CLOUDWATCH_TIMEZONE, if set
+		want     string // the envelope's time
+	}{
+		{want: "2030-01-02T03:04:05.6789Z"},
+		{timezone: "Asia/Tokyo", want: "2030-01-02T12:04:05.6789+09:00"},
+	}
+	for _, test := range tests {
+		for _, zone := range zones {
+			client := newFakeLogs()
+			options := map[string]string{`CLOUDWATCH_JSON_ENVELOPE`: `true`,
+				`CLOUDWATCH_ENVELOPE_FIELDS`: `time`}
+			if test.timezone != "" {
+				options[`CLOUDWATCH_TIMEZONE`] = test.timezone
+			}
+			adapter := newTestAdapter(t, client, options)
+			msg := testMessage("web", "hello")
+			msg.Time = sent.In(zone)
+			runAdapter(adapter, msg)
+			// the timestamp is always milliseconds since the epoch
+			if got := client.times(); (len(got) != 1) ||
+				(got[0] != 1893553445678) {
+				t.Errorf("zone %s: got timestamps %v, want 1893553445678",
+					zone, got)
+			}
+			want := `{"time":"` + test.want + `"}`
+			if got := client.messages(); !sameStrings(got, []string{want}) {
+				t.Errorf("zone %s, timezone %q: got %q, want %s", zone,
+					test.timezone, got, want)
+			}
+		}
+	}
+}
+
+func TestNameSlash(t *testing.T) {
+	tests := []struct {
+		keep string // CLOUDWATCH_KEEP_NAME_SLASH, if set
+		want string
+	}{
+		{want: "web"},
+		{keep: `false`, want: "web"},
+		{keep: `true`, want: "/web"},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		options := map[string]string{`LOGSPOUT_STREAM`: `{{.Name}}`,
+			`CLOUDWATCH_JSON_ENVELOPE`:   `true`,
+			`CLOUDWATCH_ENVELOPE_FIELDS`: `container`}
+		if test.keep != "" {
+			options[`CLOUDWATCH_KEEP_NAME_SLASH`] = test.keep
+		}
+		adapter := newTestAdapter(t, client, options)
+		runAdapter(adapter, testMessage("web", "hello"))
+		if got := client.putStreams(); !sameStrings(got,
+			[]string{test.want}) {
+			t.Errorf("keep %q: got uploads to streams %q, want %s", test.keep,
+				got, test.want)
+		}
+		want := `{"container":"` + test.want + `"}`
+		if got := client.messages(); !sameStrings(got, []string{want}) {
+			t.Errorf("keep %q: got %q, want %s", test.keep, got, want)
+		}
+	}
+}
+
+func TestEnvPrefix(t *testing.T) {
+	env := []string{`LOGMETA_TEAM=logs`, `LOGMETA_COST_CENTER=42`,
+		`LOGMETA_=empty key`, `LOGMETA_message=replaced`, `PATH=/bin`,
+		`logmeta_lower=no`, `TEAM=other`}
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    string
+	}{
+		{
+			name: "envelope",
+			options: map[string]string{`CLOUDWATCH_ENV_PREFIX`: `LOGMETA_`,
+				`CLOUDWATCH_JSON_ENVELOPE`:   `true`,
+				`CLOUDWATCH_ENVELOPE_FIELDS`: `message`},
+			// an env var can't replace an envelope field
+			want: `{"COST_CENTER":"42","TEAM":"logs","message":"hello"}`,
+		},
+		{
+			name: "no prefix",
+			options: map[string]string{`CLOUDWATCH_JSON_ENVELOPE`: `true`,
+				`CLOUDWATCH_ENVELOPE_FIELDS`: `message`},
+			want: `{"message":"hello"}`,
+		},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client, test.options)
+		msg := testMessage("web", "hello")
+		msg.Container.Config.Env = env
+		runAdapter(adapter, msg)
+		if got := client.messages(); !sameStrings(got, []string{test.want}) {
+			t.Errorf("%s: got %q, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFallbackNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    string // group-stream
+		logged  bool   // whether the render error is logged
+	}{
+		{
+			name: "stream error",
+			options: map[string]string{`LOGSPOUT_STREAM`: `{{.Nope}}`,
+				`CLOUDWATCH_FALLBACK_STREAM`: `fallback-{{.Name}}`},
+			want:   "test-group-fallback-web",
+			logged: true,
+		},
+		{
+			name:    "stream error without a fallback",
+			options: map[string]string{`LOGSPOUT_STREAM`: `{{.Nope}}`},
+			want:    "test-group-web",
+		},
+		{
+			name: "stream unset",
+			options: map[string]string{
+				`CLOUDWATCH_FALLBACK_STREAM`: `fallback-{{.Name}}`},
+			want: "test-group-web",
+		},
+		{
+			name: "group error",
+			options: map[string]string{`LOGSPOUT_GROUP`: `{{.Nope}}`,
+				`CLOUDWATCH_FALLBACK_GROUP`: `fallback-group`},
+			want:   "fallback-group-web",
+			logged: true,
+		},
+	}
+	for _, test := range tests {
+		output, restore := captureLog()
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client, test.options)
+		runAdapter(adapter, testMessage("web", "hello"))
+		restore()
+		got := []string{}
+		for _, put := range client.puts {
+			got = append(got, put.group+"-"+put.stream)
+		}
+		if !sameStrings(got, []string{test.want}) {
+			t.Errorf("%s: got uploads to %q, want %s", test.name, got,
+				test.want)
+		}
+		logged := strings.Contains(output.String(), "using the fallback")
+		if logged != test.logged {
+			t.Errorf("%s: logged the render error: %t, want %t", test.name,
+				logged, test.logged)
+		}
+	}
+}
+
+func TestOptionPrecedence(t *testing.T) {
+	os.Setenv(`LOGSPOUT_GROUP`, `logspout-group`)
+	defer os.Unsetenv(`LOGSPOUT_GROUP`)
+	tests := []struct {
+		precedence string // CLOUDWATCH_OPTION_PRECEDENCE, if set
+		want       string
+		sources    []string
+	}{
+		{
+			want: "label-group",
+			sources: []string{`logspout`, `route`, `config`, `container`,
+				`label`},
+		},
+		{
+			precedence: `logspout,container,route`,
+			want:       "route-group",
+			sources:    []string{`logspout`, `container`, `route`},
+		},
+		{
+			precedence: `route,logspout`,
+			want:       "logspout-group",
+			sources:    []string{`route`, `logspout`},
+		},
+		{
+			precedence: `container, route, container, bogus`,
+			want:       "route-group",
+			sources:    []string{`container`, `route`},
+		},
+		{precedence: `label`, want: "label-group", sources: []string{`label`}},
+	}
+	for _, test := range tests {
+		route := &router.Route{Options: map[string]string{
+			`LOGSPOUT_GROUP`:       `route-group`,
+			`LOGSPOUT_GROUP_LABEL`: `logs.group`,
+		}}
+		if test.precedence != "" {
+			route.Options[`CLOUDWATCH_OPTION_PRECEDENCE`] = test.precedence
+		}
+		adapter := &CloudwatchAdapter{Route: route,
+			precedence: getOptionPrecedence(route)}
+		if !sameStrings(adapter.precedence, test.sources) {
+			t.Errorf("%q: got sources %q, want %q", test.precedence,
+				adapter.precedence, test.sources)
+		}
+		context := &RenderContext{Name: `web`,
+			Env:    map[string]string{`LOGSPOUT_GROUP`: `env-group`},
+			Labels: map[string]string{`logs.group`: `label-group`}}
+		got := adapter.renderEnvValue(`LOGSPOUT_GROUP`, context,
+			"default-group")
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.precedence, got, test.want)
+		}
+	}
+}
+
+func TestDropRollup(t *testing.T) {
+	tests := []struct {
+		reason  string
+		options map[string]string
+		fail    bool // if set, the upload fails
+		lines   []string
+		want    int64
+	}{
+		{reason: DROP_EMPTY, lines: []string{"", "hello"}, want: 1},
+		{
+			reason:  DROP_FILTERED,
+			options: map[string]string{`CLOUDWATCH_OPT_IN`: `true`},
+			lines:   []string{"hello", "again"},
+			want:    2,
+		},
+		{
+			reason: DROP_DENYLISTED,
+			options: map[string]string{
+				`CLOUDWATCH_GROUP_DENYLIST`: `test-group`},
+			lines: []string{"hello"},
+			want:  1,
+		},
+		{
+			reason:  DROP_MATCHED,
+			options: map[string]string{`CLOUDWATCH_DROP_PATTERN`: `^GET `},
+			lines:   []string{"GET /healthz", "hello"},
+			want:    1,
+		},
+		{
+			reason: DROP_RATE_LIMITED,
+			options: map[string]string{
+				`CLOUDWATCH_MAX_EVENTS_PER_SEC`: `1`},
+			lines: []string{"one", "two", "three"},
+			want:  2,
+		},
+		{
+			reason: DROP_DELIVERY_FAILED,
+			fail:   true,
+			lines:  []string{"one", "two"},
+			want:   2,
+		},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		if test.fail {
+			client.failWith("PutLogEvents", errAccessDenied, 1)
+		}
+		adapter := newTestAdapter(t, client, test.options)
+		msgs := []*router.Message{}
+		for _, line := range test.lines {
+			msgs = append(msgs, testMessage("web", line))
+		}
+		drops.Reset()
+		runAdapter(adapter, msgs...)
+		counts := drops.Reset()
+		if got := counts[test.reason]; got != test.want {
+			t.Errorf("%s: got %d dropped, want %d", test.reason, got,
+				test.want)
+		}
+		want := fmt.Sprintf("%d messages (%d %s)", test.want, test.want,
+			test.reason)
+		if got := dropRollup(counts); got != want {
+			t.Errorf("%s: got rollup %q, want %q", test.reason, got, want)
+		}
+		// the counts were reset after the rollup
+		if got := dropRollup(drops.Reset()); got != "" {
+			t.Errorf("%s: got rollup %q after a reset", test.reason, got)
+		}
+	}
+	counts := map[string]int64{DROP_REJECTED: 1, DROP_EMPTY: 2,
+		DROP_FILTERED: 0}
+	want := "3 messages (2 empty, 1 rejected)"
+	if got := dropRollup(counts); got != want {
+		t.Errorf("got rollup %q, want %q", got, want)
+	}
+}
+
+func TestTemplateFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "names.tmpl")
+	err := ioutil.WriteFile(filename, []byte(
+		`{{define "groupname"}}{{.Name}}-{{.Env.TEAM}}{{end}}`+"\n"+
+			`{{define "streamname"}}{{.Name | upper}}{{end}}`+"\n"), 0644)
+	if err != nil {
+		t.Fatal("writing the template file:", err)
+	}
+	tests := []struct {
+		name     string
+		filename string
+		want     string // group-stream
+	}{
+		{name: "included", filename: filename, want: "web-payments-WEB"},
+		{
+			name:     "missing file",
+			filename: filepath.Join(dir, "missing.tmpl"),
+			want:     "fallback-web",
+		},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client, map[string]string{
+			`CLOUDWATCH_TEMPLATE_FILE`:  test.filename,
+			`LOGSPOUT_GROUP`:            `{{template "groupname" .}}`,
+			`LOGSPOUT_STREAM`:           `{{template "streamname" .}}`,
+			`CLOUDWATCH_FALLBACK_GROUP`: `fallback`,
+		})
+		msg := testMessage("web", "hello")
+		msg.Container.Config.Env = []string{`TEAM=payments`}
+		runAdapter(adapter, msg)
+		got := []string{}
+		for _, put := range client.puts {
+			got = append(got, put.group+"-"+put.stream)
+		}
+		if !sameStrings(got, []string{test.want}) {
+			t.Errorf("%s: got uploads to %q, want %s", test.name, got,
+				test.want)
+		}
+	}
+}
+
+func TestContainerHost(t *testing.T) {
+	tests := []struct {
+		hostname string
+		want     string
+	}{
+		{hostname: "api-host", want: "api-host"},
+		{hostname: "", want: "web-01234567"}, // the short ID
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client,
+			map[string]string{`LOGSPOUT_STREAM`: `service-{{.Host}}`})
+		msg := testMessage("web", "hello")
+		msg.Container.Config.Hostname = test.hostname
+		if got := containerHost(msg.Container); got != test.want {
+			t.Errorf("hostname %q: got host %q, want %q", test.hostname,
+				got, test.want)
+		}
+		runAdapter(adapter, msg)
+		want := "service-" + test.want
+		if got := client.putStreams(); !sameStrings(got, []string{want}) {
+			t.Errorf("hostname %q: got uploads to streams %q, want %s",
+				test.hostname, got, want)
+		}
+	}
+}
+
+func TestStreamRoutes(t *testing.T) {
+	lines := []string{"GET /index.html 200", "POST /login 302",
+		"[error] upstream timed out", "worker started"}
+	tests := []struct {
+		name   string
+		routes string // CLOUDWATCH_STREAM_ROUTES
+		want   []string
+	}{
+		{
+			name:   "access and error",
+			routes: `GET|POST=access;.=error`,
+			want:   []string{"access", "access", "error", "error"},
+		},
+		{
+			name:   "no match",
+			routes: `GET|POST=access`,
+			want:   []string{"access", "access", "web", "web"},
+		},
+		{
+			name:   "first match wins",
+			routes: `error=errors;.=other;GET=access`,
+			want:   []string{"other", "other", "errors", "other"},
+		},
+		{
+			name:   "templates",
+			routes: `^(GET|POST) ={{.Name}}-access;[=bad;x`,
+			want:   []string{"web-access", "web-access", "web", "web"},
+		},
+		{
+			name:   "empty stream",
+			routes: `GET={{.Env.MISSING | default ""}};.=other`,
+			want:   []string{"web", "other", "other", "other"},
+		},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client,
+			map[string]string{`CLOUDWATCH_STREAM_ROUTES`: test.routes})
+		msgs := []*router.Message{}
+		for _, line := range lines {
+			msgs = append(msgs, testMessage("web", line))
+		}
+		runAdapter(adapter, msgs...)
+		streams := map[string]string{} // by message
+		for _, put := range client.puts {
+			for _, message := range put.messages {
+				streams[message] = put.stream
+			}
+		}
+		got := []string{}
+		for _, line := range lines {
+			got = append(got, streams[line])
+		}
+		if !sameStrings(got, test.want) {
+			t.Errorf("%s: got streams %q, want %q", test.name, got,
+				test.want)
+		}
+	}
+}
+
+func TestNestedJSON(t *testing.T) {
+	tests := []struct {
+		nested string // CLOUDWATCH_NESTED_JSON, if set
+		data   string
+		want   string
+	}{
+		{
+			nested: `true`,
+			data:   `{"level":"info","n":1}`,
+			want:   `{"message":{"level":"info","n":1}}`,
+		},
+		{
+			nested: `true`,
+			data:   ` {"padded": true} `,
+			want:   `{"message":{"padded":true}}`,
+		},
+		{
+			nested: `true`,
+			data:   `not {"json"}`,
+			want:   `{"message":"not {\"json\"}"}`,
+		},
+		{
+			nested: `true`,
+			data:   `{"broken": `,
+			want:   `{"message":"{\"broken\": "}`,
+		},
+		{
+			nested: `true`,
+			data:   `[1,2]`, // only objects are nested
+			want:   `{"message":"[1,2]"}`,
+		},
+		{
+			data: `{"level":"info"}`,
+			want: `{"message":"{\"level\":\"info\"}"}`,
+		},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		options := map[string]string{`CLOUDWATCH_JSON_ENVELOPE`: `true`,
+			`CLOUDWATCH_ENVELOPE_FIELDS`: `message`}
+		if test.nested != "" {
+			options[`CLOUDWATCH_NESTED_JSON`] = test.nested
+		}
+		adapter := newTestAdapter(t, client, options)
+		runAdapter(adapter, testMessage("web", test.data))
+		if got := client.messages(); !sameStrings(got, []string{test.want}) {
+			t.Errorf("%q: got %q, want %s", test.data, got, test.want)
+		}
+	}
+}
+
+func TestUnreachableDocker(t *testing.T) {
+	stopped := httptest.NewServer(http.NotFoundHandler())
+	stopped.Close() // so connections to it are refused
+	tests := []struct {
+		host string // DOCKER_HOST
+		want string // in the error
+	}{
+		{host: stopped.URL, want: "ERROR connecting to Docker at " +
+			stopped.URL + " (check DOCKER_HOST)"},
+		{host: `tcp://[bad`, want: "ERROR creating Docker client"},
+	}
+	defer os.Unsetenv(`DOCKER_HOST`)
+	for _, test := range tests {
+		os.Setenv(`DOCKER_HOST`, test.host)
+		route := &router.Route{Adapter: `cloudwatch`, Address: `us-east-1`,
+			Options: map[string]string{`NOEC2`: ``}}
+		adapter, err := NewCloudwatchAdapter(route)
+		if err == nil {
+			t.Errorf("%s: got adapter %v, want an error", test.host, adapter)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %q, want %q", test.host, err, test.want)
+		}
+	}
+}
+
+func TestGroupNameFunc(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{name: "missing", want: "default"},
+		{name: "empty", env: map[string]string{`APP_NAME`: ` `},
+			want: "default"},
+		{name: "clean", env: map[string]string{`APP_NAME`: `billing-api`},
+			want: "billing-api"},
+		{
+			name: "dirty",
+			env:  map[string]string{`APP_NAME`: ` Billing API:v2* `},
+			want: "billing_api_v2_",
+		},
+	}
+	for _, test := range tests {
+		route := &router.Route{Options: map[string]string{
+			`LOGSPOUT_GROUP`: `{{groupname .Env.APP_NAME "Default"}}`}}
+		adapter := &CloudwatchAdapter{Route: route,
+			precedence: getOptionPrecedence(route)}
+		context := &RenderContext{Name: `web`, Env: test.env}
+		got := adapter.renderEnvValue(`LOGSPOUT_GROUP`, context, "unrendered")
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLevelStreams(t *testing.T) {
+	lines := []string{"ERROR disk full", "fatal: out of memory",
+		"INFO started", "no level here", "WARN slow request"}
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    []string // the stream of each line
+	}{
+		{
+			name: "errors stream",
+			options: map[string]string{
+				`CLOUDWATCH_LEVEL_PATTERN`:    `^(?i)(ERROR|FATAL|WARN|INFO)`,
+				`CLOUDWATCH_LEVEL_STREAM_MAP`: `ERROR=-errors, fatal=-errors`},
+			want: []string{"web-errors", "web-errors", "web", "web", "web"},
+		},
+		{
+			name: "bad entries",
+			options: map[string]string{
+				`CLOUDWATCH_LEVEL_PATTERN`:    `^(WARN|INFO)`,
+				`CLOUDWATCH_LEVEL_STREAM_MAP`: `WARN=-warn*,=x,INFO`},
+			want: []string{"web", "web", "web", "web", "web-warn_"},
+		},
+		{
+			name: "no map",
+			options: map[string]string{
+				`CLOUDWATCH_LEVEL_PATTERN`: `^(ERROR)`},
+			want: []string{"web", "web", "web", "web", "web"},
+		},
+		{
+			name: "bad pattern",
+			options: map[string]string{`CLOUDWATCH_LEVEL_PATTERN`: `(`,
+				`CLOUDWATCH_LEVEL_STREAM_MAP`: `ERROR=-errors`},
+			want: []string{"web", "web", "web", "web", "web"},
+		},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client, test.options)
+		msgs := []*router.Message{}
+		for _, line := range lines {
+			msgs = append(msgs, testMessage("web", line))
+		}
+		runAdapter(adapter, msgs...)
+		streams := map[string]string{} // by message
+		for _, put := range client.puts {
+			for _, message := range put.messages {
+				streams[message] = put.stream
+			}
+		}
+		got := []string{}
+		for _, line := range lines {
+			got = append(got, streams[line])
+		}
+		if !sameStrings(got, test.want) {
+			t.Errorf("%s: got streams %q, want %q", test.name, got,
+				test.want)
+		}
+	}
+}
+
+func TestDateStream(t *testing.T) {
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client,
+		map[string]string{`LOGSPOUT_STREAM`: `{{.Name}}/{{date "2006-01-02"}}`})
+	info := &containerInfo{names: map[string]*logNames{},
+		context: &RenderContext{Name: `web`}, ship: true}
+	today := "web/" + time.Now().UTC().Format("2006-01-02")
+	names := adapter.sourceNames(info, `stdout`)
+	if names.stream != today {
+		t.Errorf("got stream %q, want %q", names.stream, today)
+	}
+	// names rendered yesterday are rendered again, with today's date
+	yesterday := time.Now().UTC().AddDate(0, 0, -1)
+	names.stream = "web/" + yesterday.Format("2006-01-02")
+	names.period = yesterday.Truncate(NAMES_PERIOD)
+	if got := adapter.sourceNames(info, `stdout`).stream; got != today {
+		t.Errorf("got stream %q after a day, want %q", got, today)
+	}
+	// while names from this period are still used
+	names = adapter.sourceNames(info, `stdout`)
+	names.stream = "cached"
+	if got := adapter.sourceNames(info, `stdout`).stream; got != "cached" {
+		t.Errorf("got stream %q in the same period, want cached", got)
+	}
+}
+
+func TestCrashContext(t *testing.T) {
+	tests := []struct {
+		exitCode string
+		want     []string // the crash context events
+	}{
+		{exitCode: "137", want: []string{"container web exited with code " +
+			"137, last 3 lines:\nline 2\nline 3\nline 4"}},
+		{exitCode: "0", want: []string{}},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client, map[string]string{
+			`CLOUDWATCH_CRASH_STREAM`: `{{.Name}}-crash`,
+			`CLOUDWATCH_CRASH_LINES`:  `3`})
+		events := make(chan *docker.APIEvents)
+		adapter.events = events
+		logstream, done := startAdapter(adapter)
+		for i := 0; i < 5; i++ {
+			logstream <- testMessage("web", fmt.Sprintf("line %d", i))
+		}
+		events <- &docker.APIEvents{Type: "container", Action: "die",
+			Actor: docker.APIActor{ID: "web-0123456789abcdef",
+				Attributes: map[string]string{"exitCode": test.exitCode}}}
+		// the lines were forgotten, so a second crash sends nothing
+		events <- &docker.APIEvents{Type: "container", Action: "die",
+			Actor: docker.APIActor{ID: "web-0123456789abcdef",
+				Attributes: map[string]string{"exitCode": test.exitCode}}}
+		close(logstream)
+		<-done
+		got := []string{}
+		for _, put := range client.puts {
+			if put.stream == "web-crash" {
+				got = append(got, put.messages...)
+			}
+		}
+		if !sameStrings(got, test.want) {
+			t.Errorf("exit code %s: got crash context %q, want %q",
+				test.exitCode, got, test.want)
+		}
+		if got := len(client.messages()); got != 5+len(test.want) {
+			t.Errorf("exit code %s: got %d messages, want %d", test.exitCode,
+				got, 5+len(test.want))
+		}
+	}
+}
+
+func TestDefaultNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		env     []string // the container's
+		want    string   // group-stream
+	}{
+		{name: "built in", want: "logger-host-web"},
+		{
+			name: "templates",
+			options: map[string]string{
+				`CLOUDWATCH_DEFAULT_GROUP`:  `{{.Env.TEAM}}-logs`,
+				`CLOUDWATCH_DEFAULT_STREAM`: `{{.Name}}-{{.Source}}`},
+			env:  []string{`TEAM=payments`},
+			want: "payments-logs-web-stdout",
+		},
+		{
+			name: "container env wins",
+			options: map[string]string{
+				`CLOUDWATCH_DEFAULT_GROUP`:  `fleet`,
+				`CLOUDWATCH_DEFAULT_STREAM`: `{{.Name}}-{{.Source}}`},
+			env:  []string{`LOGSPOUT_GROUP=mine`, `LOGSPOUT_STREAM=custom`},
+			want: "mine-custom",
+		},
+		{
+			name: "bad templates",
+			options: map[string]string{`CLOUDWATCH_DEFAULT_GROUP`: `{{.Nope}}`,
+				`CLOUDWATCH_DEFAULT_STREAM`: `{{.Name`},
+			want: "logger-host-web",
+		},
+		{
+			name: "empty",
+			options: map[string]string{
+				`CLOUDWATCH_DEFAULT_STREAM`: `{{.Env.MISSING | default ""}}`},
+			want: "logger-host-web",
+		},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client, test.options)
+		delete(adapter.Route.Options, `LOGSPOUT_GROUP`)
+		adapter.OsHost = `logger-host`
+		msg := testMessage("web", "hello")
+		msg.Container.Config.Env = test.env
+		runAdapter(adapter, msg)
+		got := []string{}
+		for _, put := range client.puts {
+			got = append(got, put.group+"-"+put.stream)
+		}
+		if !sameStrings(got, []string{test.want}) {
+			t.Errorf("%s: got uploads to %q, want %s", test.name, got,
+				test.want)
+		}
+	}
+}
+
+// returns the heartbeats uploaded to the given group and stream
+func (f *fakeLogs) heartbeats(t *testing.T, group, stream string) []heartbeat {
+	f.Lock()
+	defer f.Unlock()
+	beats := []heartbeat{}
+	for _, put := range f.puts {
+		if (put.group != group) || (put.stream != stream) {
+			continue
+		}
+		for _, message := range put.messages {
+			var beat heartbeat
+			if err := json.Unmarshal([]byte(message), &beat); err != nil {
+				t.Fatalf("parsing heartbeat %s: %s", message, err)
+			}
+			beats = append(beats, beat)
+		}
+	}
+	return beats
+}
+
+func TestHeartbeat(t *testing.T) {
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client, map[string]string{
+		`CLOUDWATCH_HEARTBEAT_INTERVAL`: `1h`,
+		`CLOUDWATCH_LOGGER_HOST`:        `test-host`,
+	})
+	if adapter.heartbeats == nil {
+		t.Fatal("no heartbeat ticker")
+	}
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	adapter.streamMessage(testMessage("web", "hello"))
+	adapter.sendHeartbeat(now)
+	runAdapter(adapter)
+	beats := client.heartbeats(t, "test-host", "heartbeat")
+	want := heartbeat{Type: `heartbeat`, Time: `2024-01-15T12:00:00Z`,
+		Host: `test-host`, Containers: 1}
+	if (len(beats) != 1) || (beats[0] != want) {
+		t.Errorf("got heartbeats %+v, want %+v", beats, want)
+	}
+	// without the interval, there are none
+	adapter = newTestAdapter(t, newFakeLogs(), nil)
+	if adapter.heartbeats != nil {
+		t.Error("got a heartbeat ticker, want none")
+	}
+}
+
+func TestHeartbeatCadence(t *testing.T) {
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client, map[string]string{
+		`CLOUDWATCH_HEARTBEAT_INTERVAL`: `50ms`,
+		`CLOUDWATCH_HEARTBEAT_STREAM`:   `alive`,
+		`CLOUDWATCH_LOGGER_HOST`:        `test-host`,
+	})
+	logstream, done := startAdapter(adapter)
+	time.Sleep(275 * time.Millisecond) // five intervals, and a bit
+	close(logstream)
+	<-done
+	// the ticker drops ticks if the loop is slow, as it may be when racing
+	beats := client.heartbeats(t, "test-host", "alive")
+	if (len(beats) < 3) || (len(beats) > 5) {
+		t.Errorf("got %d heartbeats in 275ms, want 5 (at least 3)",
+			len(beats))
+	}
+}
+
+func TestInsightsJSON(t *testing.T) {
+	sent := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		data  string
+		extra map[string]string // more options
+		want  string
+	}{
+		{
+			name: "level",
+			data: "ERROR disk full",
+			want: `{"@message":"ERROR disk full",` +
+				`"@timestamp":"2024-01-15T12:00:00Z","container":"web",` +
+				`"level":"ERROR"}`,
+		},
+		{
+			name: "no level",
+			data: "started",
+			want: `{"@message":"started","@timestamp":"2024-01-15T12:00:00Z",` +
+				`"container":"web","level":""}`,
+		},
+		{
+			name:  "nested",
+			data:  `{"user":"ann"}`,
+			extra: map[string]string{`CLOUDWATCH_NESTED_JSON`: `true`},
+			want: `{"@message":{"user":"ann"},` +
+				`"@timestamp":"2024-01-15T12:00:00Z","container":"web",` +
+				`"level":""}`,
+		},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		options := map[string]string{`CLOUDWATCH_INSIGHTS_JSON`: `true`,
+			`CLOUDWATCH_ENVELOPE_FIELDS`: `message`,
+			`CLOUDWATCH_LEVEL_PATTERN`:   `^(ERROR|WARN)`}
+		for key, value := range test.extra {
+			options[key] = value
+		}
+		adapter := newTestAdapter(t, client, options)
+		msg := testMessage("web", test.data)
+		msg.Time = sent
+		runAdapter(adapter, msg)
+		if got := client.messages(); !sameStrings(got, []string{test.want}) {
+			t.Errorf("%s: got %q, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDegradedContext(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "daemon unavailable", http.StatusInternalServerError)
+		}))
+	defer failing.Close()
+	for _, fail := range []bool{false, true} {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client, map[string]string{
+			`LOGSPOUT_STREAM`: `{{.Name}}-{{.Env.STAGE}}-{{.Labels.team}}`})
+		if adapter.client != nil {
+			t.Errorf("failing %v: got a Docker client, want none", fail)
+		}
+		if fail { // inspecting the container fails instead
+			dockerClient, err := docker.NewClient(failing.URL)
+			if err != nil {
+				t.Fatal("creating the Docker client:", err)
+			}
+			adapter.noDocker, adapter.client = false, dockerClient
+		}
+		msg := testMessage("web", "hello")
+		msg.Container.Config.Env = []string{`STAGE=prod`}
+		msg.Container.Config.Labels = map[string]string{"team": "logs"}
+		logstream, done := startAdapter(adapter)
+		logstream <- msg
+		close(logstream)
+		<-done
+		if got := client.putStreams(); !sameStrings(got,
+			[]string{"web-prod-logs"}) {
+			t.Errorf("failing %v: got uploads to streams %q, want "+
+				"web-prod-logs", fail, got)
+		}
+	}
+}
+
+func TestSweepIdle(t *testing.T) {
+	tests := []struct {
+		name       string
+		sentBefore []bool // whether a message is sent before each sweep
+		wantCached bool
+	}{
+		{name: "one sweep", sentBefore: []bool{true}, wantCached: true},
+		{
+			name:       "two idle sweeps",
+			sentBefore: []bool{true, false},
+			wantCached: false,
+		},
+		{
+			name:       "active between sweeps",
+			sentBefore: []bool{true, true},
+			wantCached: true,
+		},
+		{
+			name:       "active again after two idle sweeps",
+			sentBefore: []bool{true, false, true},
+			wantCached: true,
+		},
+	}
+	for _, test := range tests {
+		adapter := newTestAdapter(t, newFakeLogs(), nil)
+		if adapter.idleSweeps == nil {
+			t.Fatalf("%s: got no idle sweeps without Docker", test.name)
+		}
+		m := testMessage("web", "hello")
+		for _, send := range test.sentBefore {
+			if send {
+				adapter.streamMessage(m)
+			}
+			adapter.sweepIdle()
+		}
+		_, cached := adapter.containers[m.Container.ID]
+		if cached != test.wantCached {
+			t.Errorf("%s: got cached %v, want %v", test.name, cached,
+				test.wantCached)
+		}
+		runAdapter(adapter)
+	}
+}
@@ -0,0 +1,98 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"regexp"
+
+	"github.com/gliderlabs/logspout/router"
+	"gopkg.in/yaml.v2"
+)
+
+// configRule sets the group and stream name templates for the containers
+// whose names match either its glob pattern, or its regular expression.
+type configRule struct {
+	Name   string `yaml:"name"`  // a glob pattern, as in "web-*"
+	Regex  string `yaml:"regex"` // a regular expression, as in "^web-\d+$"
+	Group  string `yaml:"group"`
+	Stream string `yaml:"stream"`
+	regex  *regexp.Regexp
+}
+
+// returns the rules in the file named by CLOUDWATCH_CONFIG_FILE, in order,
+// or nil if it's not set. Errors in the file are logged, and it's ignored.
+func loadConfigRules(route *router.Route) []configRule {
+	filename, isSet := getOption(route, `CLOUDWATCH_CONFIG_FILE`)
+	if !isSet {
+		return nil
+	}
+	rules, err := parseConfigRules(filename)
+	if err != nil {
+		log.Printf("cloudwatch: WARNING: ERROR reading CLOUDWATCH_CONFIG_FILE "+
+			"%s, ignoring it: %s\n", filename, err)
+		return nil
+	}
+	return rules
+}
+
+// reads and checks the rules in the given YAML file
+func parseConfigRules(filename string) ([]configRule, error) {
+	text, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Rules []configRule `yaml:"rules"`
+	}
+	if err = yaml.Unmarshal(text, &config); err != nil {
+		return nil, err
+	}
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if (rule.Name == "") == (rule.Regex == "") {
+			return nil, fmt.Errorf("rule %d needs either a name or a regex", i+1)
+		}
+		if rule.Regex != "" {
+			if rule.regex, err = regexp.Compile(rule.Regex); err != nil {
+				return nil, fmt.Errorf("rule %d: %s", i+1, err)
+			}
+		} else if _, err = path.Match(rule.Name, ""); err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i+1, err)
+		}
+	}
+	return config.Rules, nil
+}
+
+// returns true if the rule applies to the named container
+func (r *configRule) matches(name string) bool {
+	if r.regex != nil {
+		return r.regex.MatchString(name)
+	}
+	matched, _ := path.Match(r.Name, name)
+	return matched
+}
+
+// Returns the template set for LOGSPOUT_GROUP or LOGSPOUT_STREAM by the
+// first config file rule that matches the named container, if any, and
+// a description of the rule.
+func (a *CloudwatchAdapter) configValue(envKey, name string) (string,
+	string, bool) {
+	for _, rule := range a.configRules {
+		if !rule.matches(name) {
+			continue
+		}
+		pattern := rule.Name
+		if rule.regex != nil {
+			pattern = rule.Regex
+		}
+		switch {
+		case (envKey == `LOGSPOUT_GROUP`) && (rule.Group != ""):
+			return rule.Group, `config file rule ` + pattern, true
+		case (envKey == `LOGSPOUT_STREAM`) && (rule.Stream != ""):
+			return rule.Stream, `config file rule ` + pattern, true
+		}
+	}
+	return "", "", false
+}
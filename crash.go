@@ -0,0 +1,80 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// the number of recent lines sent as a container's crash context
+const DEFAULT_CRASH_LINES = 50
+
+// recentLines holds the last lines logged by a container, oldest first.
+type recentLines struct {
+	lines []string
+	limit int
+}
+
+// adds a line, forgetting the oldest one if there are too many
+func (r *recentLines) Add(line string) {
+	r.lines = append(r.lines, line)
+	if len(r.lines) > r.limit {
+		r.lines = r.lines[len(r.lines)-r.limit:]
+	}
+}
+
+// reads CLOUDWATCH_CRASH_STREAM and CLOUDWATCH_CRASH_LINES into the adapter
+func (a *CloudwatchAdapter) setCrashContext(route *router.Route) {
+	a.crashStream, _ = getOption(route, `CLOUDWATCH_CRASH_STREAM`)
+	a.crashLines = getIntOption(route, `CLOUDWATCH_CRASH_LINES`,
+		DEFAULT_CRASH_LINES)
+	if a.crashLines < 1 {
+		log.Printf("cloudwatch: WARNING: CLOUDWATCH_CRASH_LINES must be at "+
+			"least 1, using %d\n", DEFAULT_CRASH_LINES)
+		a.crashLines = DEFAULT_CRASH_LINES
+	}
+}
+
+// remembers the message as one of its container's recent lines, if crash
+// contexts are being sent
+func (a *CloudwatchAdapter) recordLine(m *router.Message) {
+	if a.crashStream == "" {
+		return
+	}
+	recent, exists := a.recent[m.Container.ID]
+	if !exists {
+		recent = &recentLines{limit: a.crashLines}
+		a.recent[m.Container.ID] = recent
+	}
+	recent.Add(m.Data)
+}
+
+// Sends the recent lines of a container that exited with a non-zero code as
+// a single event, to the CLOUDWATCH_CRASH_STREAM in each of its log groups.
+// The lines are forgotten either way, so each crash context only has the
+// lines from the container's last run.
+func (a *CloudwatchAdapter) sendCrashContext(id, exitCode string) {
+	recent, exists := a.recent[id]
+	delete(a.recent, id)
+	info, isCached := a.containers[id]
+	if !exists || !isCached || (exitCode == "") || (exitCode == "0") {
+		return
+	}
+	stream, err := renderTemplateWith(a.templates, a.crashStream,
+		info.context)
+	if (err != nil) || (strings.TrimSpace(stream) == "") {
+		log.Printf("cloudwatch: WARNING: ERROR rendering "+
+			"CLOUDWATCH_CRASH_STREAM for container %s, not sending its "+
+			"crash context\n", info.context.Name)
+		return
+	}
+	text := fmt.Sprintf("container %s exited with code %s, last %d lines:\n%s",
+		info.context.Name, exitCode, len(recent.lines),
+		strings.Join(recent.lines, "\n"))
+	names := a.sourceNames(info, info.context.Source)
+	a.sendToGroups(names.groups, a.sanitizeStream(stream), text, time.Now(),
+		id, info)
+}
@@ -0,0 +1,125 @@
+package cloudwatch
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+const DEFAULT_DEADLETTER_MAX_MB = 100 // total size of the dead-letter files
+
+// ends the names of dead-letter and write-ahead log files that are gzipped
+const GZIP_EXTENSION = ".gz"
+
+// numbers the dead-letter files written by this process, so that uploaders
+// writing at the same time never choose the same name
+var deadLetterCount int64
+
+// DeadLetterDir stores batches that could not be uploaded to AWS, as files
+// of newline-delimited JSON messages, so they can be replayed later.
+// The oldest files are deleted to keep the directory under its size limit.
+type DeadLetterDir struct {
+	path     string
+	maxBytes int64
+	compress bool // if set, gzip each file
+}
+
+// constructor for DeadLetterDir - returns nil unless
+// CLOUDWATCH_DEADLETTER_DIR is set, or if the directory can't be created
+func NewDeadLetterDir(route *router.Route) *DeadLetterDir {
+	path, isSet := getOption(route, `CLOUDWATCH_DEADLETTER_DIR`)
+	if !isSet {
+		return nil
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		log.Println("cloudwatch: ERROR creating dead-letter directory:", err)
+		return nil
+	}
+	maxMB := getIntOption(route, `CLOUDWATCH_DEADLETTER_MAX_MB`,
+		DEFAULT_DEADLETTER_MAX_MB)
+	if maxMB < 1 { // or every batch would be deleted as soon as it's saved
+		log.Printf("cloudwatch: WARNING: CLOUDWATCH_DEADLETTER_MAX_MB must be "+
+			"at least 1, using %d\n", DEFAULT_DEADLETTER_MAX_MB)
+		maxMB = DEFAULT_DEADLETTER_MAX_MB
+	}
+	return &DeadLetterDir{
+		path:     path,
+		maxBytes: int64(maxMB) * 1024 * 1024,
+		compress: getBoolOption(route, `CLOUDWATCH_SPILL_GZIP`, false),
+	}
+}
+
+// Writes the batch to a new file, then deletes the oldest files as needed.
+func (d *DeadLetterDir) Write(batch CloudwatchBatch) error {
+	name := filepath.Join(d.path, fmt.Sprintf("batch-%d-%d.json",
+		time.Now().UnixNano(), atomic.AddInt64(&deadLetterCount, 1)))
+	if d.compress {
+		name = name + GZIP_EXTENSION
+	}
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	var output io.WriteCloser = file
+	if d.compress {
+		output = gzip.NewWriter(file)
+	}
+	encoder := json.NewEncoder(output)
+	for _, msg := range batch.Msgs {
+		if err = encoder.Encode(msg); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if d.compress { // write the gzip trailer
+		if err = output.Close(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return d.prune()
+}
+
+// Deletes the oldest dead-letter files until they're under the size limit.
+// Other files in the directory are left alone, and don't count towards it.
+func (d *DeadLetterDir) prune() error {
+	entries, err := ioutil.ReadDir(d.path) // sorted by name, so oldest first
+	if err != nil {
+		return err
+	}
+	files := []os.FileInfo{}
+	var totalBytes int64
+	for _, file := range entries {
+		if strings.HasPrefix(file.Name(), `batch-`) {
+			files = append(files, file)
+			totalBytes = totalBytes + file.Size()
+		}
+	}
+	for _, file := range files {
+		if totalBytes <= d.maxBytes {
+			break
+		}
+		log.Println("cloudwatch: WARNING: deleting dead-letter file",
+			file.Name())
+		// another uploader may have just deleted the same file
+		err = os.Remove(filepath.Join(d.path, file.Name()))
+		if (err != nil) && !os.IsNotExist(err) {
+			return err
+		}
+		totalBytes = totalBytes - file.Size()
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamStatus is the upload state of one log stream.
+type streamStatus struct {
+	token     string // "" if no sequence token is cached
+	lastError error
+	errorTime time.Time
+}
+
+// statusTracker records the state of every log stream in this process,
+// for the debug endpoint.
+type statusTracker struct {
+	sync.Mutex
+	streams map[streamID]*streamStatus
+}
+
+var statuses = &statusTracker{streams: map[streamID]*streamStatus{}}
+
+// returns the stream's status, creating it if needed - the lock must be held
+func (t *statusTracker) status(id streamID) *streamStatus {
+	status, exists := t.streams[id]
+	if !exists {
+		status = &streamStatus{}
+		t.streams[id] = status
+	}
+	return status
+}
+
+// Records the stream's cached sequence token, or that it has none.
+func (t *statusTracker) Token(id streamID, token *string) {
+	t.Lock()
+	defer t.Unlock()
+	if token == nil {
+		t.status(id).token = ""
+	} else {
+		t.status(id).token = *token
+	}
+}
+
+// Records that a batch for the stream failed to upload.
+func (t *statusTracker) Failed(id streamID, err error) {
+	t.Lock()
+	defer t.Unlock()
+	status := t.status(id)
+	status.lastError = err
+	status.errorTime = time.Now()
+}
+
+// returns a copy of the stream's status
+func (t *statusTracker) Get(id streamID) streamStatus {
+	t.Lock()
+	defer t.Unlock()
+	if status, exists := t.streams[id]; exists {
+		return *status
+	}
+	return streamStatus{}
+}
+
+// streamDebugInfo is the JSON that the debug endpoint returns for a stream.
+type streamDebugInfo struct {
+	Group           string     `json:"group"`
+	Stream          string     `json:"stream"`
+	SequenceToken   string     `json:"sequence_token,omitempty"`
+	LastFlush       time.Time  `json:"last_flush"`
+	BufferedBatches int        `json:"buffered_batches"`
+	BufferedEvents  int        `json:"buffered_events"`
+	LastError       string     `json:"last_error,omitempty"`
+	LastErrorTime   *time.Time `json:"last_error_time,omitempty"`
+}
+
+var debugServer sync.Once // only one debug server runs per process
+
+// Serves the state of each log stream as JSON at /debug/streams on the
+// given address, if it's not already being served.
+func serveDebug(addr string) {
+	debugServer.Do(func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/streams", writeDebug)
+		go func() {
+			log.Println("cloudwatch: serving stream state on", addr)
+			err := http.ListenAndServe(addr, mux)
+			log.Println("cloudwatch: ERROR serving stream state:", err)
+		}()
+	})
+}
+
+func writeDebug(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	streams := []streamDebugInfo{}
+	for _, value := range lags.Values() {
+		status := statuses.Get(value.id)
+		info := streamDebugInfo{
+			Group:           value.id.group,
+			Stream:          value.id.stream,
+			SequenceToken:   status.token,
+			LastFlush:       now.Add(-value.sinceFlush).UTC(),
+			BufferedBatches: value.bufferedCount,
+			BufferedEvents:  value.bufferedEvents,
+		}
+		if status.lastError != nil {
+			errorTime := status.errorTime.UTC()
+			info.LastError = status.lastError.Error()
+			info.LastErrorTime = &errorTime
+		}
+		streams = append(streams, info)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(streams); err != nil {
+		log.Println("cloudwatch: ERROR writing stream state:", err)
+	}
+}
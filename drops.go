@@ -0,0 +1,140 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// the reasons that messages are dropped, in the order they're logged
+const (
+	DROP_EMPTY           = `empty`           // blank, or empty after stripping
+	DROP_FILTERED        = `filtered`        // the container is not shipped
+	DROP_DENYLISTED      = `denylisted`      // in CLOUDWATCH_GROUP_DENYLIST
+	DROP_MATCHED         = `matched`         // by CLOUDWATCH_DROP_PATTERN
+	DROP_RATE_LIMITED    = `rate-limited`    // over CLOUDWATCH_MAX_EVENTS_PER_SEC
+	DROP_EVICTED         = `evicted`         // over CLOUDWATCH_STREAM_BUFFER_LIMIT
+	DROP_DELIVERY_FAILED = `delivery-failed` // the batch failed to upload
+	DROP_REJECTED        = `rejected`        // too old or new for Cloudwatch
+)
+
+var DROP_REASONS = []string{
+	DROP_EMPTY, DROP_FILTERED, DROP_DENYLISTED, DROP_MATCHED,
+	DROP_RATE_LIMITED, DROP_EVICTED, DROP_DELIVERY_FAILED, DROP_REJECTED}
+
+// dropCounter counts the messages dropped by all the adapters in this
+// process, by reason, since the last rollup was logged, and in total.
+type dropCounter struct {
+	sync.Mutex
+	counts map[string]int64
+	totals map[string]int64 // never reset, for the metrics
+}
+
+var drops = &dropCounter{counts: map[string]int64{},
+	totals: map[string]int64{}}
+
+var dropLogger sync.Once // only one rollup is logged per process
+
+func (d *dropCounter) Add(reason string, n int) {
+	d.Lock()
+	defer d.Unlock()
+	d.counts[reason] = d.counts[reason] + int64(n)
+	d.totals[reason] = d.totals[reason] + int64(n)
+}
+
+// returns the total for the given reason
+func (d *dropCounter) Total(reason string) int64 {
+	d.Lock()
+	defer d.Unlock()
+	return d.totals[reason]
+}
+
+// returns the counts since the last call, and resets them
+func (d *dropCounter) Reset() map[string]int64 {
+	d.Lock()
+	defer d.Unlock()
+	counts := d.counts
+	d.counts = map[string]int64{}
+	return counts
+}
+
+// Logs the number of messages dropped for each reason once per interval,
+// if any were, unless the rollup is already being logged.
+func logDrops(interval time.Duration) {
+	dropLogger.Do(func() {
+		go func() {
+			for range time.Tick(interval) {
+				if rollup := dropRollup(drops.Reset()); rollup != "" {
+					log.Printf("cloudwatch: WARNING: dropped %s in the last %s\n",
+						rollup, interval)
+				}
+			}
+		}()
+	})
+}
+
+// writes the total dropped for each reason, as a Prometheus counter
+func writeDropMetrics(w http.ResponseWriter) {
+	fmt.Fprintln(w, "# HELP cloudwatch_events_dropped_total "+
+		"Log messages dropped, by reason.")
+	fmt.Fprintln(w, "# TYPE cloudwatch_events_dropped_total counter")
+	for _, reason := range DROP_REASONS {
+		fmt.Fprintf(w, "cloudwatch_events_dropped_total{reason=\"%s\"} %d\n",
+			reason, drops.Total(reason))
+	}
+}
+
+// returns the patterns listed in CLOUDWATCH_DROP_PATTERN, separated by ";".
+// Patterns that can't be parsed are left out, with a warning.
+func getDropPatterns(route *router.Route) []*regexp.Regexp {
+	list, isSet := getOption(route, `CLOUDWATCH_DROP_PATTERN`)
+	if !isSet {
+		return nil
+	}
+	patterns := []*regexp.Regexp{}
+	for _, text := range strings.Split(list, `;`) {
+		if text == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(text)
+		if err != nil {
+			log.Printf("cloudwatch: WARNING: ERROR parsing drop pattern %s, "+
+				"ignoring it: %s\n", text, err)
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// returns true if the text matches any of the patterns
+func matchesAny(patterns []*regexp.Regexp, text string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the counts as text, as in "3 messages (1 empty, 2 filtered)",
+// or "" if they're all zero
+func dropRollup(counts map[string]int64) string {
+	total, reasons := int64(0), []string{}
+	for _, reason := range DROP_REASONS {
+		if count := counts[reason]; count > 0 {
+			total = total + count
+			reasons = append(reasons, fmt.Sprintf("%d %s", count, reason))
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d messages (%s)", total, strings.Join(reasons, `, `))
+}
@@ -3,13 +3,20 @@ package cloudwatch
 import (
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/gliderlabs/logspout/router"
 )
 
+// the time allowed for each EC2 Metadata request, including fetching the
+// IMDSv2 token
+const DEFAULT_IMDS_TIMEOUT = 1 * time.Second
+
 type EC2Info struct {
 	InstanceID string
 	Region     string
@@ -21,8 +28,11 @@ func NewEC2Info(route *router.Route) (EC2Info, error) {
 		return EC2Info{}, nil
 	}
 	// get my instance ID
-	mySession := session.New()
-	metadataSvc := ec2metadata.New(mySession)
+	mySession := session.New(ec2MetadataConfig(route))
+	metadataSvc := ec2metadata.New(mySession, &aws.Config{
+		HTTPClient: &http.Client{Timeout: getDurationOption(route,
+			`CLOUDWATCH_IMDS_TIMEOUT`, DEFAULT_IMDS_TIMEOUT)},
+	})
 	if !metadataSvc.Available() {
 		log.Println("cloudwatch: WARNING EC2 Metadata service not available")
 		return EC2Info{}, nil
@@ -40,3 +50,12 @@ func NewEC2Info(route *router.Route) (EC2Info, error) {
 		Region:     region,
 	}, nil
 }
+
+// Returns the EC2 Metadata settings for each AWS session. The SDK makes
+// token-based (IMDSv2) metadata requests, for the region and the IAM Role
+// credentials. If a token can't be fetched, it falls back to IMDSv1, unless
+// CLOUDWATCH_IMDS_V1_FALLBACK is false, so that only IMDSv2 is used.
+func ec2MetadataConfig(route *router.Route) *aws.Config {
+	fallback := getBoolOption(route, `CLOUDWATCH_IMDS_V1_FALLBACK`, true)
+	return &aws.Config{EC2MetadataEnableFallback: aws.Bool(fallback)}
+}
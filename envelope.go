@@ -0,0 +1,217 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// the fields of each JSON envelope, unless CLOUDWATCH_ENVELOPE_FIELDS is set
+const DEFAULT_ENVELOPE_FIELDS = `message,container,host,labels,time`
+
+// the fields that an envelope may hold
+var ENVELOPE_FIELDS = map[string]bool{"message": true, "time": true,
+	"source": true, "container": true, "id": true, "image": true,
+	"host": true, "labels": true, "env": true, "level": true}
+
+// the fields that are always in envelopes if CLOUDWATCH_INSIGHTS_JSON is set
+var INSIGHTS_FIELDS = []string{"message", "time", "container", "level"}
+
+// the keys of envelope fields that are renamed for Logs Insights queries
+var INSIGHTS_KEYS = map[string]string{"message": "@message",
+	"time": "@timestamp"}
+
+// envelopeSource is everything an envelope field may be read from.
+type envelopeSource struct {
+	text    string
+	time    time.Time
+	source  string
+	level   string // from CLOUDWATCH_LEVEL_PATTERN, or "" if it's not found
+	context *RenderContext
+	nested  bool // if set, JSON object text is nested, rather than a string
+}
+
+// returns the value of one of the ENVELOPE_FIELDS
+func (s *envelopeSource) value(field string) interface{} {
+	switch field {
+	case "message":
+		if s.nested && isJSONObject(s.text) {
+			return json.RawMessage(s.text)
+		}
+		return s.text
+	case "time":
+		return s.time
+	case "source":
+		return s.source
+	case "container":
+		return s.context.Name
+	case "id":
+		return s.context.ID
+	case "image":
+		return s.context.Image
+	case "host":
+		return s.context.LoggerHost
+	case "labels":
+		return s.context.Labels
+	case "env":
+		return s.context.Env
+	case "level":
+		return s.level
+	}
+	return nil
+}
+
+// returns true if the text is a valid JSON object
+func isJSONObject(text string) bool {
+	return strings.HasPrefix(strings.TrimSpace(text), `{`) &&
+		json.Valid([]byte(text))
+}
+
+// returns the envelope fields to include if CLOUDWATCH_JSON_ENVELOPE or
+// CLOUDWATCH_INSIGHTS_JSON is set, or nil if neither is. Unknown field names
+// are left out, with a warning, and the INSIGHTS_FIELDS are added if needed.
+func getEnvelopeFields(route *router.Route) []string {
+	insights := getBoolOption(route, `CLOUDWATCH_INSIGHTS_JSON`, false)
+	if !insights && !getBoolOption(route, `CLOUDWATCH_JSON_ENVELOPE`, false) {
+		return nil
+	}
+	fieldList := DEFAULT_ENVELOPE_FIELDS
+	if list, isSet := getOption(route, `CLOUDWATCH_ENVELOPE_FIELDS`); isSet {
+		fieldList = list
+	}
+	fields := []string{}
+	for _, field := range strings.Split(fieldList, `,`) {
+		field = strings.TrimSpace(field)
+		if !ENVELOPE_FIELDS[field] {
+			log.Printf("cloudwatch: WARNING: unknown envelope field %s, "+
+				"ignoring it\n", field)
+			continue
+		}
+		fields = append(fields, field)
+	}
+	if insights {
+		for _, field := range INSIGHTS_FIELDS {
+			if !containsString(fields, field) {
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields
+}
+
+// returns true if the list contains the value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// labelField is a container label that is added to each of its messages.
+type labelField struct {
+	key   string
+	value string
+}
+
+// returns the label keys listed in CLOUDWATCH_LABEL_FIELDS, if it's set
+func getLabelFields(route *router.Route) []string {
+	list, isSet := getOption(route, `CLOUDWATCH_LABEL_FIELDS`)
+	if !isSet {
+		return nil
+	}
+	keys := []string{}
+	for _, key := range strings.Split(list, `,`) {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// returns the container's labels with the given keys, in the same order,
+// leaving out any that it doesn't have
+func selectLabels(labels map[string]string, keys []string) []labelField {
+	fields := []labelField{}
+	for _, key := range keys {
+		if value, exists := labels[key]; exists {
+			fields = append(fields, labelField{key: key, value: value})
+		}
+	}
+	return fields
+}
+
+// returns the container's env vars whose names start with the prefix, with
+// the prefix removed, sorted by name - or nil if the prefix is ""
+func selectEnv(env map[string]string, prefix string) []labelField {
+	if prefix == "" {
+		return nil
+	}
+	fields := []labelField{}
+	for name, value := range env {
+		key := strings.TrimPrefix(name, prefix)
+		if (key == name) || (key == "") {
+			continue
+		}
+		fields = append(fields, labelField{key: key, value: value})
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].key < fields[j].key
+	})
+	return fields
+}
+
+// returns the text that adds the label fields to a message, as in
+// "[git.sha=0a1b2c deploy.version=1.2] ", or "" if there are none
+func labelPrefix(fields []labelField) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	pairs := []string{}
+	for _, field := range fields {
+		pairs = append(pairs, field.key+`=`+field.value)
+	}
+	return `[` + strings.Join(pairs, ` `) + `] `
+}
+
+// Wraps the message text in a JSON object holding the envelope fields,
+// then the container's label fields and env fields, unless they'd replace
+// a field that's already set.
+// If the object can't be encoded, the text is returned as-is.
+func (a *CloudwatchAdapter) envelope(text string, msgTime time.Time,
+	m *router.Message, info *containerInfo) string {
+	source := &envelopeSource{
+		text:    text,
+		time:    msgTime.In(a.timezone),
+		source:  m.Source,
+		level:   a.messageLevel(m.Data),
+		context: info.context,
+		nested:  a.nestedJSON,
+	}
+	object := map[string]interface{}{}
+	for _, field := range a.envelopeFields {
+		key := field
+		if renamed, exists := INSIGHTS_KEYS[field]; exists && a.insightsJSON {
+			key = renamed
+		}
+		object[key] = source.value(field)
+	}
+	for _, fields := range [][]labelField{info.labelFields, info.envFields} {
+		for _, field := range fields {
+			if _, exists := object[field.key]; !exists {
+				object[field.key] = field.value
+			}
+		}
+	}
+	encoded, err := json.Marshal(object)
+	if err != nil {
+		log.Println("cloudwatch: ERROR encoding JSON envelope:", err)
+		return text
+	}
+	return string(encoded)
+}
@@ -0,0 +1,44 @@
+package cloudwatch
+
+import "errors"
+
+// UploadError describes a batch of messages that could not be uploaded.
+type UploadError struct {
+	Group   string
+	Stream  string
+	Region  string // "" for the default region
+	Err     error
+	Dropped int // the number of messages in the batch
+}
+
+// UploadErrors, if set, receives an UploadError for each batch that fails
+// to upload, so a program that embeds the adapter can react to failures.
+// The errors are still logged. If the channel is full, they're not sent.
+var UploadErrors chan<- UploadError
+
+// the error for batches dropped by CLOUDWATCH_INFLIGHT_POLICY=drop
+var errUploaderFull = errors.New("uploader is full")
+
+// the error for the events in an uploaded batch that Cloudwatch rejected
+var errRejected = errors.New("events rejected as too old or too new")
+
+// counts the messages in a batch that failed to upload as dropped, records
+// the error for its stream, and sends it to UploadErrors, if it's set
+func reportError(batch CloudwatchBatch, err error) {
+	drops.Add(DROP_DELIVERY_FAILED, len(batch.Msgs))
+	msg := batch.Msgs[0]
+	statuses.Failed(streamID{group: msg.Group, stream: msg.Stream}, err)
+	if UploadErrors == nil {
+		return
+	}
+	select {
+	case UploadErrors <- UploadError{
+		Group:   msg.Group,
+		Stream:  msg.Stream,
+		Region:  msg.Region,
+		Err:     err,
+		Dropped: len(batch.Msgs),
+	}:
+	default:
+	}
+}
@@ -0,0 +1,83 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// the health endpoint fails once uploads have failed, and no PutLogEvents
+// has succeeded, for this long
+const DEFAULT_HEALTH_WINDOW = 5 * time.Minute
+
+// uploadHealth records the outcome of the latest uploads made by all the
+// uploaders in this process - an upload also fails if its log group or
+// stream can't be checked, as with bad credentials.
+type uploadHealth struct {
+	sync.Mutex
+	lastSuccess time.Time // zero until an upload succeeds
+	lastFailure time.Time // zero until an upload fails
+	lastError   error     // nil if the latest request succeeded
+}
+
+var health = &uploadHealth{}
+
+func (h *uploadHealth) Success() {
+	h.Lock()
+	defer h.Unlock()
+	h.lastSuccess = time.Now()
+	h.lastError = nil
+}
+
+func (h *uploadHealth) Failure(err error) {
+	h.Lock()
+	defer h.Unlock()
+	h.lastFailure = time.Now()
+	h.lastError = err
+}
+
+// returns true if an upload has succeeded within the given window - and the
+// latest error, if any. An idle adapter, with no upload failing within the
+// window (as before any logs arrive), is also healthy.
+func (h *uploadHealth) Healthy(window time.Duration) (bool, error) {
+	h.Lock()
+	defer h.Unlock()
+	uploading := time.Since(h.lastSuccess) <= window
+	idle := time.Since(h.lastFailure) > window
+	return uploading || idle, h.lastError
+}
+
+var healthServer sync.Once // only one health server runs per process
+
+// Serves the upload health at /health on the given address, if it's not
+// already being served. It responds with 200 if healthy, or else 503.
+func serveHealth(addr string, window time.Duration) {
+	healthServer.Do(func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+			writeHealth(w, window)
+		})
+		go func() {
+			log.Println("cloudwatch: serving health checks on", addr)
+			err := http.ListenAndServe(addr, mux)
+			log.Println("cloudwatch: ERROR serving health checks:", err)
+		}()
+	})
+}
+
+func writeHealth(w http.ResponseWriter, window time.Duration) {
+	w.Header().Set("Content-Type", "text/plain")
+	healthy, err := health.Healthy(window)
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "ERROR: no logs uploaded for %v: %s\n", window, err)
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(w, "OK, but the last upload failed:", err)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
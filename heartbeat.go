@@ -0,0 +1,57 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// the stream that heartbeats are sent to, in the logger host's log group
+const DEFAULT_HEARTBEAT_STREAM = `heartbeat`
+
+// heartbeat is the JSON event sent every CLOUDWATCH_HEARTBEAT_INTERVAL.
+type heartbeat struct {
+	Type       string `json:"type"` // always "heartbeat"
+	Time       string `json:"time"`
+	Host       string `json:"host"`
+	InstanceID string `json:"instance_id,omitempty"`
+	Containers int    `json:"containers"` // the containers with cached info
+}
+
+// starts the heartbeat ticker, if CLOUDWATCH_HEARTBEAT_INTERVAL is set
+func (a *CloudwatchAdapter) setHeartbeat(route *router.Route) {
+	interval := getDurationOption(route, `CLOUDWATCH_HEARTBEAT_INTERVAL`, 0)
+	if interval <= 0 {
+		return // a.heartbeats stays nil, so the Stream loop never reads it
+	}
+	a.heartbeatStream = DEFAULT_HEARTBEAT_STREAM
+	if stream, isSet := getOption(route,
+		`CLOUDWATCH_HEARTBEAT_STREAM`); isSet {
+		a.heartbeatStream = stream
+	}
+	a.heartbeats = time.NewTicker(interval).C
+}
+
+// sends a heartbeat event to the heartbeat stream, in the logger host's
+// log group, so it's uploaded even when no container is logging
+func (a *CloudwatchAdapter) sendHeartbeat(now time.Time) {
+	text, err := json.Marshal(heartbeat{
+		Type:       `heartbeat`,
+		Time:       now.UTC().Format(time.RFC3339),
+		Host:       a.OsHost,
+		InstanceID: a.Ec2Instance,
+		Containers: len(a.containers),
+	})
+	if err != nil {
+		log.Println("cloudwatch: ERROR encoding heartbeat:", err)
+		return
+	}
+	a.batcher.Input <- CloudwatchMessage{
+		Message: string(text),
+		Group:   a.sanitizeGroup(a.OsHost),
+		Stream:  a.sanitizeStream(a.heartbeatStream),
+		Time:    now,
+	}
+}
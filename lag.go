@@ -0,0 +1,143 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streams that have nothing buffered are forgotten after this long
+const LAG_EXPIRY = time.Hour
+
+// streamLag tracks how far behind a log stream's uploads are.
+type streamLag struct {
+	buffered  []time.Time // when each unfinished batch got its first message
+	events    int         // the messages in the unfinished batches
+	lastFlush time.Time   // when a batch was last uploaded
+}
+
+// lagTracker tracks the lag of every log stream in this process. Each
+// batch is started by the batcher, and finished by the uploader (or by
+// the batcher, if it's dropped), in the same order for each stream.
+type lagTracker struct {
+	sync.Mutex
+	streams map[streamID]*streamLag
+}
+
+var lags = &lagTracker{streams: map[streamID]*streamLag{}}
+
+// Records that a new batch has started buffering messages for the stream.
+func (t *lagTracker) Started(id streamID) {
+	t.Lock()
+	defer t.Unlock()
+	lag, exists := t.streams[id]
+	if !exists {
+		lag = &streamLag{lastFlush: time.Now()}
+		t.streams[id] = lag
+	}
+	lag.buffered = append(lag.buffered, time.Now())
+}
+
+// Records that a message was added to the stream's newest batch.
+func (t *lagTracker) Added(id streamID) {
+	t.Lock()
+	defer t.Unlock()
+	if lag, exists := t.streams[id]; exists {
+		lag.events = lag.events + 1
+	}
+}
+
+// Records that the stream's oldest batch, holding the given number of
+// messages, is done - uploaded, if flushed.
+func (t *lagTracker) Finished(id streamID, events int, flushed bool) {
+	t.Lock()
+	defer t.Unlock()
+	lag, exists := t.streams[id]
+	if !exists || (len(lag.buffered) == 0) {
+		return
+	}
+	lag.buffered = lag.buffered[1:]
+	lag.events = lag.events - events
+	if flushed {
+		lag.lastFlush = time.Now()
+	}
+}
+
+// Records that messages were dropped from the stream's unfinished batches,
+// without finishing any of them.
+func (t *lagTracker) Evicted(id streamID, events int) {
+	t.Lock()
+	defer t.Unlock()
+	if lag, exists := t.streams[id]; exists {
+		lag.events = lag.events - events
+	}
+}
+
+// streamLagValues are the lag of one stream, at a point in time.
+type streamLagValues struct {
+	id             streamID
+	oldestAge      time.Duration // zero if nothing is buffered
+	sinceFlush     time.Duration
+	bufferedCount  int // batches
+	bufferedEvents int
+}
+
+// Returns the lag of every stream, sorted by group and stream name, and
+// forgets the streams with nothing buffered for LAG_EXPIRY.
+func (t *lagTracker) Values() []streamLagValues {
+	t.Lock()
+	defer t.Unlock()
+	values := []streamLagValues{}
+	for id, lag := range t.streams {
+		if (len(lag.buffered) == 0) && (time.Since(lag.lastFlush) > LAG_EXPIRY) {
+			delete(t.streams, id)
+			continue
+		}
+		value := streamLagValues{
+			id:             id,
+			sinceFlush:     time.Since(lag.lastFlush),
+			bufferedCount:  len(lag.buffered),
+			bufferedEvents: lag.events,
+		}
+		if len(lag.buffered) > 0 {
+			value.oldestAge = time.Since(lag.buffered[0])
+		}
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].id.group != values[j].id.group {
+			return values[i].id.group < values[j].id.group
+		}
+		return values[i].id.stream < values[j].id.stream
+	})
+	return values
+}
+
+// escapes a Prometheus label value
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeLagMetrics(w http.ResponseWriter) {
+	values := lags.Values()
+	fmt.Fprintln(w, "# HELP cloudwatch_stream_oldest_buffered_seconds "+
+		"Age of the oldest message not yet uploaded, per stream.")
+	fmt.Fprintln(w, "# TYPE cloudwatch_stream_oldest_buffered_seconds gauge")
+	for _, value := range values {
+		fmt.Fprintf(w, "cloudwatch_stream_oldest_buffered_seconds%s %f\n",
+			lagLabels(value.id), value.oldestAge.Seconds())
+	}
+	fmt.Fprintln(w, "# HELP cloudwatch_stream_since_last_flush_seconds "+
+		"Time since a batch was last uploaded, per stream.")
+	fmt.Fprintln(w, "# TYPE cloudwatch_stream_since_last_flush_seconds gauge")
+	for _, value := range values {
+		fmt.Fprintf(w, "cloudwatch_stream_since_last_flush_seconds%s %f\n",
+			lagLabels(value.id), value.sinceFlush.Seconds())
+	}
+}
+
+func lagLabels(id streamID) string {
+	return fmt.Sprintf(`{group="%s",stream="%s"}`,
+		labelEscaper.Replace(id.group), labelEscaper.Replace(id.stream))
+}
@@ -0,0 +1,70 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// counter is a single metric, which is only ever incremented.
+type counter struct {
+	value int64 // first, to keep it 64-bit aligned for the atomic functions
+	name  string
+	help  string
+}
+
+func (c *counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+func (c *counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+// Counters for the events handled by all the adapters in this process
+var (
+	eventsReceived = &counter{name: "cloudwatch_events_received_total",
+		help: "Log messages received from logspout."}
+	eventsShipped = &counter{name: "cloudwatch_events_shipped_total",
+		help: "Log events accepted by Cloudwatch Logs."}
+	batchesSent = &counter{name: "cloudwatch_batches_sent_total",
+		help: "Batches accepted by Cloudwatch Logs."}
+	putErrors = &counter{name: "cloudwatch_put_errors_total",
+		help: "Failed PutLogEvents requests, including retries."}
+	bytesShipped = &counter{name: "cloudwatch_bytes_shipped_total",
+		help: "Bytes of log events accepted by Cloudwatch Logs."}
+	eventsRejected = &counter{name: "cloudwatch_events_rejected_total",
+		help: "Log events rejected by Cloudwatch Logs as too old or new."}
+)
+
+var counters = []*counter{eventsReceived, eventsShipped, batchesSent,
+	putErrors, bytesShipped, eventsRejected}
+
+var metricsServer sync.Once // only one metrics server runs per process
+
+// Serves the counters in the Prometheus text format on the given address,
+// if it's not already being served.
+func serveMetrics(addr string) {
+	metricsServer.Do(func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", writeMetrics)
+		go func() {
+			log.Println("cloudwatch: serving metrics on", addr)
+			err := http.ListenAndServe(addr, mux)
+			log.Println("cloudwatch: ERROR serving metrics:", err)
+		}()
+	})
+}
+
+func writeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+		fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+		fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+	}
+	writeDropMetrics(w)
+	writeLagMetrics(w)
+}
@@ -0,0 +1,84 @@
+package cloudwatch
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// the pattern of logspout's multiline adapter, if only MULTILINE_MATCH is set
+const DEFAULT_LOGSPOUT_MULTILINE_PATTERN = `^\s`
+
+// how each MULTILINE_MATCH value uses the multiline pattern, as in logspout's
+// multiline adapter - "first" is the meaning of CLOUDWATCH_MULTILINE_PATTERN
+var MULTILINE_MATCHES = map[string]bool{"first": true, "nonfirst": true,
+	"last": true, "nonlast": true}
+
+// Sets the batcher's multiline pattern, match and timeout from the
+// CLOUDWATCH_MULTILINE_* options, or else from the MULTILINE_* route options
+// of logspout's multiline adapter, so that both can be configured the same.
+func (b *CloudwatchBatcher) setMultiline(route *router.Route) {
+	pattern, isSet := getOption(route, `CLOUDWATCH_MULTILINE_PATTERN`)
+	b.multilineMatch = `first`
+	if !isSet {
+		pattern, isSet = route.Options[`MULTILINE_PATTERN`]
+		match, matchSet := route.Options[`MULTILINE_MATCH`]
+		if !isSet && !matchSet {
+			return
+		}
+		if !isSet {
+			pattern = DEFAULT_LOGSPOUT_MULTILINE_PATTERN
+		}
+		b.multilineMatch = `nonfirst`
+		if matchSet && MULTILINE_MATCHES[match] {
+			b.multilineMatch = match
+		} else if matchSet {
+			log.Printf("cloudwatch: WARNING: ERROR parsing MULTILINE_MATCH "+
+				"%s, using nonfirst\n", match)
+		}
+		b.multilineShared = true
+	}
+	multiline, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Printf("cloudwatch: WARNING: ERROR parsing multiline pattern "+
+			"%s, ignoring it: %s\n", pattern, err)
+		return
+	}
+	b.multiline = multiline
+	b.multilineTimeout = DEFAULT_MULTILINE_TIMEOUT
+	if millis, isSet := route.Options[`MULTILINE_FLUSH_AFTER`]; isSet {
+		if value, err := strconv.Atoi(millis); err == nil {
+			b.multilineTimeout = time.Duration(value) * time.Millisecond
+		} else {
+			log.Printf("cloudwatch: WARNING: ERROR parsing "+
+				"MULTILINE_FLUSH_AFTER %s, ignoring it: %s\n", millis, err)
+		}
+	}
+	b.multilineTimeout = getDurationOption(route,
+		`CLOUDWATCH_MULTILINE_TIMEOUT`, b.multilineTimeout)
+}
+
+// returns true if the line starts a new multiline entry
+func (b *CloudwatchBatcher) startsEntry(line string) bool {
+	switch b.multilineMatch {
+	case `first`:
+		return b.multiline.MatchString(line)
+	case `nonfirst`:
+		return !b.multiline.MatchString(line)
+	}
+	return false // the entry is ended by its last line instead
+}
+
+// returns true if the line is the last line of its multiline entry
+func (b *CloudwatchBatcher) endsEntry(line string) bool {
+	switch b.multilineMatch {
+	case `last`:
+		return b.multiline.MatchString(line)
+	case `nonlast`:
+		return !b.multiline.MatchString(line)
+	}
+	return false
+}
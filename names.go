@@ -0,0 +1,59 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"regexp"
+	"unicode/utf8"
+)
+
+// replaces characters that are not allowed in group or stream names
+const DEFAULT_NAME_REPLACEMENT = `_`
+
+// the longest log group or log stream name that Cloudwatch allows
+const MAX_NAME_LENGTH = 512
+
+// characters that are not allowed in log group and log stream names
+var invalidGroupChars = regexp.MustCompile(`[^a-zA-Z0-9_/.#-]`)
+var invalidStreamChars = regexp.MustCompile(`[:*]`)
+
+// Returns the log group name with any invalid characters replaced.
+func (a *CloudwatchAdapter) sanitizeGroup(name string) string {
+	return a.sanitizeName(`group`, name, invalidGroupChars)
+}
+
+// Returns the log stream name with any invalid characters replaced.
+func (a *CloudwatchAdapter) sanitizeStream(name string) string {
+	return a.sanitizeName(`stream`, name, invalidStreamChars)
+}
+
+// Replaces the invalid characters in a name, and truncates it if it's too
+// long, warning once for each name.
+func (a *CloudwatchAdapter) sanitizeName(kind, name string,
+	invalidChars *regexp.Regexp) string {
+	validName := invalidChars.ReplaceAllLiteralString(name, a.nameReplacement)
+	validName = truncateName(validName)
+	if (validName != name) && !a.invalidNames[name] {
+		log.Printf("cloudwatch: WARNING: invalid log %s name %s, using %s\n",
+			kind, name, validName)
+		a.invalidNames[name] = true
+	}
+	return validName
+}
+
+// Truncates a name longer than MAX_NAME_LENGTH, ending it with a hash of
+// the whole name, so that names with the same beginning stay unique.
+func truncateName(name string) string {
+	if len(name) <= MAX_NAME_LENGTH {
+		return name
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	suffix := fmt.Sprintf("-%08x", hash.Sum32())
+	cut := MAX_NAME_LENGTH - len(suffix)
+	for (cut > 0) && !utf8.RuneStart(name[cut]) { // keep whole characters
+		cut--
+	}
+	return name[:cut] + suffix
+}
@@ -0,0 +1,134 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// Searches the route options, then the OS environment, for a given
+// configuration key. Route options take precedence, as in renderEnvValue.
+// Returns the value, and whether it was set at all.
+func getOption(route *router.Route, key string) (string, bool) {
+	if routeVal, exists := route.Options[key]; exists {
+		return routeVal, true
+	}
+	if envVal := os.Getenv(key); envVal != "" {
+		return envVal, true
+	}
+	return "", false
+}
+
+// Returns the integer value of the given option, or the default value
+// if the option is not set or cannot be parsed.
+func getIntOption(route *router.Route, key string, defaultVal int) int {
+	text, isSet := getOption(route, key)
+	if !isSet {
+		return defaultVal
+	}
+	val, err := strconv.Atoi(text)
+	if err != nil {
+		log.Printf("cloudwatch: WARNING: ERROR parsing %s %s, using default of %d\n",
+			key, text, defaultVal)
+		return defaultVal
+	}
+	return val
+}
+
+// Returns the value of the given option as a time.Duration (as in "250ms"),
+// or the default value if the option is not set or cannot be parsed.
+func getDurationOption(route *router.Route, key string,
+	defaultVal time.Duration) time.Duration {
+	text, isSet := getOption(route, key)
+	if !isSet {
+		return defaultVal
+	}
+	val, err := time.ParseDuration(text)
+	if err != nil {
+		log.Printf("cloudwatch: WARNING: ERROR parsing %s %s, using default of %v\n",
+			key, text, defaultVal)
+		return defaultVal
+	}
+	return val
+}
+
+// Returns the value of the given option as a bool (as in "true" or "0"),
+// or the default value if the option is not set or cannot be parsed.
+func getBoolOption(route *router.Route, key string, defaultVal bool) bool {
+	text, isSet := getOption(route, key)
+	if !isSet {
+		return defaultVal
+	}
+	val, err := strconv.ParseBool(text)
+	if err != nil {
+		log.Printf("cloudwatch: WARNING: ERROR parsing %s %s, using default of %t\n",
+			key, text, defaultVal)
+		return defaultVal
+	}
+	return val
+}
+
+// Returns true if debug logging is enabled by the DEBUG option (which is
+// set by its presence), or the CLOUDWATCH_DEBUG option (which must be true).
+func isDebugSet(route *router.Route) bool {
+	_, debugOption := getOption(route, `DEBUG`)
+	return debugOption || getBoolOption(route, `CLOUDWATCH_DEBUG`, false)
+}
+
+// Logs a formatted debug message.
+func debugLog(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	msg = fmt.Sprintf("cloudwatch: %s", msg)
+	if !strings.HasSuffix(msg, "\n") {
+		msg = fmt.Sprintf("%s\n", msg)
+	}
+	log.Print(msg)
+}
+
+// the sources of the group and stream names (and other settings read by
+// renderEnvValue), from lowest to highest precedence, unless
+// CLOUDWATCH_OPTION_PRECEDENCE is set
+const DEFAULT_OPTION_PRECEDENCE = `logspout,route,config,container,label`
+
+// the sources that CLOUDWATCH_OPTION_PRECEDENCE may list
+var OPTION_SOURCES = map[string]bool{"logspout": true, "route": true,
+	"config": true, "container": true, "label": true}
+
+// Returns the sources listed in CLOUDWATCH_OPTION_PRECEDENCE, from lowest to
+// highest precedence. Unknown and repeated sources are left out, with a
+// warning, and sources that aren't listed are not searched at all.
+func getOptionPrecedence(route *router.Route) []string {
+	list, isSet := getOption(route, `CLOUDWATCH_OPTION_PRECEDENCE`)
+	if !isSet {
+		list = DEFAULT_OPTION_PRECEDENCE
+	}
+	sources, seen := []string{}, map[string]bool{}
+	for _, source := range strings.Split(list, `,`) {
+		source = strings.TrimSpace(source)
+		if !OPTION_SOURCES[source] || seen[source] {
+			log.Printf("cloudwatch: WARNING: unknown or repeated option "+
+				"source %s, ignoring it\n", source)
+			continue
+		}
+		seen[source] = true
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// Returns where getOption finds the given key - "route options",
+// "logspout env", or "default" if it's not set.
+func optionSource(route *router.Route, key string) string {
+	if _, exists := route.Options[key]; exists {
+		return `route options`
+	}
+	if os.Getenv(key) != "" {
+		return `logspout env`
+	}
+	return `default`
+}
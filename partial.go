@@ -0,0 +1,71 @@
+package cloudwatch
+
+import (
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// Docker splits log lines longer than this many bytes into parts of this
+// size, followed by the rest of the line, and marks every part with the
+// time of the whole line. So a message of exactly this size is only joined
+// to the next message from the same container and source if both have the
+// same time.
+const DOCKER_PARTIAL_SIZE = 16 * 1024
+
+// how long to wait for the rest of a split line, before sending its parts
+// as they are - as when a line's length is an exact multiple of 16 KB
+const PARTIAL_TIMEOUT = time.Second
+
+// partialLine holds the parts of a split line, joined so far.
+type partialLine struct {
+	msg     *router.Message
+	updated time.Time // when the latest part was received
+}
+
+// sets up the merging of split lines, if CLOUDWATCH_MERGE_PARTIAL is set
+func (a *CloudwatchAdapter) setMergePartial(route *router.Route) {
+	if !getBoolOption(route, `CLOUDWATCH_MERGE_PARTIAL`, false) {
+		return // a.partialTicks stays nil, so the Stream loop never reads it
+	}
+	a.partials = map[string]*partialLine{}
+	a.partialTicks = time.NewTicker(PARTIAL_TIMEOUT).C
+}
+
+// Returns the message with any earlier parts of its line joined to its
+// start, with no separator - or nil if the message may itself be a part of
+// a longer line, which is held until the next message shows whether it is.
+// A held message whose next message has a different time was a whole line,
+// so it's sent on by itself.
+func (a *CloudwatchAdapter) mergePartialLine(
+	m *router.Message) *router.Message {
+	key := m.Container.ID + `/` + m.Source
+	// a message with no time can't be matched to its next part
+	split := (len(m.Data) == DOCKER_PARTIAL_SIZE) && !m.Time.IsZero()
+	if partial, exists := a.partials[key]; exists {
+		delete(a.partials, key)
+		if partial.msg.Time.Equal(m.Time) {
+			merged := *partial.msg // copy the message, which routes share
+			merged.Data = merged.Data + m.Data
+			m = &merged
+		} else {
+			a.handleLine(partial.msg)
+		}
+	}
+	if split {
+		a.partials[key] = &partialLine{msg: m, updated: time.Now()}
+		return nil
+	}
+	return m
+}
+
+// sends on the lines whose next part hasn't arrived within the timeout, or
+// all of them if the timeout is 0
+func (a *CloudwatchAdapter) flushPartials(timeout time.Duration) {
+	for key, partial := range a.partials {
+		if time.Since(partial.updated) >= timeout {
+			delete(a.partials, key)
+			a.handleLine(partial.msg)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package cloudwatch
+
+import (
+	"log"
+	"time"
+)
+
+// tokenBucket tracks the recent rate of events for a single log stream.
+type tokenBucket struct {
+	tokens  float64   // events that can be sent right now
+	updated time.Time // when tokens was last computed
+}
+
+// RateLimiter sheds the events for each log stream that exceed a maximum
+// rate, allowing bursts of up to one second's worth of events.
+type RateLimiter struct {
+	rate    float64 // events per second
+	buckets map[streamID]*tokenBucket
+	dropped map[streamID]int64 // events shed since the last summary
+}
+
+func NewRateLimiter(eventsPerSec int) *RateLimiter {
+	return &RateLimiter{
+		rate:    float64(eventsPerSec),
+		buckets: map[streamID]*tokenBucket{},
+		dropped: map[streamID]int64{},
+	}
+}
+
+// Returns true if the message's stream is below the maximum rate,
+// or else counts the message as dropped.
+func (r *RateLimiter) Allow(msg CloudwatchMessage) bool {
+	id := streamID{group: msg.Group, stream: msg.Stream}
+	now := time.Now()
+	bucket, exists := r.buckets[id]
+	if !exists {
+		bucket = &tokenBucket{tokens: r.rate, updated: now}
+		r.buckets[id] = bucket
+	}
+	bucket.tokens = bucket.tokens + (now.Sub(bucket.updated).Seconds() * r.rate)
+	if bucket.tokens > r.rate {
+		bucket.tokens = r.rate
+	}
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		r.dropped[id] = r.dropped[id] + 1
+		return false
+	}
+	bucket.tokens = bucket.tokens - 1
+	return true
+}
+
+// Logs the number of messages dropped from each stream since the last call.
+func (r *RateLimiter) LogDropped() {
+	for id, count := range r.dropped {
+		log.Printf("cloudwatch: WARNING: dropped %d messages for %s-%s "+
+			"over the rate limit of %v per second\n",
+			count, id.group, id.stream, r.rate)
+		delete(r.dropped, id)
+	}
+}
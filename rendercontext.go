@@ -2,22 +2,72 @@ package cloudwatch
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"strings"
 	"text/template"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
 )
 
 type RenderContext struct {
-	Host       string            // container host name
-	Env        map[string]string // container ENV
-	Labels     map[string]string // container Labels
-	Name       string            // container Name
-	ID         string            // container ID
-	LoggerHost string            // hostname of logging container (os.Hostname)
-	InstanceID string            // EC2 Instance ID
-	Region     string            // EC2 region
+	Host     string            // container host name, or ShortID if none
+	Env      map[string]string // container ENV
+	Labels   map[string]string // container Labels
+	Name     string            // container Name
+	ID       string            // container ID
+	ShortID  string            // first 12 characters of the container ID
+	Image    string            // container image name, without the tag
+	ImageTag string            // container image tag
+	// the Docker Compose project and service, or "" if not run by Compose
+	ComposeProject string
+	ComposeService string
+	LoggerHost     string // hostname of logging container (see README)
+	InstanceID     string // EC2 Instance ID
+	Region         string // EC2 region
+	Source         string // message source, "stdout" or "stderr"
+	// the message's top-level JSON fields, if CLOUDWATCH_PARSE_JSON is set
+	JSON map[string]interface{}
+}
+
+// functions available to the group and stream name templates
+var templateFuncs = template.FuncMap{
+	"upper":     strings.ToUpper,
+	"lower":     strings.ToLower,
+	"trim":      strings.TrimSpace,
+	"replace":   replaceAll,
+	"default":   defaultString,
+	"groupname": groupName,
+	"date":      formatDate,
+}
+
+// TagContext is the render context of CLOUDWATCH_STREAM_TAG, which
+// provides the same values as the tag option of Docker's awslogs driver.
+type TagContext struct {
+	ID         string // first 12 characters of the container ID
+	FullID     string // container ID
+	Name       string // container Name
+	ImageName  string // container image name, with the tag
+	DaemonName string // always "docker"
+}
+
+// returns the TagContext for the container in the given context
+func newTagContext(context *RenderContext) *TagContext {
+	imageName := context.Image
+	if context.ImageTag != "" {
+		imageName = imageName + `:` + context.ImageTag
+	}
+	return &TagContext{
+		ID:         context.ShortID,
+		FullID:     context.ID,
+		Name:       context.Name,
+		ImageName:  imageName,
+		DaemonName: `docker`,
+	}
 }
 
 // renders a label value based on a given key
@@ -30,46 +80,240 @@ func (r *RenderContext) Lbl(key string) (string, error) {
 
 // HELPER FUNCTIONS
 
-// Searches the OS environment, then the route options, then the render context
-// Env for a given key, then uses the value (or the provided default value)
-// as template text, which is then rendered in the given context.
-// The rendered result is returned - or the default value on any errors.
+// Searches the OS environment, then the route options, then the config file
+// rules, then the render context Env for a given key, then the container
+// Label named by $envKey_LABEL (if set) - or the sources in the order set by
+// CLOUDWATCH_OPTION_PRECEDENCE - then uses the last value found (or the
+// provided default value) as template text, which is then rendered in the
+// given context. The rendered result is returned - or the default value on any
+// errors.
 func (a *CloudwatchAdapter) renderEnvValue(
 	envKey string, context *RenderContext, defaultVal string) string {
-	finalVal := defaultVal
-	if logspoutEnvVal := os.Getenv(envKey); logspoutEnvVal != "" {
-		finalVal = logspoutEnvVal // use $envKey, if set
+	finalVal, _ := a.lookupEnvValue(envKey, context, defaultVal)
+	renderedValue, err := renderTemplateWith(a.templates, finalVal, context)
+	if err != nil {
+		return defaultVal
 	}
-	if routeOptionsVal, exists := a.Route.Options[envKey]; exists {
-		finalVal = routeOptionsVal
+	return renderedValue
+}
+
+// Renders a value like renderEnvValue, except that if its template can't be
+// rendered, the fallback template is rendered instead, if it's set. The
+// fallback is not used when the value is simply unset.
+func (a *CloudwatchAdapter) renderEnvFallback(envKey string,
+	context *RenderContext, defaultVal, fallback string) string {
+	finalVal, _ := a.lookupEnvValue(envKey, context, defaultVal)
+	renderedValue, err := renderTemplateWith(a.templates, finalVal, context)
+	if err == nil {
+		return renderedValue
 	}
-	if containerEnvVal, exists := context.Env[envKey]; exists {
-		finalVal = containerEnvVal // or, $envKey from container!
+	if fallback == "" {
+		return defaultVal
 	}
-	template, err := template.New("template").Parse(finalVal)
+	log.Printf("cloudwatch: WARNING: ERROR rendering %s for container %s, "+
+		"using the fallback: %s\n", envKey, context.Name, err)
+	renderedValue, err = renderTemplateWith(a.templates, fallback, context)
 	if err != nil {
-		log.Println("cloudwatch: error parsing template", finalVal, ":", err)
 		return defaultVal
-	} else { // render the templates in the generated context
-		var renderedValue bytes.Buffer
-		err = template.Execute(&renderedValue, context)
+	}
+	return renderedValue
+}
+
+// Performs the search for renderEnvValue, returning the unrendered value,
+// and a description of where it was found.
+func (a *CloudwatchAdapter) lookupEnvValue(envKey string,
+	context *RenderContext, defaultVal string) (string, string) {
+	finalVal, source := defaultVal, `default`
+	for _, next := range a.precedence {
+		switch next {
+		case `logspout`:
+			if logspoutEnvVal := os.Getenv(envKey); logspoutEnvVal != "" {
+				finalVal = logspoutEnvVal // use $envKey, if set
+				source = `logspout env`
+			}
+		case `route`:
+			if routeOptionsVal, exists := a.Route.Options[envKey]; exists {
+				finalVal = routeOptionsVal
+				source = `route options`
+			}
+		case `config`:
+			if configVal, ruleSource, exists := a.configValue(envKey,
+				context.Name); exists {
+				finalVal, source = configVal, ruleSource
+			}
+		case `container`:
+			if containerEnvVal, exists := context.Env[envKey]; exists {
+				finalVal = containerEnvVal // or, $envKey from container!
+				source = `container env`
+			}
+		case `label`:
+			labelKey, isSet := getOption(a.Route, envKey+`_LABEL`)
+			if !isSet {
+				continue
+			}
+			if containerLabelVal, exists := context.Labels[labelKey]; exists {
+				finalVal = containerLabelVal // or, a container label, if named
+				source = `container label ` + labelKey
+			}
+		}
+	}
+	return finalVal, source
+}
+
+// Renders the given template text in the given context. Errors are logged.
+func renderTemplate(text string, context interface{}) (string, error) {
+	return renderTemplateWith(nil, text, context)
+}
+
+// Renders the given template text like renderTemplate, but if includes is
+// set, the text may also use the templates it defines, as in
+// {{template "groupname" .}}.
+func renderTemplateWith(includes *template.Template, text string,
+	context interface{}) (string, error) {
+	base := template.New("template").Funcs(templateFuncs)
+	if includes != nil {
+		clone, err := includes.Clone() // so the text can't change includes
 		if err != nil {
-			log.Printf("cloudwatch: error rendering template %s : %s\n",
-				finalVal, err)
-			return defaultVal
+			log.Println("cloudwatch: error copying included templates:", err)
+			return "", err
 		}
-		finalVal = renderedValue.String()
+		base = clone.New("template")
+	}
+	template, err := base.Parse(text)
+	if err != nil {
+		log.Println("cloudwatch: error parsing template", text, ":", err)
+		return "", err
+	}
+	// render the template in the generated context
+	var renderedValue bytes.Buffer
+	if err = template.Execute(&renderedValue, context); err != nil {
+		log.Printf("cloudwatch: error rendering template %s : %s\n", text, err)
+		return "", err
+	}
+	return renderedValue.String(), nil
+}
+
+// returns the templates defined in the file named by CLOUDWATCH_TEMPLATE_FILE,
+// as in {{define "groupname"}}...{{end}}, or nil if it's not set. If the file
+// can't be parsed, the error is logged, and it's ignored.
+func loadTemplates(route *router.Route) *template.Template {
+	filename, isSet := getOption(route, `CLOUDWATCH_TEMPLATE_FILE`)
+	if !isSet {
+		return nil
+	}
+	includes, err := template.New("includes").Funcs(templateFuncs).
+		ParseFiles(filename)
+	if err != nil {
+		log.Printf("cloudwatch: WARNING: ERROR reading "+
+			"CLOUDWATCH_TEMPLATE_FILE %s, ignoring it: %s\n", filename, err)
+		return nil
 	}
-	return finalVal
+	return includes
 }
 
+// replaces all instances of old with new in s - the argument order allows
+// pipelines in templates, as in {{.Name | replace "/" "-"}}
+func replaceAll(old, new, s string) string {
+	return strings.Replace(s, old, new, -1)
+}
+
+// returns value, or defaultVal if value is empty or missing,
+// as in {{.Env.APP | default "app"}}
+func defaultString(defaultVal string, value interface{}) string {
+	if (value == nil) || (fmt.Sprint(value) == "") {
+		return defaultVal
+	}
+	return fmt.Sprint(value)
+}
+
+// returns the container's hostname, or its short ID if it has none - Docker
+// uses the short ID as the default hostname
+func containerHost(container *docker.Container) string {
+	if container.Config.Hostname != "" {
+		return container.Config.Hostname
+	}
+	return shortID(container.ID)
+}
+
+// returns the value as a log group name - trimmed, in lower case, and with
+// invalid characters replaced - or the fallback, the same way, if the value
+// is empty or missing, as in {{groupname .Env.APP_NAME "default"}}
+func groupName(value interface{}, fallback string) string {
+	name := ""
+	if value != nil {
+		name = strings.ToLower(strings.TrimSpace(fmt.Sprint(value)))
+	}
+	if name == "" {
+		name = strings.ToLower(strings.TrimSpace(fallback))
+	}
+	return invalidGroupChars.ReplaceAllLiteralString(name,
+		DEFAULT_NAME_REPLACEMENT)
+}
+
+// returns the current UTC time in the given layout, as in
+// {{date "2006-01-02"}} - cached names are rendered again each NAMES_PERIOD,
+// so names that use it rotate
+func formatDate(layout string) string {
+	return time.Now().UTC().Format(layout)
+}
+
+// returns the short form of a container ID, as shown by `docker ps`
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// splits a Docker image reference into its name and tag, as in
+// "registry:5000/app:1.2" -> "registry:5000/app", "1.2"
+func parseImage(image string) (string, string) {
+	image = strings.SplitN(image, `@`, 2)[0] // drop any digest
+	slash, colon := strings.LastIndex(image, `/`), strings.LastIndex(image, `:`)
+	if colon <= slash { // no tag, or the colon is in the registry's port
+		return image, ""
+	}
+	return image[:colon], image[colon+1:]
+}
+
+// returns the top-level fields of a JSON object, or nil if the text isn't one
+func parseJSONObject(text string) map[string]interface{} {
+	if !strings.HasPrefix(strings.TrimSpace(text), `{`) {
+		return nil // not worth trying to parse
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &fields); err != nil {
+		return nil
+	}
+	return fields
+}
+
+// parses KEY=value lines from a container's Env - the value may contain more
+// "=" signs, and a line with no "=" is a KEY with an empty value
 func parseEnv(envLines []string) map[string]string {
 	env := map[string]string{}
 	for _, line := range envLines {
-		fields := strings.Split(line, `=`)
+		fields := strings.SplitN(line, `=`, 2)
+		if fields[0] == "" { // no key to look up
+			continue
+		}
 		if len(fields) > 1 {
-			env[fields[0]] = strings.Join(fields[1:], `=`)
+			env[fields[0]] = fields[1]
+		} else {
+			env[fields[0]] = ""
 		}
 	}
 	return env
 }
+
+// parses comma-separated key=value pairs, as in CLOUDWATCH_TAGS
+func parseTags(text string) map[string]string {
+	tags := map[string]string{}
+	for _, pair := range strings.Split(text, `,`) {
+		fields := strings.SplitN(pair, `=`, 2)
+		if key := strings.TrimSpace(fields[0]); (len(fields) > 1) && (key != "") {
+			tags[key] = strings.TrimSpace(fields[1])
+		}
+	}
+	return tags
+}
@@ -0,0 +1,140 @@
+package cloudwatch
+
+import (
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// streamRoute sends the messages whose text matches its pattern to the
+// stream named by its template, instead of the container's usual stream.
+type streamRoute struct {
+	pattern *regexp.Regexp
+	stream  string // template text
+}
+
+// Returns the routes listed in CLOUDWATCH_STREAM_ROUTES, in order, as in
+// "GET|POST=access;.=error" - each route's pattern ends at its last "=".
+// Routes that can't be parsed are left out, with a warning.
+func getStreamRoutes(route *router.Route) []streamRoute {
+	list, isSet := getOption(route, `CLOUDWATCH_STREAM_ROUTES`)
+	if !isSet {
+		return nil
+	}
+	routes := []streamRoute{}
+	for _, text := range strings.Split(list, `;`) {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		split := strings.LastIndex(text, `=`)
+		if split < 1 {
+			log.Printf("cloudwatch: WARNING: ERROR parsing stream route %s, "+
+				"ignoring it: no pattern=stream\n", text)
+			continue
+		}
+		pattern, err := regexp.Compile(text[:split])
+		if err != nil {
+			log.Printf("cloudwatch: WARNING: ERROR parsing stream route %s, "+
+				"ignoring it: %s\n", text, err)
+			continue
+		}
+		routes = append(routes,
+			streamRoute{pattern: pattern, stream: text[split+1:]})
+	}
+	return routes
+}
+
+// Renders the stream name of each of the stream routes, in the given
+// context. A stream that can't be rendered, or renders to "", is "", so its
+// messages are sent to the usual stream.
+func (a *CloudwatchAdapter) renderRoutes(context *RenderContext) []string {
+	if len(a.streamRoutes) == 0 {
+		return nil
+	}
+	streams := []string{}
+	for _, route := range a.streamRoutes {
+		stream, err := renderTemplateWith(a.templates, route.stream, context)
+		if (err != nil) || (strings.TrimSpace(stream) == "") {
+			stream = ""
+		} else {
+			stream = a.sanitizeStream(stream)
+		}
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+// Returns the stream of the first stream route whose pattern matches the
+// text, from the given rendered streams, or defaultStream if there is none.
+func (a *CloudwatchAdapter) routeStream(text string, streams []string,
+	defaultStream string) string {
+	for i, route := range a.streamRoutes {
+		if route.pattern.MatchString(text) {
+			if streams[i] != "" {
+				return streams[i]
+			}
+			return defaultStream
+		}
+	}
+	return defaultStream
+}
+
+// Sets the pattern of CLOUDWATCH_LEVEL_PATTERN, if it's set, and the stream
+// suffixes of CLOUDWATCH_LEVEL_STREAM_MAP, if that's set too. The map is a
+// comma-separated list of level=suffix pairs, as in "ERROR=-errors".
+func (a *CloudwatchAdapter) setLevelStreams(route *router.Route) {
+	pattern, isSet := getOption(route, `CLOUDWATCH_LEVEL_PATTERN`)
+	if !isSet {
+		return
+	}
+	levelPattern, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Printf("cloudwatch: WARNING: ERROR parsing "+
+			"CLOUDWATCH_LEVEL_PATTERN %s, ignoring it: %s\n", pattern, err)
+		return
+	}
+	a.levelPattern = levelPattern
+	mapText, mapSet := getOption(route, `CLOUDWATCH_LEVEL_STREAM_MAP`)
+	if !mapSet {
+		return // the levels are only used in JSON envelopes
+	}
+	suffixes := map[string]string{}
+	for _, pair := range strings.Split(mapText, `,`) {
+		fields := strings.SplitN(pair, `=`, 2)
+		level := strings.ToUpper(strings.TrimSpace(fields[0]))
+		if (len(fields) < 2) || (level == "") {
+			log.Printf("cloudwatch: WARNING: ERROR parsing "+
+				"CLOUDWATCH_LEVEL_STREAM_MAP entry %s, ignoring it\n", pair)
+			continue
+		}
+		suffixes[level] = invalidStreamChars.ReplaceAllLiteralString(
+			strings.TrimSpace(fields[1]), a.nameReplacement)
+	}
+	a.levelStreams = suffixes
+}
+
+// returns the message's level, in upper case, as found by the first capture
+// group of CLOUDWATCH_LEVEL_PATTERN, or "" if it's not set or doesn't match
+func (a *CloudwatchAdapter) messageLevel(text string) string {
+	if a.levelPattern == nil {
+		return ""
+	}
+	match := a.levelPattern.FindStringSubmatch(text)
+	if len(match) < 2 {
+		return ""
+	}
+	return strings.ToUpper(match[1])
+}
+
+// Returns the stream with the suffix for the message's level added, if
+// CLOUDWATCH_LEVEL_PATTERN finds a level in the text that has a suffix
+// in CLOUDWATCH_LEVEL_STREAM_MAP, or else the stream as it is.
+func (a *CloudwatchAdapter) levelStream(text, stream string) string {
+	suffix, exists := a.levelStreams[a.messageLevel(text)]
+	if !exists {
+		return stream
+	}
+	return truncateName(stream + suffix)
+}
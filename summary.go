@@ -0,0 +1,144 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// summaryField is one resolved setting in the startup summary.
+type summaryField struct {
+	name   string
+	value  interface{}
+	source string
+}
+
+// Logs the batcher's resolved settings, and where each came from, as a
+// single line. Secrets, such as a proxy password, are redacted.
+func (b *CloudwatchBatcher) logSummary() {
+	route := b.route
+	fields := []summaryField{
+		b.regionField(),
+		credentialsField(route),
+		optionField(route, `endpoint`, `CLOUDWATCH_ENDPOINT`, `AWS`),
+		b.intervalField(),
+		{`batch_size`, b.maxCount, optionSource(route, `CLOUDWATCH_BATCH_SIZE`)},
+		{`flush_jitter`, fmt.Sprintf("%d%%", b.jitter),
+			optionSource(route, `CLOUDWATCH_FLUSH_JITTER`)},
+		{`max_latency`, b.maxLatency,
+			optionSource(route, `CLOUDWATCH_MAX_LATENCY`)},
+		{`input_buffer`, cap(b.Input),
+			optionSource(route, `CLOUDWATCH_INPUT_BUFFER`)},
+		{`upload_workers`, b.workers,
+			optionSource(route, `CLOUDWATCH_UPLOAD_WORKERS`)},
+		{`max_inflight`, getIntOption(route, `CLOUDWATCH_MAX_INFLIGHT`,
+			DEFAULT_MAX_INFLIGHT), optionSource(route, `CLOUDWATCH_MAX_INFLIGHT`)},
+		b.policyField(),
+		{`retries`, getIntOption(route, `CLOUDWATCH_RETRIES`, DEFAULT_RETRIES),
+			optionSource(route, `CLOUDWATCH_RETRIES`)},
+		{`aws_max_retries`, awsMaxRetries(route),
+			optionSource(route, `CLOUDWATCH_AWS_MAX_RETRIES`)},
+		{`retry_base`, getDurationOption(route, `CLOUDWATCH_RETRY_BASE`,
+			DEFAULT_RETRY_BASE), optionSource(route, `CLOUDWATCH_RETRY_BASE`)},
+		{`client_timeout`, getDurationOption(route, `CLOUDWATCH_CLIENT_TIMEOUT`,
+			DEFAULT_CLIENT_TIMEOUT),
+			optionSource(route, `CLOUDWATCH_CLIENT_TIMEOUT`)},
+		proxyField(route),
+		{`dry_run`, getBoolOption(route, `CLOUDWATCH_DRY_RUN`, false),
+			optionSource(route, `CLOUDWATCH_DRY_RUN`)},
+		optionField(route, `wal_dir`, `CLOUDWATCH_WAL_DIR`, `none`),
+		optionField(route, `deadletter_dir`, `CLOUDWATCH_DEADLETTER_DIR`,
+			`none`),
+	}
+	parts := []string{}
+	for _, field := range fields {
+		parts = append(parts, fmt.Sprintf("%s=%v (%s)", field.name,
+			field.value, field.source))
+	}
+	log.Println("cloudwatch: configuration:", strings.Join(parts, `, `))
+}
+
+// returns the summary of a string option, or defaultVal if it's not set
+func optionField(route *router.Route, name, key,
+	defaultVal string) summaryField {
+	value, isSet := getOption(route, key)
+	if !isSet {
+		value = defaultVal
+	}
+	return summaryField{name, value, optionSource(route, key)}
+}
+
+// returns the summary of the default region, as found by defaultRegion
+func (b *CloudwatchBatcher) regionField() summaryField {
+	region, source := routeRegion(b.route)
+	field := summaryField{`region`, region, source}
+	if (field.value == "auto") || (field.value == "") {
+		field.value = b.adapter.Ec2Region
+		field.source = `EC2 metadata`
+	}
+	return field
+}
+
+// returns the summary of where the AWS credentials come from
+func credentialsField(route *router.Route) summaryField {
+	field := summaryField{`credentials`, `default chain`, `default`}
+	if profile, isSet := getOption(route, `CLOUDWATCH_PROFILE`); isSet {
+		field.value = `profile ` + profile
+		field.source = optionSource(route, `CLOUDWATCH_PROFILE`)
+	} else if profile := os.Getenv(`AWS_PROFILE`); profile != "" {
+		field.value = `profile ` + profile
+		field.source = `logspout env`
+	}
+	if roleARN, isSet := getOption(route, `CLOUDWATCH_ROLE_ARN`); isSet {
+		field.value = fmt.Sprintf("%s, assuming role %s", field.value, roleARN)
+		field.source = optionSource(route, `CLOUDWATCH_ROLE_ARN`)
+	}
+	return field
+}
+
+// returns the summary of the push interval, from CLOUDWATCH_BATCH_INTERVAL
+// or DELAY - for which the environment takes precedence
+func (b *CloudwatchBatcher) intervalField() summaryField {
+	field := summaryField{`interval`, b.interval, `default`}
+	if _, isSet := getOption(b.route, `CLOUDWATCH_BATCH_INTERVAL`); isSet {
+		field.source = optionSource(b.route, `CLOUDWATCH_BATCH_INTERVAL`)
+	} else if os.Getenv(`DELAY`) != "" {
+		field.source = `logspout env`
+	} else if _, isSet := b.route.Options[`DELAY`]; isSet {
+		field.source = `route options`
+	}
+	return field
+}
+
+// returns the summary of what happens when an uploader is full
+func (b *CloudwatchBatcher) policyField() summaryField {
+	if b.bufferLimit > 0 {
+		return summaryField{`inflight_policy`,
+			fmt.Sprintf("buffer %d", b.bufferLimit),
+			optionSource(b.route, `CLOUDWATCH_STREAM_BUFFER_LIMIT`)}
+	}
+	policy := `block`
+	if b.dropWhenFull {
+		policy = `drop`
+	}
+	return summaryField{`inflight_policy`, policy,
+		optionSource(b.route, `CLOUDWATCH_INFLIGHT_POLICY`)}
+}
+
+// returns the summary of the proxy, with any password redacted
+func proxyField(route *router.Route) summaryField {
+	proxy, isSet := getOption(route, `CLOUDWATCH_PROXY`)
+	if !isSet {
+		return summaryField{`proxy`, `from HTTP_PROXY, if set`, `default`}
+	}
+	if proxyURL, err := url.Parse(proxy); err == nil {
+		proxy = proxyURL.Redacted()
+	} else {
+		proxy = `invalid`
+	}
+	return summaryField{`proxy`, proxy, optionSource(route, `CLOUDWATCH_PROXY`)}
+}
@@ -1,53 +1,273 @@
 package cloudwatch
 
 import (
-	"errors"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/gliderlabs/logspout/router"
 )
 
+const DEFAULT_RETRIES = 5                         // PutLogEvents attempts
+const DEFAULT_RETRY_BASE = 100 * time.Millisecond // first retry delay
+const MAX_RETRY_DELAY = 30 * time.Second          // doubled delays stop here
+const DEFAULT_MAX_INFLIGHT = 1                    // batches per uploader
+const DEFAULT_CLIENT_TIMEOUT = 10 * time.Second   // for each AWS request
+
+// streamID identifies a single log stream within a log group
+type streamID struct {
+	group  string
+	stream string
+}
+
 // CloudwatchUploader receieves CloudwatchBatches on its input channel,
 // and sends them on to the AWS Cloudwatch Logs endpoint.
 type CloudwatchUploader struct {
 	Input    chan CloudwatchBatch
-	svc      *cloudwatchlogs.CloudWatchLogs
-	tokens   map[string]string
+	Done     chan bool // closed once Input is closed and drained
+	svc      cloudwatchlogsiface.CloudWatchLogsAPI
+	tokens   map[streamID]string // sequence tokens for each log stream
+	groups   map[string]bool     // log groups known to exist
 	debugSet bool
+	dryRun   bool // if set, log each batch instead of uploading it
+	// retry failed uploads this many times, doubling the delay each time
+	retries   int
+	retryBase time.Duration
+	// if nonzero, the retention policy for newly-created log groups
+	retentionDays int
+	kmsKeyID      string         // if set, the KMS key to encrypt groups with
+	deadLetters   *DeadLetterDir // if set, stores batches that fail to upload
+	// if set, events are never sent with a timestamp before the last one
+	// uploaded to their stream, which is tracked in lastTimes
+	monotonic bool
+	lastTimes map[streamID]int64 // epoch milliseconds, for each log stream
 }
 
-func NewCloudwatchUploader(adapter *CloudwatchAdapter) *CloudwatchUploader {
-	region := adapter.Route.Address
-	if (region == "auto") || (region == "") {
-		if adapter.Ec2Region == "" {
-			log.Println("cloudwatch: ERROR - could not get region from EC2")
-		} else {
-			region = adapter.Ec2Region
-		}
+// the retention periods, in days, that Cloudwatch allows for log groups
+var RETENTION_DAYS = []int{1, 3, 5, 7, 14, 30, 60, 90, 120, 150, 180, 365, 400,
+	545, 731, 1096, 1827, 2192, 2557, 2922, 3288, 3653}
+
+// constructor for CloudwatchUploader - uploads to the given region,
+// or to the adapter's default region if it's empty
+func NewCloudwatchUploader(adapter *CloudwatchAdapter,
+	region string) *CloudwatchUploader {
+	if region == "" {
+		region = defaultRegion(adapter)
 	}
-	debugSet := false
-	_, debugOption := adapter.Route.Options[`DEBUG`]
-	if debugOption || (os.Getenv(`DEBUG`) != "") {
-		debugSet = true
+	debugSet := isDebugSet(adapter.Route)
+	if debugSet {
 		log.Println("cloudwatch: Creating AWS Cloudwatch client for region",
 			region)
 	}
+	retentionDays := getIntOption(adapter.Route, `CLOUDWATCH_RETENTION_DAYS`, 0)
+	if (retentionDays != 0) && !isValidRetention(retentionDays) {
+		log.Printf("cloudwatch: WARNING: CLOUDWATCH_RETENTION_DAYS %d is not "+
+			"allowed by Cloudwatch, ignoring it\n", retentionDays)
+		retentionDays = 0
+	}
+	kmsKeyID, _ := getOption(adapter.Route, `CLOUDWATCH_KMS_KEY_ID`)
+	maxInflight := getIntOption(adapter.Route, `CLOUDWATCH_MAX_INFLIGHT`,
+		DEFAULT_MAX_INFLIGHT)
+	if maxInflight < 1 {
+		log.Printf("cloudwatch: WARNING: CLOUDWATCH_MAX_INFLIGHT must be at "+
+			"least 1, using %d\n", DEFAULT_MAX_INFLIGHT)
+		maxInflight = DEFAULT_MAX_INFLIGHT
+	}
 	uploader := CloudwatchUploader{
-		Input:    make(chan CloudwatchBatch),
-		tokens:   map[string]string{},
+		// one batch is uploaded while the rest wait in the channel
+		Input:    make(chan CloudwatchBatch, maxInflight-1),
+		Done:     make(chan bool),
+		tokens:   map[streamID]string{},
+		groups:   map[string]bool{},
 		debugSet: debugSet,
-		svc: cloudwatchlogs.New(session.New(),
-			&aws.Config{Region: aws.String(region)}),
+		dryRun:   getBoolOption(adapter.Route, `CLOUDWATCH_DRY_RUN`, false),
+		retries: getIntOption(adapter.Route, `CLOUDWATCH_RETRIES`,
+			DEFAULT_RETRIES),
+		retryBase: getDurationOption(adapter.Route, `CLOUDWATCH_RETRY_BASE`,
+			DEFAULT_RETRY_BASE),
+		retentionDays: retentionDays,
+		kmsKeyID:      kmsKeyID,
+		deadLetters:   NewDeadLetterDir(adapter.Route),
+		svc:           Clients.NewClient(adapter.Route, region),
+		monotonic: getBoolOption(adapter.Route,
+			`CLOUDWATCH_MONOTONIC_TIMESTAMPS`, false),
+		lastTimes: map[streamID]int64{},
 	}
 	go uploader.Start()
 	return &uploader
 }
 
+// returns the region set by the `region` route option, or else the
+// CLOUDWATCH_REGION option, or else the route address, or the EC2 region if
+// none of them names a region
+func defaultRegion(adapter *CloudwatchAdapter) string {
+	region, _ := routeRegion(adapter.Route)
+	if (region == "auto") || (region == "") {
+		if adapter.Ec2Region == "" {
+			log.Println("cloudwatch: ERROR - could not get region from EC2")
+		} else {
+			region = adapter.Ec2Region
+		}
+	}
+	return region
+}
+
+// returns the region set for the route, in the order of precedence used by
+// defaultRegion, and where it was set, for the summary
+func routeRegion(route *router.Route) (string, string) {
+	if region, isSet := route.Options[`region`]; isSet {
+		return region, `route options`
+	}
+	if region, isSet := getOption(route, `CLOUDWATCH_REGION`); isSet {
+		return region, optionSource(route, `CLOUDWATCH_REGION`)
+	}
+	return route.Address, `route address`
+}
+
+// ClientFactory creates the Cloudwatch Logs client for each uploader.
+type ClientFactory interface {
+	NewClient(route *router.Route,
+		region string) cloudwatchlogsiface.CloudWatchLogsAPI
+}
+
+// Clients creates every uploader's client - it can be replaced before the
+// adapter is created, as in tests, to use fake clients instead of AWS
+var Clients ClientFactory = awsClientFactory{}
+
+// awsClientFactory creates clients for the real AWS Cloudwatch Logs API.
+type awsClientFactory struct{}
+
+func (f awsClientFactory) NewClient(route *router.Route,
+	region string) cloudwatchlogsiface.CloudWatchLogsAPI {
+	return newCloudwatchClient(route, region)
+}
+
+// creates a Cloudwatch Logs client for the given region, configured
+// by the route options and environment
+func newCloudwatchClient(route *router.Route,
+	region string) *cloudwatchlogs.CloudWatchLogs {
+	httpClient := newHTTPClient(route)
+	sessionConfig := ec2MetadataConfig(route)
+	sessionConfig.Region = aws.String(region)
+	sessionConfig.HTTPClient = httpClient
+	awsConfig := &aws.Config{
+		Region:     aws.String(region),
+		HTTPClient: httpClient,
+		MaxRetries: aws.Int(awsMaxRetries(route)),
+	}
+	if profile := credentialsProfile(route); profile != "" {
+		log.Println("cloudwatch: Using AWS credentials profile", profile)
+		// "" reads $AWS_SHARED_CREDENTIALS_FILE, or ~/.aws/credentials
+		sessionConfig.Credentials = credentials.NewSharedCredentials("", profile)
+		awsConfig.Credentials = sessionConfig.Credentials
+	}
+	mySession := session.New(sessionConfig)
+	if endpoint, isSet := getOption(route, `CLOUDWATCH_ENDPOINT`); isSet {
+		log.Println("cloudwatch: Using custom AWS endpoint", endpoint)
+		awsConfig.Endpoint = aws.String(endpoint)
+		if strings.HasPrefix(endpoint, "http://") {
+			awsConfig.DisableSSL = aws.Bool(true)
+		}
+	}
+	if roleARN, isSet := getOption(route, `CLOUDWATCH_ROLE_ARN`); isSet {
+		log.Println("cloudwatch: Assuming IAM role", roleARN)
+		externalID, hasExternalID := getOption(route, `CLOUDWATCH_EXTERNAL_ID`)
+		awsConfig.Credentials = stscreds.NewCredentials(mySession, roleARN,
+			func(provider *stscreds.AssumeRoleProvider) {
+				if hasExternalID {
+					provider.ExternalID = aws.String(externalID)
+				}
+			})
+	}
+	return cloudwatchlogs.New(mySession, awsConfig)
+}
+
+// returns the SDK's own retries for each AWS request, as set by
+// CLOUDWATCH_AWS_MAX_RETRIES, or 0 if it's not set, since the adapter
+// already retries each request (see retry)
+func awsMaxRetries(route *router.Route) int {
+	maxRetries := getIntOption(route, `CLOUDWATCH_AWS_MAX_RETRIES`, 0)
+	if maxRetries < 0 {
+		log.Printf("cloudwatch: WARNING: CLOUDWATCH_AWS_MAX_RETRIES must be "+
+			"at least 0, ignoring %d\n", maxRetries)
+		maxRetries = 0
+	}
+	return maxRetries
+}
+
+// returns the shared credentials profile set by CLOUDWATCH_PROFILE, or else
+// by AWS_PROFILE, or "" to use the default credentials chain
+func credentialsProfile(route *router.Route) string {
+	if profile, isSet := getOption(route, `CLOUDWATCH_PROFILE`); isSet {
+		return profile
+	}
+	return os.Getenv(`AWS_PROFILE`)
+}
+
+// creates the HTTP client for AWS requests, which uses the proxy set by
+// CLOUDWATCH_PROXY, or else by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY vars,
+// gives up on each request after CLOUDWATCH_CLIENT_TIMEOUT, and also trusts
+// the certificates in CLOUDWATCH_CA_BUNDLE, if it's set
+func newHTTPClient(route *router.Route) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxy, isSet := getOption(route, `CLOUDWATCH_PROXY`); isSet {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			log.Printf("cloudwatch: WARNING: ERROR parsing CLOUDWATCH_PROXY "+
+				"%s, ignoring it: %s\n", proxy, err)
+		} else {
+			transport.Proxy = http.ProxyURL(proxyURL)
+		}
+	}
+	if bundle, isSet := getOption(route, `CLOUDWATCH_CA_BUNDLE`); isSet {
+		roots, err := loadCABundle(bundle)
+		if err != nil {
+			log.Printf("cloudwatch: WARNING: ERROR reading CLOUDWATCH_CA_BUNDLE "+
+				"%s, ignoring it: %s\n", bundle, err)
+		} else {
+			transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		}
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout: getDurationOption(route, `CLOUDWATCH_CLIENT_TIMEOUT`,
+			DEFAULT_CLIENT_TIMEOUT),
+	}
+}
+
+// returns the system's root certificates, plus those in the given PEM file
+func loadCABundle(filename string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil { // as on Windows, before Go 1.18
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found")
+	}
+	return roots, nil
+}
+
 // Main loop for the Uploader - POSTs each batch to AWS Cloudwatch Logs,
 // while keeping track of the unique sequence token for each log stream.
 func (u *CloudwatchUploader) Start() {
@@ -55,35 +275,47 @@ func (u *CloudwatchUploader) Start() {
 		msg := batch.Msgs[0]
 		u.log("Submitting batch for %s-%s (length %d, size %v)",
 			msg.Group, msg.Stream, len(batch.Msgs), batch.Size)
+		id := streamID{group: msg.Group, stream: msg.Stream}
+		if u.dryRun {
+			log.Printf("cloudwatch: DRY RUN: PutLogEvents to %s-%s with %d "+
+				"messages, %d bytes\n", msg.Group, msg.Stream, len(batch.Msgs),
+				batch.Size)
+			lags.Finished(id, len(batch.Msgs), true)
+			releaseBatch(batch)
+			continue
+		}
 
+		// make sure the log group exists
+		err := u.retry("Checking log group", func() error {
+			return u.ensureGroup(msg)
+		})
+		if err != nil {
+			u.fail(batch, err)
+			continue
+		}
 		// fetch and cache the upload sequence token
-		var token *string
-		if cachedToken, isCached := u.tokens[msg.Container]; isCached {
-			token = &cachedToken
-			u.log("Got token from cache: %s", *token)
-		} else {
-			u.log("Fetching token from AWS...")
-			awsToken, err := u.getSequenceToken(msg)
-			if err != nil {
-				u.log("ERROR:", err)
-				continue
-			}
-			if awsToken != nil {
-				u.tokens[msg.Container] = *(awsToken)
-				u.log("Got token from AWS:", *awsToken)
-				token = awsToken
-			}
+		token, err := u.sequenceToken(id)
+		if err != nil {
+			u.fail(batch, err)
+			continue
 		}
 
+		// Cloudwatch requires the events in chronological order
+		sort.SliceStable(batch.Msgs, func(i, j int) bool {
+			return batch.Msgs[i].Time.Before(batch.Msgs[j].Time)
+		})
 		// generate the array of InputLogEvent from the batch's contents
 		events := []*cloudwatchlogs.InputLogEvent{}
 		for _, msg := range batch.Msgs {
 			event := cloudwatchlogs.InputLogEvent{
 				Message:   aws.String(msg.Message),
-				Timestamp: aws.Int64(msg.Time.UnixNano() / 1000000),
+				Timestamp: aws.Int64(epochMillis(msg.Time)),
 			}
 			events = append(events, &event)
 		}
+		if u.monotonic {
+			u.clampTimes(id, events)
+		}
 		params := &cloudwatchlogs.PutLogEventsInput{
 			LogEvents:     events,
 			LogGroupName:  aws.String(msg.Group),
@@ -93,37 +325,340 @@ func (u *CloudwatchUploader) Start() {
 
 		u.log("POSTing PutLogEvents to %s-%s with %d messages, %d bytes",
 			msg.Group, msg.Stream, len(batch.Msgs), batch.Size)
-		resp, err := u.svc.PutLogEvents(params)
+		resp, err := u.putLogEvents(params, msg)
 		if err != nil {
-			u.log(err.Error())
+			u.fail(batch, err)
 			continue
 		}
+		lags.Finished(id, len(batch.Msgs), true)
+		releaseBatch(batch)
 		u.log("Got 200 response")
+		if u.monotonic {
+			u.lastTimes[id] = *events[len(events)-1].Timestamp
+		}
+		batchesSent.Add(1)
+		rejected := rejectedBatch(batch.Msgs, resp.RejectedLogEventsInfo)
+		if len(rejected.Msgs) > 0 {
+			u.reject(rejected)
+		}
+		eventsShipped.Add(int64(len(batch.Msgs) - len(rejected.Msgs)))
+		bytesShipped.Add(batch.Size - rejected.Size)
 		if resp.NextSequenceToken != nil {
 			u.log("Caching new sequence token for %s-%s: %s",
 				msg.Group, msg.Stream, *resp.NextSequenceToken)
-			u.tokens[msg.Container] = *resp.NextSequenceToken
+			u.cacheToken(id, resp.NextSequenceToken)
 		}
 	}
+	close(u.Done)
 }
 
-// AWS CLIENT METHODS
+// moves the timestamps of the given events, which are in chronological order,
+// up to the last timestamp uploaded to their stream, if they're earlier
+func (u *CloudwatchUploader) clampTimes(id streamID,
+	events []*cloudwatchlogs.InputLogEvent) {
+	last, exists := u.lastTimes[id]
+	if !exists {
+		return
+	}
+	clamped := 0
+	for _, event := range events {
+		if *event.Timestamp >= last {
+			break // the rest are later still
+		}
+		event.Timestamp = aws.Int64(last)
+		clamped++
+	}
+	if clamped > 0 {
+		u.log("Moved %d earlier timestamps in %s-%s up to %d", clamped,
+			id.group, id.stream, last)
+	}
+}
 
-// returns the next sequence token for the log stream associated
-// with the given message's group and stream. Creates the stream as needed.
-func (u *CloudwatchUploader) getSequenceToken(msg CloudwatchMessage) (*string,
-	error) {
-	group, stream := msg.Group, msg.Stream
-	groupExists, err := u.groupExists(group)
-	if err != nil {
-		return nil, err
+// Gives up on uploading the given batch after the given error, whether its
+// log group or stream couldn't be checked or PutLogEvents failed: records
+// the failure, and stores the batch as a dead letter, if possible. Its
+// messages are only released from the write-ahead log if they were stored,
+// so they're replayed after a restart otherwise.
+func (u *CloudwatchUploader) fail(batch CloudwatchBatch, err error) {
+	msg := batch.Msgs[0]
+	health.Failure(err)
+	saved := u.drop(batch, err)
+	reportError(batch, err)
+	lags.Finished(streamID{group: msg.Group, stream: msg.Stream},
+		len(batch.Msgs), false)
+	if saved {
+		releaseBatch(batch)
+	}
+}
+
+// logs the failure to upload the given batch, and stores it in the
+// dead-letter directory, if there is one - returns true if it was stored
+func (u *CloudwatchUploader) drop(batch CloudwatchBatch, err error) bool {
+	msg := batch.Msgs[0]
+	if u.deadLetters == nil {
+		log.Printf("cloudwatch: ERROR dropping batch for %s-%s "+
+			"(length %d, size %v): %s\n", msg.Group, msg.Stream,
+			len(batch.Msgs), batch.Size, err)
+		return false
+	}
+	log.Printf("cloudwatch: ERROR uploading batch for %s-%s "+
+		"(length %d, size %v), saving it as a dead letter: %s\n", msg.Group,
+		msg.Stream, len(batch.Msgs), batch.Size, err)
+	if err = u.deadLetters.Write(batch); err != nil {
+		log.Println("cloudwatch: ERROR saving dead letter:", err)
+		return false
+	}
+	return true
+}
+
+// Counts the messages that Cloudwatch rejected from an uploaded batch as
+// dropped, and stores them as a dead letter, if possible. They're released
+// from the write-ahead log either way, since they'd be rejected again.
+func (u *CloudwatchUploader) reject(batch CloudwatchBatch) {
+	drops.Add(DROP_REJECTED, len(batch.Msgs))
+	eventsRejected.Add(int64(len(batch.Msgs)))
+	u.drop(batch, errRejected)
+}
+
+// returns a batch of the given messages, in the order their events were
+// sent, that Cloudwatch rejected according to the given info - the events
+// before each end index are too old, or older than the group's retention,
+// and the events from the start index on are too new
+func rejectedBatch(msgs []CloudwatchMessage,
+	info *cloudwatchlogs.RejectedLogEventsInfo) CloudwatchBatch {
+	batch := CloudwatchBatch{}
+	if info == nil {
+		return batch
+	}
+	start, end := 0, len(msgs) // the accepted events
+	for _, index := range []*int64{info.TooOldLogEventEndIndex,
+		info.ExpiredLogEventEndIndex} {
+		if (index != nil) && (int(*index) > start) {
+			start = int(*index)
+		}
+	}
+	if index := info.TooNewLogEventStartIndex; index != nil {
+		end = int(*index)
+	}
+	if start > len(msgs) {
+		start = len(msgs)
+	}
+	if end < start {
+		end = start
+	}
+	for i, msg := range msgs {
+		if (i < start) || (i >= end) {
+			batch.Msgs = append(batch.Msgs, msg)
+			batch.Size = batch.Size + msgSize(msg)
+		}
 	}
-	if !groupExists {
-		err = u.createGroup(group)
+	return batch
+}
+
+// AWS CLIENT METHODS
+
+// POSTs the given PutLogEvents request, retrying any failures with
+// exponential backoff. Returns the last error if all the retries fail.
+// If the request's sequence token is rejected, the expected token is
+// cached, and the request is retried once with the new token. If the stream
+// no longer exists, it's created again (with its group, as for the given
+// message, if needed), and the request is retried once.
+func (u *CloudwatchUploader) putLogEvents(
+	params *cloudwatchlogs.PutLogEventsInput, msg CloudwatchMessage) (
+	*cloudwatchlogs.PutLogEventsOutput, error) {
+	delay := u.retryBase
+	tokenRefreshed, recreated := false, false
+	for attempt := 0; ; attempt++ {
+		resp, err := u.svc.PutLogEvents(params)
+		if isAWSError(err,
+			cloudwatchlogs.ErrCodeDataAlreadyAcceptedException) {
+			// an earlier attempt succeeded, so this batch was delivered
+			u.log("Batch was already accepted by AWS")
+			health.Success()
+			return u.alreadyAccepted(err, params), nil
+		}
 		if err != nil {
+			putErrors.Add(1)
+		}
+		if !tokenRefreshed && isAWSError(err,
+			cloudwatchlogs.ErrCodeInvalidSequenceTokenException) {
+			tokenRefreshed = true
+			token, tokenErr := u.expectedSequenceToken(err,
+				*params.LogGroupName, *params.LogStreamName)
+			if tokenErr != nil {
+				return nil, tokenErr
+			}
+			u.log("Retrying with expected sequence token %s",
+				aws.StringValue(token))
+			params.SequenceToken = token
+			attempt-- // this retry doesn't count against the backoff
+			continue
+		}
+		if !recreated && isAWSError(err,
+			cloudwatchlogs.ErrCodeResourceNotFoundException) {
+			recreated = true
+			createErr := u.recreateStream(msg)
+			if createErr != nil {
+				return nil, createErr
+			}
+			// a new stream needs no token, and this retry doesn't count
+			// against the backoff
+			params.SequenceToken = nil
+			attempt--
+			continue
+		}
+		if err == nil {
+			health.Success()
+			return resp, nil
+		}
+		if (attempt >= u.retries) || !isRetryable(err) {
+			return resp, err
+		}
+		u.log("PutLogEvents failed (%s), retrying in %v...", err, delay)
+		time.Sleep(delay)
+		delay = nextRetryDelay(delay)
+	}
+}
+
+// returns a PutLogEvents response for a batch that was rejected with the
+// given DataAlreadyAcceptedException, holding the expected sequence token.
+// If the token is not available, it will be fetched for the next batch.
+func (u *CloudwatchUploader) alreadyAccepted(putErr error,
+	params *cloudwatchlogs.PutLogEventsInput) *cloudwatchlogs.PutLogEventsOutput {
+	resp := &cloudwatchlogs.PutLogEventsOutput{}
+	acceptedErr, ok := putErr.(*cloudwatchlogs.DataAlreadyAcceptedException)
+	if ok {
+		resp.NextSequenceToken = acceptedErr.ExpectedSequenceToken
+	}
+	if resp.NextSequenceToken == nil {
+		u.cacheToken(streamID{
+			group:  *params.LogGroupName,
+			stream: *params.LogStreamName,
+		}, nil)
+	}
+	return resp
+}
+
+// returns the sequence token expected by AWS, after PutLogEvents fails with
+// the given InvalidSequenceTokenException. The token is read from the error
+// if possible, or else fetched again from AWS. The new token is cached.
+func (u *CloudwatchUploader) expectedSequenceToken(putErr error,
+	group, stream string) (*string, error) {
+	id := streamID{group: group, stream: stream}
+	var token *string
+	tokenErr, ok := putErr.(*cloudwatchlogs.InvalidSequenceTokenException)
+	if ok {
+		token = tokenErr.ExpectedSequenceToken
+	}
+	if token == nil {
+		u.log("Fetching expected token from AWS...")
+		var err error
+		if token, err = u.getSequenceToken(group, stream); err != nil {
 			return nil, err
 		}
 	}
+	u.cacheToken(id, token)
+	return token, nil
+}
+
+// returns the stream's cached sequence token, or else fetches and caches it,
+// creating the stream as needed. Failures are retried, as for PutLogEvents.
+func (u *CloudwatchUploader) sequenceToken(id streamID) (*string, error) {
+	if cachedToken, isCached := u.tokens[id]; isCached {
+		u.log("Got token from cache: %s", cachedToken)
+		return &cachedToken, nil
+	}
+	u.log("Fetching token from AWS...")
+	var token *string
+	err := u.retry("Fetching token", func() error {
+		var fetchErr error
+		token, fetchErr = u.getSequenceToken(id.group, id.stream)
+		return fetchErr
+	})
+	if (err == nil) && (token != nil) {
+		u.cacheToken(id, token)
+		u.log("Got token from AWS: %s", *token)
+	}
+	return token, err
+}
+
+// Calls the given AWS request, retrying any failures that may succeed on
+// a retry with exponential backoff, as for PutLogEvents. Returns the last
+// error if the request can't be retried, or all the retries fail.
+func (u *CloudwatchUploader) retry(what string, request func() error) error {
+	delay := u.retryBase
+	for attempt := 0; ; attempt++ {
+		err := request()
+		if (err == nil) || (attempt >= u.retries) || !isRetryable(err) {
+			return err
+		}
+		u.log("%s failed (%s), retrying in %v...", what, err, delay)
+		time.Sleep(delay)
+		delay = nextRetryDelay(delay)
+	}
+}
+
+// returns the delay before the retry after one that waited for the given
+// delay - double the delay, up to MAX_RETRY_DELAY
+func nextRetryDelay(delay time.Duration) time.Duration {
+	if delay = delay * 2; delay > MAX_RETRY_DELAY {
+		return MAX_RETRY_DELAY
+	}
+	return delay
+}
+
+// Returns true if a failed AWS request may succeed when it's retried: if AWS
+// was throttling, or failed with a 5xx status, or the request timed out or
+// couldn't connect. Other errors, such as AccessDeniedException, would only
+// happen again.
+func isRetryable(err error) bool {
+	if request.IsErrorThrottle(err) || request.IsErrorRetryable(err) {
+		return true
+	}
+	if failure, ok := err.(awserr.RequestFailure); ok {
+		return failure.StatusCode() >= 500
+	}
+	return isAWSError(err, cloudwatchlogs.ErrCodeServiceUnavailableException)
+}
+
+// caches the stream's sequence token, or forgets it if the token is nil
+func (u *CloudwatchUploader) cacheToken(id streamID, token *string) {
+	if token == nil {
+		delete(u.tokens, id)
+	} else {
+		u.tokens[id] = *token
+	}
+	statuses.Token(id, token)
+}
+
+// creates the log group for the given message, if it doesn't exist yet,
+// or associates an existing group with the KMS key, if it has none
+func (u *CloudwatchUploader) ensureGroup(msg CloudwatchMessage) error {
+	if u.groups[msg.Group] { // only check for each group once
+		return nil
+	}
+	logGroup, err := u.findGroup(msg.Group)
+	if err != nil {
+		return err
+	}
+	if logGroup == nil {
+		if err = u.createGroup(msg.Group, msg.Tags,
+			msg.RetentionDays); err != nil {
+			return err
+		}
+	} else if (u.kmsKeyID != "") && (logGroup.KmsKeyId == nil) {
+		if err = u.associateKey(msg.Group); err != nil {
+			return err
+		}
+	}
+	u.groups[msg.Group] = true
+	return nil
+}
+
+// returns the next sequence token for the log stream associated
+// with the given group and stream. Creates the stream as needed.
+func (u *CloudwatchUploader) getSequenceToken(group, stream string) (*string,
+	error) {
 	params := &cloudwatchlogs.DescribeLogStreamsInput{
 		LogGroupName:        aws.String(group),
 		LogStreamNamePrefix: aws.String(stream),
@@ -133,68 +668,144 @@ func (u *CloudwatchUploader) getSequenceToken(msg CloudwatchMessage) (*string,
 	if err != nil {
 		return nil, err
 	}
-	if count := len(resp.LogStreams); count > 1 { // too many matching streams!
-		return nil, errors.New(fmt.Sprintf(
-			"%d streams match group %s, stream %s!", count, group, stream))
-	}
-	if len(resp.LogStreams) == 0 { // no matching streams - create one and retry
-		if err = u.createStream(group, stream); err != nil {
-			return nil, err
+	for _, matchedStream := range resp.LogStreams {
+		if *matchedStream.LogStreamName == stream {
+			return matchedStream.UploadSequenceToken, nil
 		}
-		token, err := u.getSequenceToken(msg)
-		return token, err
 	}
-	return resp.LogStreams[0].UploadSequenceToken, nil
+	// no matching stream - create one, which needs no sequence token
+	return nil, u.createStream(group, stream)
 }
 
-func (u *CloudwatchUploader) groupExists(group string) (bool, error) {
+// returns the log group with the given name, or nil if it doesn't exist
+func (u *CloudwatchUploader) findGroup(group string) (
+	*cloudwatchlogs.LogGroup, error) {
 	u.log("Checking for group: %s...", group)
 	resp, err := u.svc.DescribeLogGroups(&cloudwatchlogs.DescribeLogGroupsInput{
 		LogGroupNamePrefix: aws.String(group),
 	})
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	for _, matchedGroup := range resp.LogGroups {
 		if *matchedGroup.LogGroupName == group {
-			return true, nil
+			return matchedGroup, nil
 		}
 	}
-	return false, nil
+	return nil, nil
 }
 
-func (u *CloudwatchUploader) createGroup(group string) error {
+// creates the log group, with the given tags, and sets its retention policy
+// to the given days, or CLOUDWATCH_RETENTION_DAYS if that's 0
+func (u *CloudwatchUploader) createGroup(group string,
+	tags map[string]string, retentionDays int) error {
 	u.log("Creating group: %s...", group)
 	params := &cloudwatchlogs.CreateLogGroupInput{
 		LogGroupName: aws.String(group),
 	}
-	if _, err := u.svc.CreateLogGroup(params); err != nil {
+	if len(tags) > 0 {
+		params.Tags = aws.StringMap(tags)
+	}
+	if u.kmsKeyID != "" {
+		params.KmsKeyId = aws.String(u.kmsKeyID)
+	}
+	_, err := u.svc.CreateLogGroup(params)
+	if isAWSError(err, cloudwatchlogs.ErrCodeResourceAlreadyExistsException) {
+		u.log("Group %s was already created", group)
+		return nil
+	}
+	if err != nil {
 		return err
 	}
+	if retentionDays == 0 {
+		retentionDays = u.retentionDays
+	}
+	if retentionDays != 0 {
+		u.setRetention(group, retentionDays)
+	}
 	return nil
 }
 
+// sets the retention policy for a new group - errors are logged, but
+// otherwise ignored, since the group can still receive logs
+func (u *CloudwatchUploader) setRetention(group string, days int) {
+	u.log("Setting retention for group %s to %d days...", group, days)
+	_, err := u.svc.PutRetentionPolicy(&cloudwatchlogs.PutRetentionPolicyInput{
+		LogGroupName:    aws.String(group),
+		RetentionInDays: aws.Int64(int64(days)),
+	})
+	if err != nil {
+		log.Printf("cloudwatch: ERROR setting retention for group %s: %s\n",
+			group, err)
+	}
+}
+
+// associates an existing group with the KMS key, so new logs are encrypted
+func (u *CloudwatchUploader) associateKey(group string) error {
+	u.log("Associating group %s with KMS key %s...", group, u.kmsKeyID)
+	_, err := u.svc.AssociateKmsKey(&cloudwatchlogs.AssociateKmsKeyInput{
+		LogGroupName: aws.String(group),
+		KmsKeyId:     aws.String(u.kmsKeyID),
+	})
+	return err
+}
+
+// creates the message's log stream, which was deleted after it was last
+// used, creating its group first if that was deleted too, and forgets its
+// sequence token
+func (u *CloudwatchUploader) recreateStream(msg CloudwatchMessage) error {
+	log.Printf("cloudwatch: WARNING: log stream %s-%s no longer exists, "+
+		"creating it again\n", msg.Group, msg.Stream)
+	delete(u.groups, msg.Group) // check for the group again
+	if err := u.ensureGroup(msg); err != nil {
+		return err
+	}
+	u.cacheToken(streamID{group: msg.Group, stream: msg.Stream}, nil)
+	return u.createStream(msg.Group, msg.Stream)
+}
+
 func (u *CloudwatchUploader) createStream(group, stream string) error {
 	u.log("Creating stream for group %s, stream %s...", group, stream)
 	params := &cloudwatchlogs.CreateLogStreamInput{
 		LogGroupName:  aws.String(group),
 		LogStreamName: aws.String(stream),
 	}
-	if _, err := u.svc.CreateLogStream(params); err != nil {
-		return err
+	_, err := u.svc.CreateLogStream(params)
+	if isAWSError(err, cloudwatchlogs.ErrCodeResourceAlreadyExistsException) {
+		u.log("Stream %s-%s was already created", group, stream)
+		return nil
 	}
-	return nil
+	return err
 }
 
 // HELPER METHODS
 
+// returns the time as milliseconds since the Unix epoch, as Cloudwatch
+// expects - this is the same in any time zone
+func epochMillis(t time.Time) int64 {
+	return t.UTC().UnixNano() / int64(time.Millisecond)
+}
+
+// returns true if Cloudwatch allows a retention period of the given days
+func isValidRetention(days int) bool {
+	for _, allowedDays := range RETENTION_DAYS {
+		if days == allowedDays {
+			return true
+		}
+	}
+	return false
+}
+
+// returns true if err is an AWS error with the given error code
+func isAWSError(err error, code string) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == code
+	}
+	return false
+}
+
 func (u *CloudwatchUploader) log(format string, args ...interface{}) {
 	if u.debugSet {
-		msg := fmt.Sprintf(format, args...)
-		msg = fmt.Sprintf("cloudwatch: %s", msg)
-		if !strings.HasSuffix(msg, "\n") {
-			msg = fmt.Sprintf("%s\n", msg)
-		}
-		log.Print(msg)
+		debugLog(format, args...)
 	}
 }
@@ -0,0 +1,1534 @@
+package cloudwatch
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/gliderlabs/logspout/router"
+)
+
+// returns a batch of count messages for the same stream, numbered from
+// first, as in "m0", "m1"...
+func testBatch(first, count int) CloudwatchBatch {
+	batch := NewCloudwatchBatch()
+	for i := first; i < first+count; i++ {
+		batch.Append(CloudwatchMessage{Message: fmt.Sprintf("m%d", i),
+			Group: `test-group`, Stream: `web`, Time: time.Now()})
+	}
+	return *batch
+}
+
+// returns a new temporary directory, which the caller must remove
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cloudwatch-test")
+	if err != nil {
+		t.Fatal("creating a temporary directory:", err)
+	}
+	return dir
+}
+
+// returns the messages in the files of the given directory whose names
+// start with the given prefix
+func readMessages(t *testing.T, dir, prefix string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal("reading", dir, ":", err)
+	}
+	messages := []string{}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), prefix) {
+			continue
+		}
+		msgs, err := readSegment(filepath.Join(dir, file.Name()))
+		if err != nil {
+			t.Fatal("reading", file.Name(), ":", err)
+		}
+		for _, msg := range msgs {
+			messages = append(messages, msg.Message)
+		}
+	}
+	return messages
+}
+
+func TestDeadLetters(t *testing.T) {
+	tests := []struct {
+		request string // the request that fails
+		gzip    bool
+	}{
+		{request: "PutLogEvents"},
+		{request: "PutLogEvents", gzip: true},
+		{request: "DescribeLogGroups"},
+		{request: "CreateLogStream"},
+	}
+	for _, test := range tests {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		client := newFakeLogs()
+		client.fail(test.request, 1)
+		options := map[string]string{`CLOUDWATCH_RETRIES`: `0`,
+			`CLOUDWATCH_DEADLETTER_DIR`: dir}
+		if test.gzip {
+			options[`CLOUDWATCH_SPILL_GZIP`] = `true`
+		}
+		adapter := newTestAdapter(t, client, options)
+		runAdapter(adapter, testMessage("web", "hello"))
+		got := readMessages(t, dir, `batch-`)
+		if !sameStrings(got, []string{"hello"}) {
+			t.Errorf("%s failing, gzip %v: got dead letters %q",
+				test.request, test.gzip, got)
+		}
+	}
+}
+
+func TestDeadLetterPrune(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	others := []string{"wal-1.log", "notes.txt"}
+	for _, name := range others {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte("keep"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadLetters := &DeadLetterDir{path: dir, maxBytes: 0}
+	if err := deadLetters.Write(testBatch(0, 2)); err != nil {
+		t.Fatal("writing a dead letter:", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	if !sameStrings(names, []string{"notes.txt", "wal-1.log"}) {
+		t.Errorf("got files %v, want only the other files kept", names)
+	}
+}
+
+func TestDeadLetterMaxMB(t *testing.T) {
+	tests := []struct {
+		maxMB string
+		want  int64
+	}{
+		{maxMB: "5", want: 5},
+		{maxMB: "1", want: 1},
+		{maxMB: "0", want: DEFAULT_DEADLETTER_MAX_MB},
+		{maxMB: "-1", want: DEFAULT_DEADLETTER_MAX_MB},
+	}
+	for _, test := range tests {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		route := &router.Route{Options: map[string]string{
+			`CLOUDWATCH_DEADLETTER_DIR`:    dir,
+			`CLOUDWATCH_DEADLETTER_MAX_MB`: test.maxMB,
+		}}
+		deadLetters := NewDeadLetterDir(route)
+		if got := deadLetters.maxBytes / 1024 / 1024; got != test.want {
+			t.Errorf("max MB %s: got %d MB, want %d", test.maxMB, got,
+				test.want)
+		}
+		if err := deadLetters.Write(testBatch(0, 1)); err != nil {
+			t.Fatal("writing a dead letter:", err)
+		}
+		got := readMessages(t, dir, `batch-`)
+		if !sameStrings(got, []string{"m0"}) {
+			t.Errorf("max MB %s: got dead letters %q, want m0", test.maxMB,
+				got)
+		}
+	}
+}
+
+func TestDeadLettersConcurrent(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	deadLetters := &DeadLetterDir{path: dir,
+		maxBytes: DEFAULT_DEADLETTER_MAX_MB * 1024 * 1024}
+	const writers = 20
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			errs <- deadLetters.Write(testBatch(i, 1))
+		}(i)
+	}
+	for i := 0; i < writers; i++ {
+		if err := <-errs; err != nil {
+			t.Error("writing a dead letter:", err)
+		}
+	}
+	if got := len(readMessages(t, dir, `batch-`)); got != writers {
+		t.Errorf("got %d dead letters, want %d", got, writers)
+	}
+}
+
+func TestWALReleased(t *testing.T) {
+	big := strings.Repeat("x", WAL_SEGMENT_SIZE/2) // two fill a segment
+	tests := []struct {
+		name         string
+		messages     []string
+		released     []int // the messages released, by position
+		wantSegments int
+		wantReplayed []string
+	}{
+		{
+			name:         "none released",
+			messages:     []string{"a", "b", "c"},
+			wantSegments: 1,
+			wantReplayed: []string{"a", "b", "c"},
+		},
+		{
+			name:         "some released",
+			messages:     []string{"a", "b", "c", "d"},
+			released:     []int{1, 3},
+			wantSegments: 1,
+			wantReplayed: []string{"a", "c"},
+		},
+		{
+			name:         "all released",
+			messages:     []string{"a", "b"},
+			released:     []int{0, 1},
+			wantSegments: 0,
+			wantReplayed: []string{},
+		},
+		{
+			name:         "later segment released before the first",
+			messages:     []string{big, big, big, big, "e"},
+			released:     []int{1, 2, 3},
+			wantSegments: 2,
+			wantReplayed: []string{big, "e"},
+		},
+	}
+	for _, test := range tests {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		wal := &WriteAheadLog{path: dir, maxBytes: 100 * 1024 * 1024}
+		msgs := []CloudwatchMessage{}
+		for _, text := range test.messages {
+			msg := CloudwatchMessage{Message: text, Group: `test-group`,
+				Stream: `web`, Time: time.Now()}
+			if err := wal.Append(&msg); err != nil {
+				t.Fatal("writing to the write-ahead log:", err)
+			}
+			msgs = append(msgs, msg)
+		}
+		for _, i := range test.released {
+			msgs[i].wal.Release()
+		}
+		if got := len(wal.segments); got != test.wantSegments {
+			t.Errorf("%s: got %d segments, want %d", test.name, got,
+				test.wantSegments)
+		}
+		// as after a restart
+		_, replayed := (&WriteAheadLog{path: dir}).readAll()
+		got := []string{}
+		for _, msg := range replayed {
+			got = append(got, msg.Message)
+		}
+		if !sameStrings(got, test.wantReplayed) {
+			t.Errorf("%s: got %d messages replayed, want %d", test.name,
+				len(got), len(test.wantReplayed))
+		}
+	}
+}
+
+func TestWALJoined(t *testing.T) {
+	tests := []struct {
+		name         string
+		options      map[string]string
+		lines        []string
+		wantReplayed []string // if the upload fails
+	}{
+		{
+			name:         "multiline",
+			options:      map[string]string{`MULTILINE_MATCH`: `nonfirst`},
+			lines:        []string{"panic", "  at a", "  at b"},
+			wantReplayed: []string{"panic", "  at a", "  at b"},
+		},
+		{
+			name:         "dedup",
+			options:      map[string]string{`CLOUDWATCH_DEDUP`: `true`},
+			lines:        []string{"x", "x", "x"},
+			wantReplayed: []string{"x", "x", "x"},
+		},
+	}
+	for _, test := range tests {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		client := newFakeLogs()
+		client.fail("PutLogEvents", 1)
+		test.options[`CLOUDWATCH_WAL_DIR`] = dir
+		test.options[`CLOUDWATCH_RETRIES`] = `0`
+		adapter := newTestAdapter(t, client, test.options)
+		msgs := []*router.Message{}
+		for _, line := range test.lines {
+			msgs = append(msgs, testMessage("web", line))
+		}
+		runAdapter(adapter, msgs...)
+		_, replayed := (&WriteAheadLog{path: dir}).readAll()
+		got := []string{}
+		for _, msg := range replayed {
+			got = append(got, msg.Message)
+		}
+		if !sameStrings(got, test.wantReplayed) {
+			t.Errorf("%s: got replayed %q, want %q", test.name, got,
+				test.wantReplayed)
+		}
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int // of PutLogEvents
+		deadLetters  bool
+		wantUploaded []string
+		wantPending  []string // left in the write-ahead log
+	}{
+		{
+			name:         "uploaded",
+			wantUploaded: []string{"first", "second"},
+			wantPending:  []string{},
+		},
+		{
+			name:         "failed",
+			failures:     1,
+			wantUploaded: []string{},
+			wantPending:  []string{"first", "second"},
+		},
+		{
+			name:         "saved as dead letters",
+			failures:     1,
+			deadLetters:  true,
+			wantUploaded: []string{},
+			wantPending:  []string{},
+		},
+	}
+	for _, test := range tests {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		// the messages left by the last run
+		records := ""
+		for i, text := range []string{"first", "second"} {
+			record, err := json.Marshal(CloudwatchMessage{Message: text,
+				Group: `test-group`, Stream: `web`,
+				Time: time.Now().Add(time.Duration(i) * time.Millisecond)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			records = records + string(record) + "\n"
+		}
+		err := ioutil.WriteFile(filepath.Join(dir, "wal-1.log"),
+			[]byte(records), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := newFakeLogs()
+		client.fail("PutLogEvents", test.failures)
+		options := map[string]string{`CLOUDWATCH_RETRIES`: `0`,
+			`CLOUDWATCH_WAL_DIR`: dir}
+		if test.deadLetters {
+			options[`CLOUDWATCH_DEADLETTER_DIR`] = filepath.Join(dir,
+				"dead")
+		}
+		adapter := newTestAdapter(t, client, options)
+		if len(adapter.replayed) != 2 {
+			t.Errorf("%s: got %d messages to replay, want 2", test.name,
+				len(adapter.replayed))
+		}
+		runAdapter(adapter)
+		if got := client.messages(); !sameStrings(got, test.wantUploaded) {
+			t.Errorf("%s: got uploaded %q, want %q", test.name, got,
+				test.wantUploaded)
+		}
+		got := readMessages(t, dir, `wal-`)
+		if !sameStrings(got, test.wantPending) {
+			t.Errorf("%s: got pending %q, want %q", test.name, got,
+				test.wantPending)
+		}
+	}
+}
+
+var errAccessDenied = awserr.New("AccessDeniedException",
+	"not authorized to perform logs:PutLogEvents", nil)
+
+var errInvalidParameter = awserr.New(
+	cloudwatchlogs.ErrCodeInvalidParameterException, "bad stream name", nil)
+
+var errThrottled = awserr.New("ThrottlingException", "rate exceeded", nil)
+
+func TestGzipSpill(t *testing.T) {
+	for _, crashed := range []bool{false, true} {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		// the messages left by the last run, which may have ended before
+		// the file's gzip trailer was written
+		file, err := os.Create(filepath.Join(dir, "wal-1.log"+GZIP_EXTENSION))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zipped := gzip.NewWriter(file)
+		for i, text := range []string{"first", "second"} {
+			record, _ := json.Marshal(CloudwatchMessage{Message: text,
+				Group: `test-group`, Stream: `web`,
+				Time: time.Now().Add(time.Duration(i) * time.Millisecond)})
+			zipped.Write(append(record, '\n'))
+		}
+		if crashed {
+			zipped.Flush()
+		} else {
+			zipped.Close()
+		}
+		file.Close()
+		// they're replayed, then saved as dead letters
+		client := newFakeLogs()
+		client.fail("PutLogEvents", 1)
+		adapter := newTestAdapter(t, client, map[string]string{
+			`CLOUDWATCH_RETRIES`:        `0`,
+			`CLOUDWATCH_SPILL_GZIP`:     `true`,
+			`CLOUDWATCH_WAL_DIR`:        dir,
+			`CLOUDWATCH_DEADLETTER_DIR`: filepath.Join(dir, "dead")})
+		runAdapter(adapter, testMessage("web", "third"))
+		got := readMessages(t, filepath.Join(dir, "dead"), `batch-`)
+		sort.Strings(got) // the replayed and new messages may be apart
+		want := []string{"first", "second", "third"}
+		if !sameStrings(got, want) {
+			t.Errorf("crashed %v: got dead letters %q, want %q", crashed, got,
+				want)
+		}
+		names, _ := filepath.Glob(filepath.Join(dir, "dead", "*"))
+		for _, name := range names {
+			if !strings.HasSuffix(name, GZIP_EXTENSION) {
+				t.Errorf("crashed %v: got dead letters %s, not compressed",
+					crashed, name)
+			}
+		}
+	}
+}
+
+func TestUploadErrors(t *testing.T) {
+	errs := make(chan UploadError, 10)
+	UploadErrors = errs
+	defer func() { UploadErrors = nil }()
+	client := newFakeLogs()
+	client.failWith("PutLogEvents", errAccessDenied, 1)
+	adapter := newTestAdapter(t, client, map[string]string{
+		`CLOUDWATCH_BATCH_SIZE`: `2`})
+	runAdapter(adapter, testMessage("web", "one"), testMessage("web", "two"),
+		testMessage("web", "three"))
+	if len(errs) != 1 {
+		t.Fatalf("got %d upload errors, want 1", len(errs))
+	}
+	got := <-errs
+	if (got.Group != "test-group") || (got.Stream != "web") ||
+		(got.Region != "") || (got.Dropped != 2) || (got.Err == nil) {
+		t.Errorf("got upload error %+v, want 2 dropped from test-group-web",
+			got)
+	}
+	if got := client.messages(); !sameStrings(got, []string{"three"}) {
+		t.Errorf("got uploaded %q, want three", got)
+	}
+	// a full channel doesn't hold up the uploads
+	UploadErrors = make(chan UploadError)
+	client = newFakeLogs()
+	client.failWith("PutLogEvents", errAccessDenied, 1)
+	adapter = newTestAdapter(t, client, nil)
+	runAdapter(adapter, testMessage("web", "one"))
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		err          error // returned by each failure
+		retries      int
+		failures     int
+		wantErr      bool
+		wantAttempts int
+		wantDelay    time.Duration // the least time spent waiting
+	}{
+		{err: errUnavailable, retries: 0, failures: 0, wantAttempts: 1},
+		{err: errUnavailable, retries: 0, failures: 1, wantErr: true,
+			wantAttempts: 1},
+		{err: errUnavailable, retries: 2, failures: 2, wantAttempts: 3,
+			wantDelay: 30 * time.Millisecond},
+		{err: errUnavailable, retries: 2, failures: 5, wantErr: true,
+			wantAttempts: 3, wantDelay: 30 * time.Millisecond},
+		{err: errThrottled, retries: 2, failures: 1, wantAttempts: 2,
+			wantDelay: 10 * time.Millisecond},
+		{err: errors.New("connection reset"), retries: 2, failures: 1,
+			wantAttempts: 2, wantDelay: 10 * time.Millisecond},
+		{err: errAccessDenied, retries: 2, failures: 1, wantErr: true,
+			wantAttempts: 1},
+		{err: errInvalidParameter, retries: 2, failures: 1, wantErr: true,
+			wantAttempts: 1},
+	}
+	for _, test := range tests {
+		uploader := &CloudwatchUploader{retries: test.retries,
+			retryBase: 10 * time.Millisecond}
+		attempts := 0
+		started := time.Now()
+		err := uploader.retry("Testing", func() error {
+			attempts++
+			if attempts <= test.failures {
+				return test.err
+			}
+			return nil
+		})
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v, %d retries, %d failures: got error %v", test.err,
+				test.retries, test.failures, err)
+		}
+		if attempts != test.wantAttempts {
+			t.Errorf("%v, %d retries, %d failures: got %d attempts, want %d",
+				test.err, test.retries, test.failures, attempts,
+				test.wantAttempts)
+		}
+		if waited := time.Since(started); waited < test.wantDelay {
+			t.Errorf("%v, %d retries, %d failures: waited %v, want at "+
+				"least %v", test.err, test.retries, test.failures, waited,
+				test.wantDelay)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	delay := DEFAULT_RETRY_BASE
+	for i := 0; i < 100; i++ {
+		next := nextRetryDelay(delay)
+		if (next < delay) || (next > MAX_RETRY_DELAY) {
+			t.Fatalf("after %v: got %v, want %v to %v", delay, next, delay,
+				MAX_RETRY_DELAY)
+		}
+		delay = next
+	}
+	if delay != MAX_RETRY_DELAY {
+		t.Errorf("got %v after 100 retries, want %v", delay, MAX_RETRY_DELAY)
+	}
+}
+
+func TestUploadFailures(t *testing.T) {
+	tests := []struct {
+		request      string
+		err          error
+		failures     int
+		wantUploaded bool
+		wantCalls    int
+	}{
+		{request: "PutLogEvents", err: errUnavailable, failures: 2,
+			wantUploaded: true, wantCalls: 3},
+		{request: "PutLogEvents", err: errUnavailable, failures: 3,
+			wantCalls: 3},
+		{request: "PutLogEvents", err: errAccessDenied, failures: 1,
+			wantCalls: 1},
+		{request: "DescribeLogGroups", err: errUnavailable, failures: 2,
+			wantUploaded: true, wantCalls: 3},
+		{request: "DescribeLogGroups", err: errUnavailable, failures: 3,
+			wantCalls: 3},
+		{request: "DescribeLogGroups", err: errAccessDenied, failures: 1,
+			wantCalls: 1},
+		{request: "CreateLogGroup", err: errUnavailable, failures: 3,
+			wantCalls: 3},
+		{request: "DescribeLogStreams", err: errUnavailable, failures: 2,
+			wantUploaded: true, wantCalls: 3},
+		{request: "CreateLogStream", err: errUnavailable, failures: 3,
+			wantCalls: 3},
+		{request: "CreateLogStream", err: errInvalidParameter, failures: 1,
+			wantCalls: 1},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		client.failWith(test.request, test.err, test.failures)
+		adapter := newTestAdapter(t, client,
+			map[string]string{`CLOUDWATCH_RETRIES`: `2`})
+		runAdapter(adapter, testMessage("web", "hello"))
+		uploaded := len(client.messages()) == 1
+		if uploaded != test.wantUploaded {
+			t.Errorf("%s failing %d times with %v: got uploaded %v, want %v",
+				test.request, test.failures, test.err, uploaded,
+				test.wantUploaded)
+		}
+		if calls := client.callCount(test.request); calls != test.wantCalls {
+			t.Errorf("%s failing %d times with %v: got %d requests, want %d",
+				test.request, test.failures, test.err, calls, test.wantCalls)
+		}
+	}
+}
+
+func TestAWSMaxRetries(t *testing.T) {
+	tests := []struct {
+		option string
+		want   int
+	}{
+		{option: "", want: 0},
+		{option: "3", want: 3},
+		{option: "-1", want: 0},
+	}
+	for _, test := range tests {
+		route := &router.Route{Options: map[string]string{}}
+		if test.option != "" {
+			route.Options[`CLOUDWATCH_AWS_MAX_RETRIES`] = test.option
+		}
+		client := newCloudwatchClient(route, "us-east-1")
+		if got := aws.IntValue(client.Config.MaxRetries); got != test.want {
+			t.Errorf("CLOUDWATCH_AWS_MAX_RETRIES %q: got %d SDK retries, "+
+				"want %d", test.option, got, test.want)
+		}
+	}
+}
+
+func TestWriteHealth(t *testing.T) {
+	never := time.Duration(-1) // leaves the time zero
+	tests := []struct {
+		name       string
+		lastError  error
+		successAge time.Duration
+		failureAge time.Duration
+		wantCode   int
+		wantBody   string
+	}{
+		{
+			name:       "starting",
+			successAge: never,
+			failureAge: never,
+			wantCode:   http.StatusOK,
+			wantBody:   "OK\n",
+		},
+		{
+			name:       "uploading",
+			failureAge: never,
+			wantCode:   http.StatusOK,
+			wantBody:   "OK\n",
+		},
+		{
+			name:       "failing since starting",
+			lastError:  errors.New("access denied"),
+			successAge: never,
+			wantCode:   http.StatusServiceUnavailable,
+			wantBody:   "ERROR: no logs uploaded for 5m0s: access denied\n",
+		},
+		{
+			name:       "recent failure",
+			lastError:  errors.New("throttled"),
+			successAge: time.Minute,
+			wantCode:   http.StatusOK,
+			wantBody:   "OK, but the last upload failed: throttled\n",
+		},
+		{
+			name:       "failing",
+			lastError:  errors.New("access denied"),
+			successAge: time.Hour,
+			wantCode:   http.StatusServiceUnavailable,
+			wantBody:   "ERROR: no logs uploaded for 5m0s: access denied\n",
+		},
+		{
+			name:       "idle since a failure",
+			lastError:  errors.New("throttled"),
+			successAge: time.Hour,
+			failureAge: 10 * time.Minute,
+			wantCode:   http.StatusOK,
+			wantBody:   "OK, but the last upload failed: throttled\n",
+		},
+	}
+	health.Lock()
+	lastSuccess, lastFailure := health.lastSuccess, health.lastFailure
+	lastError := health.lastError
+	health.Unlock()
+	defer func() {
+		health.Lock()
+		health.lastSuccess, health.lastFailure = lastSuccess, lastFailure
+		health.lastError = lastError
+		health.Unlock()
+	}()
+	ago := func(age time.Duration) time.Time {
+		if age == never {
+			return time.Time{}
+		}
+		return time.Now().Add(-age)
+	}
+	for _, test := range tests {
+		health.Lock()
+		health.lastSuccess = ago(test.successAge)
+		health.lastFailure = ago(test.failureAge)
+		health.lastError = test.lastError
+		health.Unlock()
+		recorder := httptest.NewRecorder()
+		writeHealth(recorder, DEFAULT_HEALTH_WINDOW)
+		if recorder.Code != test.wantCode {
+			t.Errorf("%s: got status %d, want %d", test.name, recorder.Code,
+				test.wantCode)
+		}
+		if got := recorder.Body.String(); got != test.wantBody {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.wantBody)
+		}
+	}
+}
+
+func TestDefaultRegion(t *testing.T) {
+	tests := []struct {
+		name      string
+		address   string
+		option    string // CLOUDWATCH_REGION, as a route option
+		env       string // CLOUDWATCH_REGION, as an Environment variable
+		region    string // the region route option
+		ec2Region string
+		want      string
+	}{
+		{name: "address", address: "us-east-1", want: "us-east-1"},
+		{name: "env", address: "us-east-1", env: "eu-west-1",
+			want: "eu-west-1"},
+		{name: "option over env", address: "us-east-1", option: "eu-west-2",
+			env: "eu-west-1", want: "eu-west-2"},
+		{name: "region over option", address: "us-east-1",
+			option: "eu-west-2", env: "eu-west-1", region: "ap-south-1",
+			want: "ap-south-1"},
+		{name: "auto", address: "auto", ec2Region: "us-west-2",
+			want: "us-west-2"},
+		{name: "auto region", address: "us-east-1", region: "auto",
+			ec2Region: "us-west-2", want: "us-west-2"},
+	}
+	defer os.Unsetenv(`CLOUDWATCH_REGION`)
+	for _, test := range tests {
+		os.Setenv(`CLOUDWATCH_REGION`, test.env)
+		route := &router.Route{Address: test.address,
+			Options: map[string]string{}}
+		if test.option != "" {
+			route.Options[`CLOUDWATCH_REGION`] = test.option
+		}
+		if test.region != "" {
+			route.Options[`region`] = test.region
+		}
+		adapter := &CloudwatchAdapter{Route: route, Ec2Region: test.ec2Region}
+		region := defaultRegion(adapter)
+		if region != test.want {
+			t.Errorf("%s: got region %q, want %q", test.name, region,
+				test.want)
+		}
+		client := newCloudwatchClient(route, region)
+		if got := aws.StringValue(client.Config.Region); got != test.want {
+			t.Errorf("%s: got client region %q, want %q", test.name, got,
+				test.want)
+		}
+	}
+}
+
+func TestRegionOption(t *testing.T) {
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client,
+		map[string]string{`region`: `eu-central-1`})
+	runAdapter(adapter, testMessage("web", "hello"))
+	if got := client.clientRegions(); !sameStrings(got,
+		[]string{"eu-central-1"}) {
+		t.Errorf("got clients for regions %q, want only eu-central-1", got)
+	}
+}
+
+func TestCreateGroupOnce(t *testing.T) {
+	tests := []struct {
+		name   string
+		exists bool // if set, the group exists before the first upload
+		want   map[string]int
+	}{
+		{
+			name: "new group",
+			want: map[string]int{"DescribeLogGroups": 1, "CreateLogGroup": 1,
+				"DescribeLogStreams": 2, "CreateLogStream": 2,
+				"PutLogEvents": 3},
+		},
+		{
+			name:   "existing group",
+			exists: true,
+			want: map[string]int{"DescribeLogGroups": 1, "CreateLogGroup": 0,
+				"DescribeLogStreams": 2, "CreateLogStream": 2,
+				"PutLogEvents": 3},
+		},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		if test.exists {
+			client.groups[`test-group`] = true
+		}
+		adapter := newTestAdapter(t, client,
+			map[string]string{`CLOUDWATCH_BATCH_SIZE`: `1`})
+		runAdapter(adapter, testMessage("web", "one"),
+			testMessage("db", "two"), testMessage("web", "three"))
+		if got := len(client.messages()); got != 3 {
+			t.Errorf("%s: got %d messages, want 3", test.name, got)
+		}
+		for request, count := range test.want {
+			if got := client.callCount(request); got != count {
+				t.Errorf("%s: got %d %s requests, want %d", test.name, got,
+					request, count)
+			}
+		}
+	}
+}
+
+func TestRetentionDays(t *testing.T) {
+	tests := []struct {
+		name   string
+		days   string // CLOUDWATCH_RETENTION_DAYS
+		exists bool   // if set, the group exists before the first upload
+		want   int64  // the retention set for the group, or 0 if none
+	}{
+		{name: "new group", days: `14`, want: 14},
+		{name: "existing group", days: `14`, exists: true},
+		{name: "not allowed", days: `10`},
+		{name: "unset"},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		if test.exists {
+			client.groups[`test-group`] = true
+		}
+		adapter := newTestAdapter(t, client, map[string]string{
+			`CLOUDWATCH_RETENTION_DAYS`: test.days,
+			`CLOUDWATCH_BATCH_SIZE`:     `1`})
+		runAdapter(adapter, testMessage("web", "one"),
+			testMessage("web", "two"))
+		if got := client.retention[`test-group`]; got != test.want {
+			t.Errorf("%s: got a retention of %d days, want %d", test.name,
+				got, test.want)
+		}
+		calls, want := client.callCount("PutRetentionPolicy"), 0
+		if test.want != 0 {
+			want = 1
+		}
+		if calls != want {
+			t.Errorf("%s: got %d PutRetentionPolicy requests, want %d",
+				test.name, calls, want)
+		}
+	}
+}
+
+func TestKMSKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string // CLOUDWATCH_KMS_KEY_ID, if set
+		exists    bool   // if set, the group exists before the first upload
+		existing  string // the existing group's key, if any
+		want      string // the group's key after the upload
+		associate int    // the AssociateKmsKey requests
+	}{
+		{name: "new group", key: `key-1`, want: `key-1`},
+		{name: "existing group", key: `key-1`, exists: true, want: `key-1`,
+			associate: 1},
+		{name: "existing encrypted group", key: `key-1`, exists: true,
+			existing: `key-0`, want: `key-0`},
+		{name: "unset", exists: true},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		if test.exists {
+			client.groups[`test-group`] = true
+		}
+		if test.existing != "" {
+			client.keys[`test-group`] = test.existing
+		}
+		options := map[string]string{}
+		if test.key != "" {
+			options[`CLOUDWATCH_KMS_KEY_ID`] = test.key
+		}
+		adapter := newTestAdapter(t, client, options)
+		runAdapter(adapter, testMessage("web", "hello"))
+		if got := client.keys[`test-group`]; got != test.want {
+			t.Errorf("%s: got the group encrypted with %q, want %q",
+				test.name, got, test.want)
+		}
+		if got := client.callCount("AssociateKmsKey"); got != test.associate {
+			t.Errorf("%s: got %d AssociateKmsKey requests, want %d",
+				test.name, got, test.associate)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	client := newFakeLogs()
+	output, restore := captureLog()
+	adapter := newTestAdapter(t, client,
+		map[string]string{`CLOUDWATCH_DRY_RUN`: `true`})
+	runAdapter(adapter, testMessage("web", "one"), testMessage("web", "two"))
+	restore()
+	if len(client.calls) > 0 {
+		t.Errorf("got AWS requests %v, want none", client.calls)
+	}
+	want := "DRY RUN: PutLogEvents to test-group-web with 2 messages"
+	if logged := output.String(); !strings.Contains(logged, want) {
+		t.Errorf("got log:\n%s\nwant %q", logged, want)
+	}
+}
+
+func TestClientFactory(t *testing.T) {
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client, nil)
+	if _, isReal := Clients.(awsClientFactory); !isReal {
+		t.Errorf("got Clients %T after the adapter was created, want the "+
+			"AWS client factory", Clients)
+	}
+	runAdapter(adapter, testMessage("web", "hello"))
+	if got := client.clientRegions(); !sameStrings(got,
+		[]string{"us-east-1"}) {
+		t.Errorf("got clients created for regions %q, want us-east-1", got)
+	}
+	if got := client.messages(); !sameStrings(got, []string{"hello"}) {
+		t.Errorf("got %q uploaded by the fake client, want hello", got)
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string // CLOUDWATCH_ENDPOINT, if set
+		want     string
+	}{
+		{endpoint: "", want: "https://logs.us-east-1.amazonaws.com"},
+		{endpoint: "http://localhost:4566", want: "http://localhost:4566"},
+		{endpoint: "https://logs.example.com", want: "https://logs.example.com"},
+	}
+	for _, test := range tests {
+		route := &router.Route{Options: map[string]string{}}
+		if test.endpoint != "" {
+			route.Options[`CLOUDWATCH_ENDPOINT`] = test.endpoint
+		}
+		client := newCloudwatchClient(route, "us-east-1")
+		if got := client.Endpoint; got != test.want {
+			t.Errorf("endpoint %q: got %q, want %q", test.endpoint, got,
+				test.want)
+		}
+		wantPlain := strings.HasPrefix(test.endpoint, "http://")
+		if plain := aws.BoolValue(client.Config.DisableSSL); plain != wantPlain {
+			t.Errorf("endpoint %q: got SSL disabled %v, want %v",
+				test.endpoint, plain, wantPlain)
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	// the client uses the proxies set in the environment by default
+	route := &router.Route{Options: map[string]string{}}
+	client := newCloudwatchClient(route, "us-east-1")
+	transport := client.Config.HTTPClient.Transport.(*http.Transport)
+	if reflect.ValueOf(transport.Proxy).Pointer() !=
+		reflect.ValueOf(http.ProxyFromEnvironment).Pointer() {
+		t.Error("got a transport that ignores HTTP_PROXY and HTTPS_PROXY")
+	}
+	// CLOUDWATCH_PROXY overrides them
+	hosts := make(chan string, 10)
+	proxy := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			hosts <- r.Host
+			w.WriteHeader(http.StatusForbidden)
+		}))
+	defer proxy.Close()
+	route.Options[`CLOUDWATCH_PROXY`] = proxy.URL
+	route.Options[`CLOUDWATCH_ENDPOINT`] = `http://logs.example.com`
+	client = newCloudwatchClient(route, "us-east-1")
+	client.Config.Credentials = credentials.NewStaticCredentials(
+		`test-key`, `test-secret`, ``)
+	client.DescribeLogGroups(&cloudwatchlogs.DescribeLogGroupsInput{})
+	if len(hosts) == 0 {
+		t.Fatal("got no requests through CLOUDWATCH_PROXY")
+	}
+	if host := <-hosts; host != `logs.example.com` {
+		t.Errorf("got a request to %s through the proxy, want "+
+			"logs.example.com", host)
+	}
+}
+
+func TestCredentialsProfile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "credentials")
+	err := ioutil.WriteFile(filename, []byte("[default]\n"+
+		"aws_access_key_id = default-key\naws_secret_access_key = secret\n"+
+		"[team]\naws_access_key_id = team-key\naws_secret_access_key = secret\n"+
+		"[other]\naws_access_key_id = other-key\n"+
+		"aws_secret_access_key = secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(`AWS_SHARED_CREDENTIALS_FILE`, filename)
+	defer os.Unsetenv(`AWS_SHARED_CREDENTIALS_FILE`)
+	defer os.Unsetenv(`AWS_PROFILE`)
+	tests := []struct {
+		option string // CLOUDWATCH_PROFILE, if set
+		env    string // AWS_PROFILE
+		want   string // the access key used
+	}{
+		{option: `team`, want: `team-key`},
+		{env: `other`, want: `other-key`},
+		{option: `team`, env: `other`, want: `team-key`},
+	}
+	for _, test := range tests {
+		os.Setenv(`AWS_PROFILE`, test.env)
+		route := &router.Route{Options: map[string]string{}}
+		if test.option != "" {
+			route.Options[`CLOUDWATCH_PROFILE`] = test.option
+		}
+		client := newCloudwatchClient(route, "us-east-1")
+		creds, err := client.Config.Credentials.Get()
+		if err != nil {
+			t.Errorf("profile %q, AWS_PROFILE %q: got error %s", test.option,
+				test.env, err)
+		} else if creds.AccessKeyID != test.want {
+			t.Errorf("profile %q, AWS_PROFILE %q: got key %s, want %s",
+				test.option, test.env, creds.AccessKeyID, test.want)
+		}
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	hung := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			select { // until the client gives up, or the test ends
+			case <-r.Context().Done():
+			case <-hung:
+			}
+		}))
+	defer server.Close()
+	defer close(hung)
+	tests := []struct {
+		timeout string        // CLOUDWATCH_CLIENT_TIMEOUT, if set
+		want    time.Duration // the HTTP client's timeout
+	}{
+		{want: DEFAULT_CLIENT_TIMEOUT},
+		{timeout: `50ms`, want: 50 * time.Millisecond},
+	}
+	for _, test := range tests {
+		route := &router.Route{Options: map[string]string{
+			`CLOUDWATCH_ENDPOINT`: server.URL}}
+		if test.timeout != "" {
+			route.Options[`CLOUDWATCH_CLIENT_TIMEOUT`] = test.timeout
+		}
+		client := newCloudwatchClient(route, "us-east-1")
+		if got := client.Config.HTTPClient.Timeout; got != test.want {
+			t.Errorf("timeout %q: got %v, want %v", test.timeout, got,
+				test.want)
+		}
+		if test.timeout == "" {
+			continue // too long to wait for
+		}
+		client.Config.Credentials = credentials.NewStaticCredentials(
+			`test-key`, `test-secret`, ``)
+		started := time.Now()
+		_, err := client.DescribeLogGroups(
+			&cloudwatchlogs.DescribeLogGroupsInput{})
+		if err == nil {
+			t.Errorf("timeout %q: got no error from a hung request",
+				test.timeout)
+		} else if !isRetryable(err) {
+			t.Errorf("timeout %q: got error %s, which isn't retried",
+				test.timeout, err)
+		}
+		if took := time.Since(started); took > 10*test.want {
+			t.Errorf("timeout %q: got an error after %v", test.timeout, took)
+		}
+	}
+}
+
+func TestAssumeRole(t *testing.T) {
+	// the proxy records the hosts the client connects to, but refuses them
+	hosts := make(chan string, 10)
+	proxy := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			hosts <- r.Host
+			w.WriteHeader(http.StatusForbidden)
+		}))
+	defer proxy.Close()
+	os.Setenv(`AWS_ACCESS_KEY_ID`, `test-key`)
+	os.Setenv(`AWS_SECRET_ACCESS_KEY`, `test-secret`)
+	defer os.Unsetenv(`AWS_ACCESS_KEY_ID`)
+	defer os.Unsetenv(`AWS_SECRET_ACCESS_KEY`)
+	tests := []struct {
+		name    string
+		roleARN string // CLOUDWATCH_ROLE_ARN, if set
+	}{
+		{name: "role", roleARN: `arn:aws:iam::123456789012:role/logs`},
+		{name: "no role"},
+	}
+	for _, test := range tests {
+		route := &router.Route{Options: map[string]string{
+			`CLOUDWATCH_PROXY`: proxy.URL}}
+		if test.roleARN != "" {
+			route.Options[`CLOUDWATCH_ROLE_ARN`] = test.roleARN
+		}
+		client := newCloudwatchClient(route, "us-east-1")
+		// the role's credentials are requested from STS, through the proxy
+		_, err := client.Config.Credentials.Get()
+		if test.roleARN == "" {
+			if err != nil {
+				t.Errorf("%s: got error %s", test.name, err)
+			}
+			if len(hosts) > 0 {
+				t.Errorf("%s: got a request to %s", test.name, <-hosts)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: got credentials, want an error from STS", test.name)
+		}
+		if len(hosts) == 0 {
+			t.Errorf("%s: got no requests, want one to STS", test.name)
+		} else if host := <-hosts; !strings.HasPrefix(host, `sts.`) {
+			t.Errorf("%s: got a request to %s, want one to STS", test.name,
+				host)
+		}
+		for len(hosts) > 0 { // any retries
+			<-hosts
+		}
+	}
+}
+
+func TestInvalidSequenceToken(t *testing.T) {
+	client := newFakeLogs()
+	client.failWith("PutLogEvents",
+		&cloudwatchlogs.InvalidSequenceTokenException{
+			Message_:              aws.String("wrong token"),
+			ExpectedSequenceToken: aws.String("expected-token"),
+		}, 1)
+	adapter := newTestAdapter(t, client,
+		map[string]string{`CLOUDWATCH_RETRIES`: `0`})
+	runAdapter(adapter, testMessage("web", "hello"))
+	if got := client.messages(); !sameStrings(got, []string{"hello"}) {
+		t.Fatalf("got uploaded %q, want hello", got)
+	}
+	if got := client.callCount("PutLogEvents"); got != 2 {
+		t.Errorf("got %d PutLogEvents requests, want 2", got)
+	}
+	if got := client.puts[0].token; got != "expected-token" {
+		t.Errorf("got retried with token %q, want expected-token", got)
+	}
+}
+
+func TestDataAlreadyAccepted(t *testing.T) {
+	client := newFakeLogs()
+	client.failWith("PutLogEvents",
+		&cloudwatchlogs.DataAlreadyAcceptedException{
+			Message_:              aws.String("already accepted"),
+			ExpectedSequenceToken: aws.String("accepted-token"),
+		}, 1)
+	failed := drops.Total(DROP_DELIVERY_FAILED)
+	adapter := newTestAdapter(t, client, map[string]string{
+		`CLOUDWATCH_BATCH_SIZE`: `1`, `CLOUDWATCH_RETRIES`: `3`})
+	runAdapter(adapter, testMessage("web", "one"), testMessage("web", "two"))
+	// the first batch was accepted by the request that "failed"
+	if got := client.messages(); !sameStrings(got, []string{"two"}) {
+		t.Fatalf("got uploaded %q, want only two", got)
+	}
+	if got := client.callCount("PutLogEvents"); got != 2 {
+		t.Errorf("got %d PutLogEvents requests, want 2", got)
+	}
+	if got := client.puts[0].token; got != "accepted-token" {
+		t.Errorf("got the next batch sent with token %q, want accepted-token",
+			got)
+	}
+	if got := drops.Total(DROP_DELIVERY_FAILED) - failed; got != 0 {
+		t.Errorf("got %d messages dropped as failed, want 0", got)
+	}
+}
+
+func TestSortedEvents(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	offsets := []int{3, 0, 4, 1, 2} // seconds after start
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client, nil)
+	msgs := []*router.Message{}
+	for _, offset := range offsets {
+		msg := testMessage("web", fmt.Sprintf("m%d", offset))
+		msg.Time = start.Add(time.Duration(offset) * time.Second)
+		msgs = append(msgs, msg)
+	}
+	runAdapter(adapter, msgs...)
+	want := []string{"m0", "m1", "m2", "m3", "m4"}
+	if got := client.messages(); !sameStrings(got, want) {
+		t.Errorf("got uploaded %q, want %q", got, want)
+	}
+	times := client.times()
+	for i := 1; i < len(times); i++ {
+		if times[i] < times[i-1] {
+			t.Errorf("got timestamps %v, want them sorted", times)
+			break
+		}
+	}
+}
+
+func TestRejectedBatch(t *testing.T) {
+	tests := []struct {
+		name string
+		info *cloudwatchlogs.RejectedLogEventsInfo
+		want string // the rejected messages
+	}{
+		{name: "none", want: ""},
+		{
+			name: "too old",
+			info: &cloudwatchlogs.RejectedLogEventsInfo{
+				TooOldLogEventEndIndex: aws.Int64(2)},
+			want: "m0 m1",
+		},
+		{
+			name: "expired",
+			info: &cloudwatchlogs.RejectedLogEventsInfo{
+				ExpiredLogEventEndIndex: aws.Int64(1)},
+			want: "m0",
+		},
+		{
+			name: "too new",
+			info: &cloudwatchlogs.RejectedLogEventsInfo{
+				TooNewLogEventStartIndex: aws.Int64(3)},
+			want: "m3",
+		},
+		{
+			name: "too old and too new",
+			info: &cloudwatchlogs.RejectedLogEventsInfo{
+				TooOldLogEventEndIndex:   aws.Int64(1),
+				ExpiredLogEventEndIndex:  aws.Int64(2),
+				TooNewLogEventStartIndex: aws.Int64(3)},
+			want: "m0 m1 m3",
+		},
+		{
+			name: "out of range",
+			info: &cloudwatchlogs.RejectedLogEventsInfo{
+				TooOldLogEventEndIndex:   aws.Int64(3),
+				TooNewLogEventStartIndex: aws.Int64(1)},
+			want: "m0 m1 m2 m3",
+		},
+	}
+	msgs := testBatch(0, 4).Msgs
+	for _, test := range tests {
+		batch := rejectedBatch(msgs, test.info)
+		texts := []string{}
+		var size int64
+		for _, msg := range batch.Msgs {
+			texts = append(texts, msg.Message)
+			size = size + msgSize(msg)
+		}
+		if got := strings.Join(texts, " "); got != test.want {
+			t.Errorf("%s: got rejected %q, want %q", test.name, got,
+				test.want)
+		}
+		if batch.Size != size {
+			t.Errorf("%s: got size %d, want %d", test.name, batch.Size, size)
+		}
+	}
+}
+
+func TestRejectedEvents(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	client := newFakeLogs()
+	client.rejected = &cloudwatchlogs.RejectedLogEventsInfo{
+		TooOldLogEventEndIndex: aws.Int64(1)}
+	adapter := newTestAdapter(t, client,
+		map[string]string{`CLOUDWATCH_DEADLETTER_DIR`: dir})
+	shipped, rejected := eventsShipped.Value(), eventsRejected.Value()
+	drops.Reset()
+	old := testMessage("web", "old")
+	old.Time = time.Now().Add(-time.Hour)
+	runAdapter(adapter, testMessage("web", "new"), old)
+	if got := eventsShipped.Value() - shipped; got != 1 {
+		t.Errorf("got %d events shipped, want 1", got)
+	}
+	if got := eventsRejected.Value() - rejected; got != 1 {
+		t.Errorf("got %d events rejected, want 1", got)
+	}
+	if got := drops.Reset()[DROP_REJECTED]; got != 1 {
+		t.Errorf("got %d dropped as rejected, want 1", got)
+	}
+	got := readMessages(t, dir, `batch-`)
+	if !sameStrings(got, []string{"old"}) {
+		t.Errorf("got dead letters %q, want the old message", got)
+	}
+}
+
+func TestDebugStreams(t *testing.T) {
+	client := newFakeLogs()
+	adapter := newTestAdapter(t, client,
+		map[string]string{`LOGSPOUT_GROUP`: `debug-ok`})
+	runAdapter(adapter, testMessage("web", "hello"))
+	client = newFakeLogs()
+	client.failWith("PutLogEvents", errAccessDenied, 1)
+	adapter = newTestAdapter(t, client,
+		map[string]string{`LOGSPOUT_GROUP`: `debug-failed`})
+	runAdapter(adapter, testMessage("web", "hello"))
+	recorder := httptest.NewRecorder()
+	writeDebug(recorder, httptest.NewRequest("GET", "/debug/streams", nil))
+	if got := recorder.Header().Get("Content-Type"); got !=
+		"application/json" {
+		t.Errorf("got content type %q, want application/json", got)
+	}
+	streams := []streamDebugInfo{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &streams); err != nil {
+		t.Fatal("parsing the stream state:", err)
+	}
+	found := map[string]streamDebugInfo{}
+	for _, info := range streams {
+		found[info.Group+"-"+info.Stream] = info
+	}
+	ok, exists := found["debug-ok-web"]
+	if !exists {
+		t.Fatalf("got streams %+v, want debug-ok-web", streams)
+	}
+	if (ok.SequenceToken != "token") || (ok.LastError != "") ||
+		(ok.BufferedEvents != 0) || ok.LastFlush.IsZero() {
+		t.Errorf("got %+v, want the token and no error for debug-ok-web", ok)
+	}
+	failed, exists := found["debug-failed-web"]
+	if !exists {
+		t.Fatalf("got streams %+v, want debug-failed-web", streams)
+	}
+	if !strings.Contains(failed.LastError, "AccessDenied") ||
+		(failed.LastErrorTime == nil) {
+		t.Errorf("got %+v, want the error for debug-failed-web", failed)
+	}
+}
+
+var errNotFound = awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException,
+	"The specified log stream does not exist.", nil)
+
+func TestRecreateStream(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int // not-found errors, from the first put
+		wantMessages []string
+		wantTokens   []string
+	}{
+		{
+			name:         "recreated",
+			failures:     1,
+			wantMessages: []string{"one", "two"},
+			wantTokens:   []string{"", "token"}, // the new stream has none
+		},
+		{
+			name:         "retried once",
+			failures:     2,
+			wantMessages: []string{"two"},
+			wantTokens:   []string{""},
+		},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		client.failWith("PutLogEvents", errNotFound, test.failures)
+		adapter := newTestAdapter(t, client,
+			map[string]string{`CLOUDWATCH_BATCH_SIZE`: `1`})
+		runAdapter(adapter, testMessage("web", "one"),
+			testMessage("web", "two"))
+		if got := client.messages(); !sameStrings(got, test.wantMessages) {
+			t.Errorf("%s: got uploaded %q, want %q", test.name, got,
+				test.wantMessages)
+		}
+		tokens := []string{}
+		for _, put := range client.puts {
+			tokens = append(tokens, put.token)
+		}
+		if !sameStrings(tokens, test.wantTokens) {
+			t.Errorf("%s: got tokens %q, want %q", test.name, tokens,
+				test.wantTokens)
+		}
+		if got := client.callCount("CreateLogStream"); got != 2 {
+			t.Errorf("%s: got %d streams created, want 2", test.name, got)
+		}
+	}
+}
+
+func TestRetentionLabel(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		labels  map[string]string
+		want    int64 // the retention set for the group, or 0 if none
+	}{
+		{
+			name:    "label",
+			options: map[string]string{`CLOUDWATCH_RETENTION_DAYS`: `14`},
+			labels:  map[string]string{`CLOUDWATCH_RETENTION_DAYS`: `90`},
+			want:    90,
+		},
+		{
+			name:    "no label",
+			options: map[string]string{`CLOUDWATCH_RETENTION_DAYS`: `14`},
+			want:    14,
+		},
+		{
+			name:    "not allowed",
+			options: map[string]string{`CLOUDWATCH_RETENTION_DAYS`: `14`},
+			labels:  map[string]string{`CLOUDWATCH_RETENTION_DAYS`: `10`},
+			want:    14,
+		},
+		{
+			name:    "not a number",
+			options: map[string]string{`CLOUDWATCH_RETENTION_DAYS`: `14`},
+			labels:  map[string]string{`CLOUDWATCH_RETENTION_DAYS`: `forever`},
+			want:    14,
+		},
+		{
+			name:   "no default",
+			labels: map[string]string{`CLOUDWATCH_RETENTION_DAYS`: `30`},
+			want:   30,
+		},
+		{
+			name: "custom label",
+			options: map[string]string{
+				`CLOUDWATCH_RETENTION_LABEL`: `com.example.logs.retention`},
+			labels: map[string]string{`com.example.logs.retention`: `7`,
+				`CLOUDWATCH_RETENTION_DAYS`: `30`},
+			want: 7,
+		},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		adapter := newTestAdapter(t, client, test.options)
+		msg := testMessage("web", "hello")
+		msg.Container.Config.Labels = test.labels
+		runAdapter(adapter, msg)
+		if got := client.retention[`test-group`]; got != test.want {
+			t.Errorf("%s: got a retention of %d days, want %d", test.name,
+				got, test.want)
+		}
+	}
+}
+
+func TestCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+			fmt.Fprint(w, `{"logGroups": []}`)
+		}))
+	defer server.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "ca.pem")
+	err := ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+	if err != nil {
+		t.Fatal("writing the CA bundle:", err)
+	}
+	tests := []struct {
+		name    string
+		bundle  string // CLOUDWATCH_CA_BUNDLE, if set
+		trusted bool   // if set, the client trusts the server's certificate
+	}{
+		{name: "system roots"},
+		{name: "bundle", bundle: bundle, trusted: true},
+		{name: "missing bundle", bundle: filepath.Join(dir, "missing.pem")},
+	}
+	for _, test := range tests {
+		route := &router.Route{Options: map[string]string{
+			`CLOUDWATCH_ENDPOINT`: server.URL}}
+		if test.bundle != "" {
+			route.Options[`CLOUDWATCH_CA_BUNDLE`] = test.bundle
+		}
+		client := newCloudwatchClient(route, "us-east-1")
+		client.Config.Credentials = credentials.NewStaticCredentials(
+			`test-key`, `test-secret`, ``)
+		transport := client.Config.HTTPClient.Transport.(*http.Transport)
+		if test.trusted && ((transport.TLSClientConfig == nil) ||
+			(transport.TLSClientConfig.RootCAs == nil)) {
+			t.Errorf("%s: got no RootCAs in the transport", test.name)
+		}
+		_, err := client.DescribeLogGroups(
+			&cloudwatchlogs.DescribeLogGroupsInput{})
+		if test.trusted && (err != nil) {
+			t.Errorf("%s: got %s, want the request to succeed", test.name,
+				err)
+		}
+		if !test.trusted && (err == nil) {
+			t.Errorf("%s: got no error, want the certificate rejected",
+				test.name)
+		}
+	}
+}
+
+func TestAWSRetryer(t *testing.T) {
+	requests := make(chan bool, 10)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests <- true
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+	defer server.Close()
+	tests := []struct {
+		option string // CLOUDWATCH_AWS_MAX_RETRIES, if set
+		want   int    // the requests made
+	}{
+		{want: 1}, // the adapter retries, the SDK doesn't
+		{option: "2", want: 3},
+	}
+	for _, test := range tests {
+		route := &router.Route{Options: map[string]string{
+			`CLOUDWATCH_ENDPOINT`: server.URL}}
+		if test.option != "" {
+			route.Options[`CLOUDWATCH_AWS_MAX_RETRIES`] = test.option
+		}
+		client := newCloudwatchClient(route, "us-east-1")
+		client.Config.Credentials = credentials.NewStaticCredentials(
+			`test-key`, `test-secret`, ``)
+		_, err := client.DescribeLogGroups(
+			&cloudwatchlogs.DescribeLogGroupsInput{})
+		if err == nil {
+			t.Errorf("retries %q: got no error, want the last failure",
+				test.option)
+		}
+		if got := len(requests); got != test.want {
+			t.Errorf("retries %q: got %d requests, want %d", test.option, got,
+				test.want)
+		}
+		for len(requests) > 0 {
+			<-requests
+		}
+	}
+}
+
+func TestMonotonicTimestamps(t *testing.T) {
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+	millis := epochMillis(start)
+	tests := []struct {
+		monotonic string // CLOUDWATCH_MONOTONIC_TIMESTAMPS, if set
+		want      []int64
+	}{
+		{want: []int64{millis + 10000, millis + 20000, millis + 5000,
+			millis + 30000}},
+		{monotonic: `true`, want: []int64{millis + 10000, millis + 20000,
+			millis + 20000, millis + 30000}},
+	}
+	for _, test := range tests {
+		client := newFakeLogs()
+		options := map[string]string{`CLOUDWATCH_BATCH_SIZE`: `2`}
+		if test.monotonic != "" {
+			options[`CLOUDWATCH_MONOTONIC_TIMESTAMPS`] = test.monotonic
+		}
+		adapter := newTestAdapter(t, client, options)
+		msgs := []*router.Message{}
+		// the second batch goes back in time
+		for _, seconds := range []int{10, 20, 5, 30} {
+			msg := testMessage("web", fmt.Sprintf("at %ds", seconds))
+			msg.Time = start.Add(time.Duration(seconds) * time.Second)
+			msgs = append(msgs, msg)
+		}
+		runAdapter(adapter, msgs...)
+		if got := client.times(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("monotonic %q: got times %v, want %v", test.monotonic,
+				got, test.want)
+		}
+		// the messages themselves are unchanged
+		want := []string{"at 10s", "at 20s", "at 5s", "at 30s"}
+		if got := client.messages(); !sameStrings(got, want) {
+			t.Errorf("monotonic %q: got %q, want %q", test.monotonic, got,
+				want)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package cloudwatch
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+const DEFAULT_WAL_MAX_MB = 100       // total size of the write-ahead log
+const WAL_SEGMENT_SIZE = 1024 * 1024 // bytes written to each file, at most
+
+// ends the name of the file that lists the released records of a segment
+const RELEASED_EXTENSION = ".released"
+
+// WriteAheadLog stores each message in a file until it has been uploaded,
+// or saved as a dead letter, so the messages still in memory, or in batches
+// that failed to upload, can be replayed after a restart.
+// Messages are written as newline-delimited JSON to a series of segment
+// files, and each file is deleted once all its messages have been released.
+// Until then, the positions of its released messages are listed in another
+// file, so they aren't replayed. The oldest files are deleted to keep the
+// log under its size limit, even if their messages are pending.
+type WriteAheadLog struct {
+	sync.Mutex
+	path     string
+	maxBytes int64
+	segments []*walSegment // oldest first - the last one may be current
+	file     *os.File      // the current segment's file, or nil
+	compress bool          // if set, gzip each new segment
+	gzip     *gzip.Writer  // compresses the current segment, if set
+}
+
+// walSegment is a single file of a WriteAheadLog.
+type walSegment struct {
+	wal     *WriteAheadLog
+	name    string
+	size    int64
+	records int // messages written to the file
+	pending int // messages written to the file, but not yet released
+	// the positions of the released messages not yet listed in its file
+	unsaved []int
+}
+
+// walRecord is a message written to a segment of a WriteAheadLog.
+type walRecord struct {
+	segment *walSegment
+	index   int // the message's position in the segment
+	pending int // parts of the message not yet released
+	// the records of lines joined to this message, released along with it
+	joined []*walRecord
+}
+
+// constructor for WriteAheadLog - returns nil unless CLOUDWATCH_WAL_DIR
+// is set, or if the directory can't be created. Also returns the messages
+// left in the directory by a previous run, which are written to the new
+// log before the old files are deleted.
+func NewWriteAheadLog(route *router.Route) (*WriteAheadLog,
+	[]CloudwatchMessage) {
+	path, isSet := getOption(route, `CLOUDWATCH_WAL_DIR`)
+	if !isSet {
+		return nil, nil
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		log.Println("cloudwatch: ERROR creating write-ahead log directory:", err)
+		return nil, nil
+	}
+	maxMB := getIntOption(route, `CLOUDWATCH_WAL_MAX_MB`, DEFAULT_WAL_MAX_MB)
+	if maxMB < 1 {
+		log.Printf("cloudwatch: WARNING: CLOUDWATCH_WAL_MAX_MB must be at "+
+			"least 1, using %d\n", DEFAULT_WAL_MAX_MB)
+		maxMB = DEFAULT_WAL_MAX_MB
+	}
+	wal := &WriteAheadLog{
+		path:     path,
+		maxBytes: int64(maxMB) * 1024 * 1024,
+		compress: getBoolOption(route, `CLOUDWATCH_SPILL_GZIP`, false),
+	}
+	oldFiles, replayed := wal.readAll()
+	for i := range replayed {
+		if err := wal.Append(&replayed[i]); err != nil {
+			log.Println("cloudwatch: ERROR writing to write-ahead log:", err)
+		}
+	}
+	for _, name := range oldFiles {
+		if err := os.Remove(name); err != nil {
+			log.Println("cloudwatch: ERROR deleting write-ahead log file:", err)
+		}
+	}
+	return wal, replayed
+}
+
+// Writes the message to the current segment, and sets the message's
+// record, so it can be released once it's uploaded.
+func (w *WriteAheadLog) Append(msg *CloudwatchMessage) error {
+	w.Lock()
+	defer w.Unlock()
+	if w.file == nil { // start a new segment
+		name := filepath.Join(w.path,
+			fmt.Sprintf("wal-%d.log", time.Now().UnixNano()))
+		if w.compress {
+			name = name + GZIP_EXTENSION
+		}
+		file, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		w.file = file
+		if w.compress {
+			w.gzip = gzip.NewWriter(file)
+		}
+		w.segments = append(w.segments, &walSegment{wal: w, name: name})
+	}
+	record, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	segment := w.segments[len(w.segments)-1]
+	if err = w.write(append(record, '\n')); err != nil {
+		return err
+	}
+	// the file's size on disk, after compression
+	if segment.size, err = w.file.Seek(0, io.SeekCurrent); err != nil {
+		return err
+	}
+	msg.wal = &walRecord{segment: segment, index: segment.records, pending: 1}
+	segment.records++
+	segment.pending++
+	if segment.size >= WAL_SEGMENT_SIZE {
+		w.closeFile()
+	}
+	w.prune()
+	return nil
+}
+
+// Writes a record to the current segment, compressing it if needed. Each
+// compressed record is flushed, so it can be read back after a crash.
+func (w *WriteAheadLog) write(record []byte) error {
+	if w.gzip == nil {
+		_, err := w.file.Write(record)
+		return err
+	}
+	if _, err := w.gzip.Write(record); err != nil {
+		return err
+	}
+	return w.gzip.Flush()
+}
+
+// Reads the unreleased messages from all the segment files in the
+// directory, oldest first, and returns the paths of the segment files and
+// the files listing their released messages, and the messages. A file's
+// records are read up to the first one that is incomplete or corrupt.
+func (w *WriteAheadLog) readAll() ([]string, []CloudwatchMessage) {
+	files, err := ioutil.ReadDir(w.path) // sorted by name, so oldest first
+	if err != nil {
+		log.Println("cloudwatch: ERROR reading write-ahead log:", err)
+		return nil, nil
+	}
+	names, msgs := []string{}, []CloudwatchMessage{}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), `wal-`) ||
+			strings.HasSuffix(file.Name(), RELEASED_EXTENSION) {
+			continue
+		}
+		name := filepath.Join(w.path, file.Name())
+		fileMsgs, err := readSegment(name)
+		if err != nil {
+			log.Printf("cloudwatch: WARNING: ignoring the rest of write-ahead "+
+				"log file %s: %s\n", name, err)
+		}
+		names = append(names, name)
+		released, err := readReleased(name + RELEASED_EXTENSION)
+		if err == nil {
+			names = append(names, name+RELEASED_EXTENSION)
+		} else if !os.IsNotExist(err) {
+			log.Printf("cloudwatch: WARNING: ERROR reading the released "+
+				"messages of write-ahead log file %s: %s\n", name, err)
+		}
+		for i, msg := range fileMsgs {
+			if !released[i] {
+				msgs = append(msgs, msg)
+			}
+		}
+	}
+	return names, msgs
+}
+
+// Reads the positions of the released messages listed in the given file.
+// An incomplete line at the end is ignored.
+func readReleased(name string) (map[int]bool, error) {
+	text, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	released := map[int]bool{}
+	lines := strings.Split(string(text), "\n")
+	for _, line := range lines[:len(lines)-1] { // after the last newline
+		if index, err := strconv.Atoi(line); err == nil {
+			released[index] = true
+		}
+	}
+	return released, nil
+}
+
+// Reads the messages from a segment file, up to the first record that
+// is incomplete or corrupt, if any, which is returned as an error.
+func readSegment(name string) ([]CloudwatchMessage, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var input io.Reader = file
+	if strings.HasSuffix(name, GZIP_EXTENSION) {
+		unzipped, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer unzipped.Close()
+		input = unzipped
+	}
+	msgs := []CloudwatchMessage{}
+	reader := bufio.NewReader(input)
+	for {
+		record, err := reader.ReadBytes('\n')
+		// a compressed file may end after its last complete record, without
+		// its trailer, if it was still being written
+		if ((err == io.EOF) || (err == io.ErrUnexpectedEOF)) &&
+			(len(record) == 0) {
+			return msgs, nil
+		}
+		if (err == io.EOF) || (err == io.ErrUnexpectedEOF) {
+			return msgs, fmt.Errorf("incomplete record")
+		}
+		if err != nil {
+			return msgs, err
+		}
+		var msg CloudwatchMessage
+		if err = json.Unmarshal(record, &msg); err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// Deletes the oldest segments until the log is under its size limit.
+func (w *WriteAheadLog) prune() {
+	var totalBytes int64
+	for _, segment := range w.segments {
+		totalBytes = totalBytes + segment.size
+	}
+	for (len(w.segments) > 0) && (totalBytes > w.maxBytes) {
+		segment := w.segments[0]
+		log.Println("cloudwatch: WARNING: write-ahead log is full, deleting",
+			segment.name)
+		totalBytes = totalBytes - segment.size
+		w.remove(0)
+	}
+}
+
+// Deletes the segments whose messages are all released.
+func (w *WriteAheadLog) removeReleased() {
+	for i := len(w.segments) - 1; i >= 0; i-- {
+		if w.segments[i].pending <= 0 {
+			w.remove(i)
+		}
+	}
+}
+
+// Deletes the segment at the given position, and the file listing its
+// released messages, closing its file first if it's current.
+func (w *WriteAheadLog) remove(i int) {
+	segment := w.segments[i]
+	if (i == len(w.segments)-1) && (w.file != nil) {
+		w.closeFile()
+	}
+	if err := os.Remove(segment.name); err != nil {
+		log.Println("cloudwatch: ERROR deleting write-ahead log file:", err)
+	}
+	err := os.Remove(segment.name + RELEASED_EXTENSION)
+	if (err != nil) && !os.IsNotExist(err) {
+		log.Println("cloudwatch: ERROR deleting write-ahead log file:", err)
+	}
+	w.segments = append(w.segments[:i], w.segments[i+1:]...)
+}
+
+// Lists the positions of the messages released since the last call in the
+// files of their segments, so they aren't replayed after a restart. If this
+// fails, they may be uploaded twice.
+func (w *WriteAheadLog) saveReleased() {
+	for _, segment := range w.segments {
+		if len(segment.unsaved) == 0 {
+			continue
+		}
+		text := ""
+		for _, index := range segment.unsaved {
+			text = text + strconv.Itoa(index) + "\n"
+		}
+		segment.unsaved = nil
+		file, err := os.OpenFile(segment.name+RELEASED_EXTENSION,
+			os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = file.WriteString(text)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			log.Println("cloudwatch: ERROR writing to write-ahead log:", err)
+		}
+	}
+}
+
+func (w *WriteAheadLog) closeFile() {
+	if w.gzip != nil {
+		if err := w.gzip.Close(); err != nil {
+			log.Println("cloudwatch: ERROR closing write-ahead log file:", err)
+		}
+		w.gzip = nil
+	}
+	if err := w.file.Close(); err != nil {
+		log.Println("cloudwatch: ERROR closing write-ahead log file:", err)
+	}
+	w.file = nil
+}
+
+// Adds n parts to the message, as when it's split, which are each released
+// separately.
+func (r *walRecord) Add(n int) {
+	if r == nil {
+		return
+	}
+	r.segment.wal.Lock()
+	defer r.segment.wal.Unlock()
+	r.pending = r.pending + n
+}
+
+// Makes the given record be released along with this one, as when its line
+// is joined to this record's message, so it's replayed if this one is.
+func (r *walRecord) Join(other *walRecord) {
+	if r == nil {
+		other.Release()
+		return
+	}
+	if other == nil {
+		return
+	}
+	r.segment.wal.Lock()
+	defer r.segment.wal.Unlock()
+	r.joined = append(r.joined, other)
+}
+
+// Releases a part of the message, once it has been uploaded or dropped,
+// deleting any segments that are no longer needed.
+func (r *walRecord) Release() {
+	if r == nil {
+		return
+	}
+	r.segment.wal.Lock()
+	defer r.segment.wal.Unlock()
+	r.release()
+	r.segment.wal.removeReleased()
+	r.segment.wal.saveReleased()
+}
+
+// Releases a part of the message, and once every part is released, the
+// message itself and the records joined to it.
+func (r *walRecord) release() {
+	r.pending--
+	if r.pending != 0 {
+		return
+	}
+	r.segment.pending--
+	r.segment.unsaved = append(r.segment.unsaved, r.index)
+	for _, joined := range r.joined {
+		joined.release()
+	}
+}
+
+// releases each of the batch's messages from the write-ahead log
+func releaseBatch(batch CloudwatchBatch) {
+	var wal *WriteAheadLog // every message comes from the same adapter
+	for _, msg := range batch.Msgs {
+		if msg.wal != nil {
+			wal = msg.wal.segment.wal
+			break
+		}
+	}
+	if wal == nil {
+		return
+	}
+	wal.Lock()
+	defer wal.Unlock()
+	for _, msg := range batch.Msgs {
+		if msg.wal != nil {
+			msg.wal.release()
+		}
+	}
+	wal.removeReleased()
+	wal.saveReleased()
+}